@@ -0,0 +1,134 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"strings"
+)
+
+// addrRules maps the ranges of IP, as 10.0.0.0/8, and of ports, as :22 or
+// :8000-8999, to the items. The longest prefix of IP, or the narrowest range
+// of ports wins.
+type addrRules struct {
+	cidrs []cidrRule
+	ports []portRule
+}
+
+type cidrRule struct {
+	ipnet *net.IPNet
+	it    *item
+}
+
+type portRule struct {
+	lo, hi int
+	it     *item
+}
+
+// parsePorts parses the range of ports of pattern, as :22 or :8000-8999.
+func parsePorts(pattern string) (lo, hi int, ok bool) {
+	if !strings.HasPrefix(pattern, ":") {
+		return 0, 0, false
+	}
+	t := strings.SplitN(pattern[1:], "-", 2)
+	lo, err := strconv.Atoi(t[0])
+	if err != nil {
+		return 0, 0, false
+	}
+	hi = lo
+	if len(t) == 2 {
+		if hi, err = strconv.Atoi(t[1]); err != nil {
+			return 0, 0, false
+		}
+	}
+	return lo, hi, lo >= 0 && lo <= hi && hi <= 65535
+}
+
+// Set stores it by pattern, it returns false if pattern is not a range of IP
+// or ports.
+func (a *addrRules) Set(pattern string, it *item) bool {
+	if _, ipnet, err := net.ParseCIDR(pattern); err == nil {
+		for i, r := range a.cidrs {
+			if r.ipnet.String() == ipnet.String() {
+				a.cidrs[i].it = it
+				return true
+			}
+		}
+		a.cidrs = append(a.cidrs, cidrRule{ipnet: ipnet, it: it})
+		return true
+	}
+	if lo, hi, ok := parsePorts(pattern); ok {
+		for i, r := range a.ports {
+			if r.lo == lo && r.hi == hi {
+				a.ports[i].it = it
+				return true
+			}
+		}
+		a.ports = append(a.ports, portRule{lo: lo, hi: hi, it: it})
+		return true
+	}
+	return false
+}
+
+// Get returns the item of pattern itself.
+func (a *addrRules) Get(pattern string) (*item, bool) {
+	if _, ipnet, err := net.ParseCIDR(pattern); err == nil {
+		for _, r := range a.cidrs {
+			if r.ipnet.String() == ipnet.String() {
+				return r.it, true
+			}
+		}
+	}
+	if lo, hi, ok := parsePorts(pattern); ok {
+		for _, r := range a.ports {
+			if r.lo == lo && r.hi == hi {
+				return r.it, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// MatchIP returns the item of the longest range containing one of ips.
+func (a *addrRules) MatchIP(ips []net.IP) (*item, bool) {
+	var found *item
+	longest := -1
+	for _, r := range a.cidrs {
+		ones, _ := r.ipnet.Mask.Size()
+		if ones <= longest {
+			continue
+		}
+		for _, ip := range ips {
+			if r.ipnet.Contains(ip) {
+				found, longest = r.it, ones
+				break
+			}
+		}
+	}
+	return found, found != nil
+}
+
+// MatchPort returns the item of the narrowest range containing port.
+func (a *addrRules) MatchPort(port int) (*item, bool) {
+	var found *item
+	width := 65536
+	for _, r := range a.ports {
+		if port >= r.lo && port <= r.hi && r.hi-r.lo < width {
+			found, width = r.it, r.hi-r.lo
+		}
+	}
+	return found, found != nil
+}
+
+// Walk calls fn with the patterns and their items, the ranges of IP first.
+func (a *addrRules) Walk(fn func(pattern string, it *item)) {
+	for _, r := range a.cidrs {
+		fn(r.ipnet.String(), r.it)
+	}
+	for _, r := range a.ports {
+		pattern := ":" + strconv.Itoa(r.lo)
+		if r.hi != r.lo {
+			pattern += "-" + strconv.Itoa(r.hi)
+		}
+		fn(pattern, r.it)
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// maxAuthRounds is the max number of 407 replies in a handshake.
+const maxAuthRounds = 4
+
+var errAuthFailed = errors.New("Proxy authentication failed")
+
+// Authenticator authenticates the requests to the proxy by a scheme of
+// Proxy-Authenticate.
+type Authenticator interface {
+	// Scheme is the name of the scheme, e.g. "NTLM".
+	Scheme() string
+	// NewSession starts a handshake.
+	NewSession() AuthSession
+}
+
+// AuthSession is a handshake of an Authenticator.
+type AuthSession interface {
+	// Authorize returns the Proxy-Authorization of req, in response to the
+	// challenge, which is the parameters of the scheme in Proxy-Authenticate.
+	// The challenge is empty if the proxy has not replied yet, and it returns
+	// "" if nothing can be sent before the challenge.
+	Authorize(req *http.Request, challenge string) (string, error)
+}
+
+// schemeRank orders the schemes, the stronger first.
+var schemeRank = map[string]int{"ntlm": 3, "digest": 2, "basic": 1}
+
+// ProxyAuth authenticates to the proxy by the strongest scheme it offers.
+// The scheme is remembered, so the later handshakes start with it directly.
+type ProxyAuth struct {
+	auths []Authenticator
+
+	lock   sync.Mutex
+	scheme string
+}
+
+// NewProxyAuth returns the ProxyAuth of user with password, by NTLM, Digest
+// or Basic. The hex of the NT hash can be given rather than the password,
+// for NTLM only. For NTLM, user is DOMAIN\user or user@DOMAIN, and if it is
+// empty, it is the current user of Windows.
+func NewProxyAuth(user, password, hash string) (*ProxyAuth, error) {
+	if user == "" {
+		a, err := currentUser()
+		if err != nil {
+			return nil, err
+		}
+		return newProxyAuth(a), nil
+	}
+	var domain string
+	name := user
+	if i := strings.Index(name, `\`); i >= 0 {
+		domain, name = name[:i], name[i+1:]
+	} else if i := strings.LastIndex(name, "@"); i >= 0 {
+		name, domain = name[:i], name[i+1:]
+	}
+	if hash != "" {
+		a, err := NewNTLMHashAuthenticator(domain, name, hash)
+		if err != nil {
+			return nil, err
+		}
+		return newProxyAuth(a), nil
+	}
+	return newProxyAuth(
+		NewNTLMAuthenticator(domain, name, password),
+		&digestAuthenticator{user: user, password: password},
+		&basicAuthenticator{user: user, password: password},
+	), nil
+}
+
+func newProxyAuth(auths ...Authenticator) *ProxyAuth {
+	sort.SliceStable(auths, func(i, j int) bool {
+		return schemeRank[strings.ToLower(auths[i].Scheme())] > schemeRank[strings.ToLower(auths[j].Scheme())]
+	})
+	return &ProxyAuth{auths: auths}
+}
+
+// authHandshake authenticates a request, and the requests after it on the
+// same connection.
+type authHandshake struct {
+	auth    *ProxyAuth
+	scheme  string
+	session AuthSession
+}
+
+// start starts the handshake of req, by the scheme chosen last time if any.
+// If authed, the connection is authenticated already by a connection based
+// scheme, and nothing is sent. It reports whether req is authorized then,
+// rather than a step of the handshake.
+func (a *ProxyAuth) start(req *http.Request, authed bool) (*authHandshake, bool, error) {
+	h := &authHandshake{auth: a}
+	if a == nil {
+		return h, authed, nil
+	}
+	a.lock.Lock()
+	scheme := a.scheme
+	a.lock.Unlock()
+	if authed {
+		h.scheme = scheme
+		return h, true, nil
+	}
+	for _, au := range a.auths {
+		if au.Scheme() == scheme {
+			h.scheme, h.session = scheme, au.NewSession()
+			if err := h.authorize(req, ""); err != nil {
+				return nil, false, err
+			}
+			return h, !persistent(scheme) && req.Header.Get("Proxy-Authorization") != "", nil
+		}
+	}
+	return h, false, nil
+}
+
+// connected reports whether the handshake authenticates the connection,
+// rather than the request.
+func (h *authHandshake) connected() bool {
+	return h.session != nil && persistent(h.scheme)
+}
+
+// persistent reports whether scheme authenticates the connection.
+func persistent(scheme string) bool {
+	return strings.EqualFold(scheme, "NTLM") || strings.EqualFold(scheme, "Negotiate")
+}
+
+// respond sets the Proxy-Authorization of req in response to resp, the 407
+// reply. It reports whether req is authorized then, rather than a step of
+// the handshake.
+func (h *authHandshake) respond(req *http.Request, resp *http.Response) (bool, error) {
+	if h.auth == nil {
+		return false, errors.New("Proxy requires authentication: " + resp.Status)
+	}
+	offers := parseChallenges(resp.Header["Proxy-Authenticate"])
+	params, ok := offers[strings.ToLower(h.scheme)]
+	if h.session == nil || !ok {
+		h.session = nil
+		for _, au := range h.auth.auths {
+			if params, ok = offers[strings.ToLower(au.Scheme())]; ok {
+				h.scheme, h.session = au.Scheme(), au.NewSession()
+				break
+			}
+		}
+		if h.session == nil {
+			return false, errors.New("Unknown Proxy-Authenticate: " + strings.Join(resp.Header["Proxy-Authenticate"], ", "))
+		}
+		h.auth.lock.Lock()
+		h.auth.scheme = h.scheme
+		h.auth.lock.Unlock()
+	}
+	return params != "", h.authorize(req, params)
+}
+
+func (h *authHandshake) authorize(req *http.Request, challenge string) error {
+	v, err := h.session.Authorize(req, challenge)
+	if err != nil {
+		return err
+	}
+	if v == "" {
+		req.Header.Del("Proxy-Authorization")
+	} else {
+		req.Header.Set("Proxy-Authorization", v)
+	}
+	return nil
+}
+
+// parseChallenges returns the parameters of each scheme in the values of
+// Proxy-Authenticate, keyed by the scheme in lower case.
+func parseChallenges(values []string) map[string]string {
+	offers := map[string]string{}
+	for _, v := range values {
+		var scheme string
+		var params []string
+		flush := func() {
+			if _, ok := offers[scheme]; scheme != "" && !ok {
+				offers[scheme] = strings.Join(params, ", ")
+			}
+		}
+		for _, item := range splitQuoted(v, ',') {
+			item = strings.TrimSpace(item)
+			if item == "" {
+				continue
+			}
+			// a challenge starts with the scheme, followed by a token or
+			// the first parameter
+			i := strings.IndexAny(item, " \t=")
+			if i >= 0 && item[i] == '=' {
+				params = append(params, item)
+				continue
+			}
+			flush()
+			scheme, params = strings.ToLower(item), nil
+			if i >= 0 {
+				scheme = strings.ToLower(item[:i])
+				params = []string{strings.TrimSpace(item[i+1:])}
+			}
+		}
+		flush()
+	}
+	return offers
+}
+
+// parseAuthParams returns the parameters of a challenge, keyed in lower case.
+func parseAuthParams(s string) map[string]string {
+	params := map[string]string{}
+	for _, item := range splitQuoted(s, ',') {
+		f := strings.SplitN(item, "=", 2)
+		if len(f) < 2 {
+			continue
+		}
+		v := strings.TrimSpace(f[1])
+		if len(v) >= 2 && v[0] == '"' && v[len(v)-1] == '"' {
+			v = strings.NewReplacer(`\\`, `\`, `\"`, `"`).Replace(v[1 : len(v)-1])
+		}
+		params[strings.ToLower(strings.TrimSpace(f[0]))] = v
+	}
+	return params
+}
+
+// splitQuoted splits s by sep outside the quoted strings.
+func splitQuoted(s string, sep byte) []string {
+	var out []string
+	quoted, start := false, 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case quoted && s[i] == '\\':
+			i++
+		case s[i] == '"':
+			quoted = !quoted
+		case !quoted && s[i] == sep:
+			out = append(out, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(out, s[start:])
+}
@@ -0,0 +1,9 @@
+//go:build !windows
+
+package main
+
+import "errors"
+
+func currentUser() (Authenticator, error) {
+	return nil, errors.New("Proxy user is required, the current user is only on Windows")
+}
@@ -0,0 +1,46 @@
+//go:build windows
+
+package main
+
+import (
+	"github.com/alexbrainman/sspi"
+	"github.com/alexbrainman/sspi/ntlm"
+)
+
+// sspiAuthenticator authenticates as the current user by SSPI.
+type sspiAuthenticator struct {
+	cred *sspi.Credentials
+}
+
+func currentUser() (Authenticator, error) {
+	cred, err := ntlm.AcquireCurrentUserCredentials()
+	if err != nil {
+		return nil, err
+	}
+	return &sspiAuthenticator{cred}, nil
+}
+
+func (a *sspiAuthenticator) Scheme() string {
+	return "NTLM"
+}
+
+func (a *sspiAuthenticator) NewSession() AuthSession {
+	return &ntlmHandshake{start: a.start}
+}
+
+func (a *sspiAuthenticator) start() (ntlmContext, []byte, error) {
+	context, b, err := ntlm.NewClientContext(a.cred)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &sspiSession{context}, b, nil
+}
+
+type sspiSession struct {
+	context *ntlm.ClientContext
+}
+
+func (s *sspiSession) Update(challenge []byte) ([]byte, error) {
+	defer s.context.Release()
+	return s.context.Update(challenge)
+}
@@ -5,16 +5,26 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
-
-	"github.com/cznic/b"
+	"time"
 )
 
 type item struct {
 	name string
 	h    http.Handler
+	// first is when the host is seen, verified is when the route is last
+	// confirmed
+	first, verified     time.Time
+	successes, failures int
+	// ttl is how long the route is trusted before it is probed again, the
+	// route is never probed if it is 0
+	ttl time.Duration
+	// addr is the host with the port last seen, to probe
+	addr string
 }
 
 // SyncWriter is interface used for writing cache to file.
@@ -25,17 +35,27 @@ type SyncWriter interface {
 	Truncate(size int64) error
 }
 
-// CacheHandler stores a mapping of host to http.Handler in a tree structure.
+// CacheHandler stores a mapping of host to http.Handler in a trie of the
+// labels of the hosts.
 // CacheHandler implements http.Handler, so it can be used in http.ListenAndServe.
 //
 // If the request is for local server, it will call the Local handler.
-// Otherwise it will search in the tree for handler, or fallback to Default.
+// Otherwise it will search in the trie for handler, or fallback to Default.
+//
+// Only the request.Host is matched, without the port, in lower case and
+// punycode. A host is mapped exactly as example.com, with its subdomains as
+// .example.com, or only the subdomains as *.example.com. The longest pattern
+// matching wins.
 //
-// The compare function will only compare the request.Host . Wild card can be
-// used, but only accepts when it is at the beginning.
+// The hosts not matched are then mapped by the ranges of IP, as 10.0.0.0/8,
+// and at last by the ranges of ports, as :22 or :8000-8999.
+//
+// The routes learned by Observe expire after TTL, Run probes them again, and
+// a route is switched after Failures observations against it in a row.
 type CacheHandler struct {
-	tree *b.Tree
-	lock sync.RWMutex
+	tree  hostTrie
+	addrs addrRules
+	lock  sync.RWMutex
 	// The default handler when entity is not found in cache.
 	// If it is nil, and handler not found, it will response an internal error
 	Default http.Handler
@@ -43,41 +63,33 @@ type CacheHandler struct {
 	// http.DefaultServeMux will be called.
 	Local http.Handler
 
+	// TTL is how long a route learned is trusted before it is probed again.
+	TTL time.Duration
+	// Failures is the number of observations in a row against a route
+	// before it is switched.
+	Failures int
+	// Probe finds the route of host, which is name now. It returns the name
+	// and handler of the route, as Observe takes them.
+	Probe func(host, name string) (string, http.Handler, error)
+	// Resolve matches the ranges of IP to the addresses of the host
+	// resolved, if it is not an IP. The host is resolved by the local
+	// resolver, the addresses are kept for resolveTTL.
+	Resolve bool
+
+	rLock    sync.Mutex
+	resolved map[string]resolvedIPs
+
 	sLock  sync.Mutex
 	writeQ chan struct{}
 }
 
-// Compare from the end of string to the beginning.
-// Accept wild card at the beginning
-func compareHost(a, b string) int {
-	var i int
-	an, bn := len(a), len(b)
-	var as, bs byte
-	for i = 1; i <= an && i <= bn; i++ {
-		as, bs = a[an-i], b[bn-i]
-		if as != bs {
-			switch {
-			case i == an && as == '*', i == bn && bs == '*':
-				return 0
-			case as > bs:
-				return +1
-			default:
-				return -1
-			}
-		}
-	}
-	return 0
-}
-
 // NewCacheHandler return a new CacheHandler with h as default handler.
 // If r is not nil, CacheHandler will read r and lookup the handler by hmap.
 func NewCacheHandler(h http.Handler, hmap map[string]http.Handler, r io.Reader) *CacheHandler {
 	c := &CacheHandler{
-		tree: b.TreeNew(func(a, b interface{}) int {
-			as, bs := a.(string), b.(string)
-			return compareHost(as, bs)
-		}),
-		Default: h,
+		Default:  h,
+		TTL:      24 * time.Hour,
+		Failures: 3,
 	}
 	if r != nil {
 		c.Read(r, hmap)
@@ -97,17 +109,7 @@ func (c *CacheHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var h http.Handler
-	c.lock.RLock()
-	e, ok := c.tree.Seek(r.Host)
-	if ok {
-		_, v, _ := e.Next()
-		h = v.(*item).h
-		e.Close()
-	}
-	c.lock.RUnlock()
-
-	if h != nil {
+	if _, h, ok := c.match(requestAddr(r), c.Resolve); ok && h != nil {
 		h.ServeHTTP(w, r)
 		return
 	}
@@ -119,31 +121,220 @@ func (c *CacheHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	c.Default.ServeHTTP(w, r)
 }
 
-// Set stores the mapping of addr to h into the cache.
+// Lookup returns the name of the handler for host.
+// ok is false if host is not in the cache.
+func (c *CacheHandler) Lookup(host string) (name string, ok bool) {
+	name, _, ok = c.match(host, false)
+	return name, ok
+}
+
+// Set stores the mapping of addr to h into the cache. The mapping never
+// expires.
 // It will also write to file if AutoSaveTo is set, and name is not empty.
 func (c *CacheHandler) Set(addr, name string, h http.Handler) {
+	now := time.Now()
 	c.lock.Lock()
-	c.set(addr, name, h)
+	c.set(addr, &item{name: name, h: h, first: now, verified: now})
 	c.lock.Unlock()
 
 	if name != "" {
-		c.sLock.Lock()
-		defer c.sLock.Unlock()
-
-		if c.writeQ != nil {
-			//non-blocking push
-			select {
-			case c.writeQ <- struct{}{}:
-			default:
+		c.save()
+	}
+}
+
+// set stores the mapping of addr to it into the cache.
+// Caller must lock the c.lock before calling this function
+func (c *CacheHandler) set(addr string, it *item) {
+	if !c.addrs.Set(addr, it) {
+		it.seen(addr)
+		c.tree.Set(addr, it)
+	}
+}
+
+// match returns the route of addr, by the patterns of hosts, the ranges of
+// IP, then the ranges of ports. The ranges of IP match the addresses of the
+// host resolved too, if resolve is set. The route is copied under the lock,
+// as Observe may switch it.
+func (c *CacheHandler) match(addr string, resolve bool) (name string, h http.Handler, ok bool) {
+	host, port := addr, 0
+	if hp, p, err := net.SplitHostPort(addr); err == nil {
+		host = hp
+		port, _ = strconv.Atoi(p)
+	}
+	ip := net.ParseIP(strings.Trim(host, "[]"))
+	route := func(it *item, found bool) {
+		if found {
+			name, h, ok = it.name, it.h, true
+		}
+	}
+
+	c.lock.RLock()
+	route(c.tree.Match(addr))
+	if !ok && ip != nil {
+		route(c.addrs.MatchIP([]net.IP{ip}))
+	}
+	resolve = resolve && !ok && ip == nil && len(c.addrs.cidrs) > 0
+	c.lock.RUnlock()
+
+	// the lock is not held while resolving
+	if resolve {
+		if ips := c.lookupIP(host); ips != nil {
+			c.lock.RLock()
+			route(c.addrs.MatchIP(ips))
+			c.lock.RUnlock()
+		}
+	}
+	if !ok && port != 0 {
+		c.lock.RLock()
+		route(c.addrs.MatchPort(port))
+		c.lock.RUnlock()
+	}
+	return name, h, ok
+}
+
+// resolveTTL is how long the addresses resolved for the ranges of IP are
+// kept, maxResolved is the number of hosts kept.
+var resolveTTL = time.Minute
+
+const maxResolved = 1024
+
+// resolvedIPs are the addresses of a host resolved at time, nil if it fails.
+type resolvedIPs struct {
+	ips  []net.IP
+	time time.Time
+}
+
+// lookupIP returns the addresses of host, they are resolved again after
+// resolveTTL.
+func (c *CacheHandler) lookupIP(host string) []net.IP {
+	c.rLock.Lock()
+	r, ok := c.resolved[host]
+	c.rLock.Unlock()
+	if ok && time.Since(r.time) < resolveTTL {
+		return r.ips
+	}
+
+	ips, _ := net.LookupIP(host)
+	now := time.Now()
+	c.rLock.Lock()
+	if c.resolved == nil || len(c.resolved) >= maxResolved {
+		// the expired ones are dropped, or all if there are still too many
+		for h, r := range c.resolved {
+			if now.Sub(r.time) >= resolveTTL {
+				delete(c.resolved, h)
 			}
 		}
+		if len(c.resolved) >= maxResolved/2 {
+			c.resolved = nil
+		}
+		if c.resolved == nil {
+			c.resolved = make(map[string]resolvedIPs)
+		}
 	}
+	c.resolved[host] = resolvedIPs{ips: ips, time: now}
+	c.rLock.Unlock()
+	return ips
 }
 
-// set stores the mapping of addr to h into the cache.
-// Caller must lock the c.lock before calling this function
-func (c *CacheHandler) set(addr, name string, h http.Handler) {
-	c.tree.Set(addr, &item{name: name, h: h})
+// requestAddr returns the host of r with the port, the default one of the
+// scheme if it is not given.
+func requestAddr(r *http.Request) string {
+	if _, _, err := net.SplitHostPort(r.Host); err == nil {
+		return r.Host
+	}
+	port := "80"
+	if r.URL.Scheme == "https" {
+		port = "443"
+	}
+	return net.JoinHostPort(strings.Trim(r.Host, "[]"), port)
+}
+
+// Observe records that the route name, handled by h, is found for addr. A
+// new host is stored with the route, which expires after TTL. The route of a
+// host known is switched after Failures observations of another route in a
+// row.
+func (c *CacheHandler) Observe(addr, name string, h http.Handler) {
+	now := time.Now()
+	c.lock.Lock()
+	it, _ := c.tree.Get(addr)
+	if it != nil {
+		it.seen(addr)
+	}
+	switch {
+	case it == nil:
+		c.set(addr, &item{name: name, h: h, first: now, verified: now, successes: 1, ttl: c.TTL})
+	case it.name == name:
+		it.verified = now
+		it.successes++
+		it.failures = 0
+	default:
+		// keep it stale, so it is probed again soon
+		if it.failures++; it.failures >= c.Failures {
+			log.Print("Route of " + addr + " is switched from " + routeName(it.name) + " to " + routeName(name))
+			it.name, it.h = name, h
+			it.verified = now
+			it.successes, it.failures = 1, 0
+		}
+	}
+	c.lock.Unlock()
+	c.save()
+}
+
+// routeName is the name of the route in log, the proxy if it is not named.
+func routeName(name string) string {
+	if name == "" {
+		return "proxy"
+	}
+	return name
+}
+
+// save writes the cache to the file of AutoSaveTo later.
+func (c *CacheHandler) save() {
+	c.sLock.Lock()
+	defer c.sLock.Unlock()
+
+	if c.writeQ != nil {
+		//non-blocking push
+		select {
+		case c.writeQ <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Run probes the routes expired every interval, it never returns.
+func (c *CacheHandler) Run(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		c.probe()
+	}
+}
+
+// probe finds the routes expired again by Probe.
+func (c *CacheHandler) probe() {
+	if c.Probe == nil {
+		return
+	}
+	type stale struct{ host, name string }
+	var hosts []stale
+	now := time.Now()
+	c.lock.RLock()
+	c.tree.Walk(func(pattern string, kind int, it *item) {
+		// a pattern of subdomains is not a host to probe
+		if kind == matchExact && it.ttl > 0 && now.Sub(it.verified) >= it.ttl {
+			hosts = append(hosts, stale{it.probeAddr(pattern), it.name})
+		}
+	})
+	c.lock.RUnlock()
+
+	for _, s := range hosts {
+		name, h, err := c.Probe(s.host, s.name)
+		if err != nil {
+			// the route is unknown, it is probed again next time
+			continue
+		}
+		c.Observe(s.host, name, h)
+	}
 }
 
 // AutoSaveTo set a writer so whenever the cache is updated, CacheHandler will write to it.
@@ -171,43 +362,36 @@ func (c *CacheHandler) AutoSaveTo(w SyncWriter) {
 }
 
 // Save writes the cache to w. As handler itself cannot be written, it will write its name.
-// Handler without name will not be written.
+// Handler without name will not be written. The line of a host is the name,
+// the pattern of the host, with the port last seen, the times first seen and
+// last verified, the counts of successes and failures, and the TTL, separated
+// by tabs. The ranges of IP and ports follow the hosts.
 func (c *CacheHandler) Save(w io.Writer) (n int, err error) {
 	c.lock.RLock()
 	defer c.lock.RUnlock()
 
-	e, err := c.tree.SeekFirst()
-	if err != nil {
-		if err == io.EOF {
-			return 0, nil
+	write := func(pattern string, it *item) {
+		if it.name == "" || err != nil {
+			return
 		}
-		return 0, err
+		var nn int
+		nn, err = fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%d\t%s\n", it.name, pattern,
+			it.first.Format(time.RFC3339), it.verified.Format(time.RFC3339), it.successes, it.failures, it.ttl)
+		n += nn
 	}
-	defer e.Close()
-
-	for err == nil {
-		var k, v interface{}
-		k, v, err = e.Next()
-		if err != nil {
-			break
+	c.tree.Walk(func(pattern string, kind int, it *item) {
+		if kind == matchExact {
+			pattern = it.probeAddr(pattern)
 		}
-		name := v.(*item).name
-		if name != "" {
-			nn, err := fmt.Fprintf(w, "%s\t%s\n", name, k.(string))
-			n += nn
-			if err != nil {
-				return n, err
-			}
-		}
-	}
-
-	if err == io.EOF {
-		err = nil
-	}
+		write(pattern, it)
+	})
+	c.addrs.Walk(write)
 	return n, err
 }
 
-// Read reads from r, and use hmap to lookup the handler for the hosts
+// Read reads from r, and use hmap to lookup the handler for the hosts.
+// A line of only the name and the host is learned before, its route expires
+// after TTL, and is probed on the first Run.
 func (c *CacheHandler) Read(r io.Reader, hmap map[string]http.Handler) error {
 	c.lock.Lock()
 	defer c.lock.Unlock()
@@ -215,17 +399,59 @@ func (c *CacheHandler) Read(r io.Reader, hmap map[string]http.Handler) error {
 	scr := bufio.NewScanner(r)
 	for scr.Scan() {
 		t := strings.Split(scr.Text(), "\t")
-		if len(t) != 2 {
+		it := &item{ttl: c.TTL}
+		if len(t) == 7 {
+			if err := it.parse(t[2:]); err != nil {
+				log.Print("Failed to parse line: " + scr.Text())
+				continue
+			}
+		} else if len(t) != 2 {
 			log.Print("Failed to parse line: " + scr.Text())
 			continue
 		}
 		if h, ok := hmap[t[0]]; ok {
-			c.set(t[1], t[0], h)
+			it.name, it.h = t[0], h
+			c.set(t[1], it)
 		} else if h, ok := hmap[t[1]]; ok {
-			c.set(t[0], t[1], h)
+			it.name, it.h = t[1], h
+			c.set(t[0], it)
 		} else {
 			log.Print("Failed to find the handler: " + t[0])
 		}
 	}
 	return scr.Err()
 }
+
+// seen keeps addr to probe, if it has the port.
+func (it *item) seen(addr string) {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		it.addr = addr
+	}
+}
+
+// probeAddr returns the address of the host to probe, the host itself if its
+// port is not seen.
+func (it *item) probeAddr(host string) string {
+	if it.addr != "" {
+		return it.addr
+	}
+	return host
+}
+
+// parse parses the times, counts and TTL of it written by Save.
+func (it *item) parse(t []string) (err error) {
+	if it.first, err = time.Parse(time.RFC3339, t[0]); err != nil {
+		return err
+	}
+	if it.verified, err = time.Parse(time.RFC3339, t[1]); err != nil {
+		return err
+	}
+	if it.successes, err = strconv.Atoi(t[2]); err != nil {
+		return err
+	}
+	if it.failures, err = strconv.Atoi(t[3]); err != nil {
+		return err
+	}
+	it.ttl, err = time.ParseDuration(t[4])
+	return err
+}
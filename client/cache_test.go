@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
 	"strings"
@@ -94,47 +95,184 @@ func TestStar(t *testing.T) {
 		panic(err)
 	}
 	c.AutoSaveTo(f)
-	for k, v := range h {
-		c.Set("*"+k, k, v)
-	}
-	req := &http.Request{}
-	for _, v := range strings.Split("x0;x1;x2;x3;x4;x5;x6;0;1;2;3;4;5;6", ";") {
-		req.Host = v
-		c.ServeHTTP(nil, req)
-		select {
-		case s := <-out:
-			if v[len(v)-1:] != s {
-				switch s {
-				case "def":
-				default:
-					t.Fatalf("%s : %s", v, s)
+	c.Set("*.x1.com", "1", h["1"])
+	c.Set(".x2.com", "2", h["2"])
+	c.Set("a.x2.com", "3", h["3"])
+	c.Set("*.a.x1.com", "4", h["4"])
+	c.Set("*x5.com", "5", h["5"])
+	hosts := "a.x1.com=1;b.a.x1.com=4;x1.com=def;x2.com:80=2;A.X2.com=3;b.a.x2.com=2;badx2.com=def;x5.com=5;a.x5.com.=5"
+	test := func(c *CacheHandler) {
+		for _, v := range strings.Split(hosts, ";") {
+			host, want := v[:strings.Index(v, "=")], v[strings.Index(v, "=")+1:]
+			req := &http.Request{Host: host, URL: &url.URL{Host: host}}
+			c.ServeHTTP(nil, req)
+			select {
+			case s := <-out:
+				if s != want {
+					t.Fatalf("%s : %s", host, s)
 				}
+			default:
+				t.Fatal("No out")
 			}
-		default:
-			t.Fatal("No out")
 		}
 	}
+	test(c)
 	var obuf bytes.Buffer
 	if _, err := c.Save(&obuf); err != nil {
 		t.Fatal(err)
 	}
+	test(NewCacheHandler(d, h, &obuf))
+	time.Sleep(1e7)
+}
 
-	nc := NewCacheHandler(d, h, &obuf)
-	for _, v := range strings.Split("x0;x1;x2;x3;x4;x5;x6;0;1;2;3;4;5;6", ";") {
-		req.Host = v
-		nc.ServeHTTP(nil, req)
-		select {
-		case s := <-out:
-			if v[len(v)-1:] != s {
-				switch s {
-				case "def":
-				default:
-					t.Fatalf("%s : %s", v, s)
-				}
+func TestCacheRoutes(t *testing.T) {
+	h := map[string]http.Handler{"remote": http.NotFoundHandler(), "block": http.NotFoundHandler()}
+	direct := http.NotFoundHandler()
+	c := NewCacheHandler(nil, h, nil)
+	c.Failures = 2
+
+	route := func(host string) string {
+		name, ok := c.Lookup(host)
+		if !ok {
+			return "none"
+		}
+		return name
+	}
+	c.Observe("a:443", "remote", h["remote"])
+	if r := route("a:443"); r != "remote" {
+		t.Fatalf("route %q", r)
+	}
+	// switched after 2 failures in a row
+	for i, want := range []string{"remote", "remote", "remote", ""} {
+		if i != 1 {
+			c.Observe("a:443", "", direct)
+		} else {
+			c.Observe("a:443", "remote", h["remote"])
+		}
+		if r := route("a:443"); r != want {
+			t.Fatalf("%d: route %q", i, r)
+		}
+	}
+
+	// only the expired routes are probed
+	c.Observe("b:443", "remote", h["remote"])
+	c.TTL = time.Nanosecond
+	c.Observe("c:443", "remote", h["remote"])
+	c.Set("d:443", "block", h["block"])
+	var probed []string
+	c.Probe = func(host, name string) (string, http.Handler, error) {
+		probed = append(probed, host+" "+name)
+		return "", direct, nil
+	}
+	time.Sleep(time.Millisecond)
+	c.probe()
+	if strings.Join(probed, ",") != "c:443 remote" {
+		t.Fatalf("probed %q", probed)
+	}
+
+	// the fields are kept in the file, the old lines expire
+	var obuf bytes.Buffer
+	if _, err := c.Save(&obuf); err != nil {
+		t.Fatal(err)
+	}
+	saved := obuf.String()
+	if strings.Count(saved, "\n") != 3 || !strings.Contains(saved, "\tc:443\t") || !strings.Contains(saved, "\t1\t1\t1ns\n") {
+		t.Fatalf("saved %q", saved)
+	}
+	nc := NewCacheHandler(nil, h, nil)
+	if err := nc.Read(strings.NewReader(saved+"remote\te:443\n"), h); err != nil {
+		t.Fatal(err)
+	}
+	var nbuf bytes.Buffer
+	nc.Save(&nbuf)
+	if !strings.HasPrefix(nbuf.String(), saved) {
+		t.Fatalf("read %q", nbuf.String())
+	}
+	probed = nil
+	nc.Probe = c.Probe
+	nc.probe()
+	if strings.Join(probed, ",") != "c:443 remote,e:443 remote" {
+		t.Fatalf("probed %q", probed)
+	}
+}
+
+func TestCacheObserveRace(t *testing.T) {
+	// run with -race, the route is switched while it is served
+	a, b := http.NotFoundHandler(), http.NotFoundHandler()
+	c := NewCacheHandler(nil, nil, nil)
+	c.Failures = 1
+	c.Observe("a:443", "a", a)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			if i%2 == 0 {
+				c.Observe("a:443", "b", b)
+			} else {
+				c.Observe("a:443", "a", a)
 			}
-		default:
-			t.Fatal("No out")
 		}
+	}()
+	for i := 0; i < 100; i++ {
+		w := httptest.NewRecorder()
+		c.ServeHTTP(w, httptest.NewRequest("CONNECT", "https://a:443", nil))
+		c.Lookup("a:443")
+	}
+	<-done
+}
+
+func TestCacheAddrRules(t *testing.T) {
+	h := map[string]http.Handler{}
+	for _, name := range []string{"host", "lan", "net", "ssh", "ports"} {
+		h[name] = http.NotFoundHandler()
+	}
+	c := NewCacheHandler(nil, h, nil)
+	c.Set("10.0.0.0/8", "net", h["net"])
+	c.Set("10.1.0.0/16", "lan", h["lan"])
+	c.Set(":22", "ssh", h["ssh"])
+	c.Set(":1-1024", "ports", h["ports"])
+	c.Set("git.example.com", "host", h["host"])
+	for _, v := range []struct {
+		addr, want string
+	}{
+		{"10.2.3.4:443", "net"},
+		{"10.1.3.4:22", "lan"},
+		{"192.168.1.1:22", "ssh"},
+		{"git.example.com:22", "host"},
+		{"example.com:80", "ports"},
+		{"example.com:8080", ""},
+		{"[::1]:8080", ""},
+	} {
+		if name, _, ok := c.match(v.addr, false); ok != (v.want != "") || name != v.want {
+			t.Fatalf("%s: %q %v", v.addr, name, ok)
+		}
+	}
+
+	// localhost is resolved, only if it is not matched by the name
+	c.Set("127.0.0.0/8", "lan", h["lan"])
+	c.Set("::1/128", "lan", h["lan"])
+	if _, _, ok := c.match("localhost:8080", false); ok {
+		t.Fatal("matched without resolving")
+	}
+	if name, _, ok := c.match("localhost:8080", true); !ok || name != "lan" {
+		t.Fatalf("resolved %q %v", name, ok)
+	}
+	// the addresses are kept
+	if r, ok := c.resolved["localhost"]; !ok || r.ips == nil {
+		t.Fatalf("not kept %v", r)
+	}
+	c.Set("localhost", "host", h["host"])
+	if name, _, _ := c.match("localhost:8080", true); name != "host" {
+		t.Fatalf("resolved %q", name)
+	}
+
+	var obuf bytes.Buffer
+	c.Save(&obuf)
+	saved := obuf.String()
+	nc := NewCacheHandler(nil, h, &obuf)
+	var nbuf bytes.Buffer
+	nc.Save(&nbuf)
+	if nbuf.String() != saved || !strings.Contains(saved, "\t:1-1024\t") {
+		t.Fatalf("saved %q", nbuf.String())
 	}
-	time.Sleep(1e7)
 }
@@ -4,13 +4,16 @@
 package main
 
 import (
-	"crypto/tls"
+	"encoding/base64"
 	"errors"
+	"expvar"
 	"flag"
 	"fmt"
 	"net"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/ramuchu/fetch"
 
@@ -20,9 +23,23 @@ import (
 )
 
 var proxyURL string
+var pacURL string
+var healthInterval time.Duration
+var routeTTL time.Duration
+var routeFailures int
+var resolveRanges bool
 var hostURL string
 var localPort string
 var useragent string
+var maxReplay int64
+var warmTunnels, maxTunnels int
+var balance string
+var raceRoutes bool
+var rulesPath string
+var proxyUser, proxyPassword, ntlmHash, netrcPath string
+var socksPort string
+var socksAuth string
+var dnsPort string
 
 func getRemoteProxy() string {
 	e := os.Getenv("REMOTE_PROXY")
@@ -34,55 +51,77 @@ func getRemoteProxy() string {
 
 func init() {
 	flag.StringVar(&localPort, "port", "8282", "the port this server going to listen")
-	flag.StringVar(&hostURL, "host", getRemoteProxy(), "Address of Remote server, $REMOTE_PROXY if set")
-	flag.StringVar(&proxyURL, "proxy", os.Getenv("HTTP_PROXY"), "Address of HTTP proxy server, $HTTP_PROXY if set")
+	flag.StringVar(&hostURL, "host", getRemoteProxy(), "Address of Remote server as scheme://[user:password@]host:port[/path], or comma separated list of [name=]address to balance, $REMOTE_PROXY if set")
+	flag.StringVar(&balance, "balance", "rr", "how to balance the remote servers, rr (round robin) or latency")
+	flag.StringVar(&proxyURL, "proxy", os.Getenv("HTTP_PROXY"), "Address of HTTP proxy server, or comma separated list to fail over, $HTTP_PROXY if set")
+	flag.DurationVar(&healthInterval, "health", 30*time.Second, "interval of the health checks of the proxies and remote servers")
+	flag.DurationVar(&routeTTL, "ttl", 24*time.Hour, "how long a route learned for a host is trusted before it is probed again")
+	flag.IntVar(&routeFailures, "failures", 3, "number of probes in a row against the route learned for a host before it is switched")
+	flag.BoolVar(&resolveRanges, "resolve", false, "match the ranges of IP in data.txt to the resolved addresses of the hosts too, not only to the IP requested; the hosts are then resolved by the local DNS, which sees them even if they are routed to the remote server")
+	flag.StringVar(&pacURL, "pac", os.Getenv("PROXY_PAC"), "file or URL of the PAC script choosing the proxy of each host, $PROXY_PAC if set")
 	flag.StringVar(&useragent, "agent", os.Getenv("AGENT"), "UserAgent of HTTP requests, $AGENT if set")
+	flag.StringVar(&proxyUser, "proxyuser", os.Getenv("PROXY_USER"), `user, or DOMAIN\user of NTLM, to authenticate to the proxy, $PROXY_USER if set`)
+	flag.StringVar(&proxyPassword, "proxypass", os.Getenv("PROXY_PASSWORD"), "password of proxyuser, $PROXY_PASSWORD if set")
+	flag.StringVar(&ntlmHash, "ntlmhash", os.Getenv("NTLM_HASH"), "hex of NT hash of proxyuser instead of password, NTLM only, $NTLM_HASH if set")
+	flag.StringVar(&netrcPath, "netrc", defaultNetrc(), "netrc file of the proxy user if it is not given, $NETRC if set")
+	flag.StringVar(&rulesPath, "rules", os.Getenv("BLOCK_RULES"), "file of the rules detecting the blocking of the proxy on this network, $BLOCK_RULES if set")
+	flag.BoolVar(&raceRoutes, "race", false, "validate the proxy and the remote server at the same time for CONNECT to a new host, rather than one by one")
+	flag.IntVar(&warmTunnels, "warm", 2, "number of tunnels to the remote server opened ahead, less than the tunnels allowed by the server")
+	flag.IntVar(&maxTunnels, "tunnels", 64, "max number of tunnels to the remote server")
+	flag.Int64Var(&maxReplay, "replay", 32<<20, "max bytes of a request body kept to retry on the remote server")
+	flag.StringVar(&socksPort, "socks", "", "the port of SOCKS5 server, disabled if empty")
+	flag.StringVar(&socksAuth, "socksauth", os.Getenv("SOCKS_AUTH"), "user:password required by SOCKS5 server, $SOCKS_AUTH if set")
+	flag.StringVar(&dnsPort, "dns", "", "the port of DNS server, disabled if empty")
 }
 
 func main() {
 	flag.Parse()
-	host := "localhost"
-	port := "8000"
-	proto := "https"
-
-	// parse the hostURL
-	sch := strings.SplitN(hostURL, "://", 2)
-	if len(sch) > 1 {
-		proto = sch[0]
-	}
-	addr := sch[len(sch)-1]
-	l := strings.Split(addr, ":")
-	host = l[0]
-	if len(l) > 1 {
-		port = l[1]
-	}
-
-	var origin, pURL string
-	switch proto {
-	case "http":
-		origin = "http://" + host + "/"
-		pURL = "ws://" + host + ":" + port + "/p"
-	case "https":
-		origin = "https://" + host + "/"
-		pURL = "wss://" + host + ":" + port + "/p"
-	default:
-		fmt.Println("Unknown protocol")
-		return
-	}
-
-	fmt.Printf("Address of the websocket to connect to: [%s]\n", pURL)
-	if proxyURL == "" {
+	var pac *PAC
+	if pacURL != "" {
+		var err error
+		if pac, err = LoadPAC(pacURL); err != nil {
+			panic(err)
+		}
+		fmt.Printf("With http proxy by PAC %s\n", pacURL)
+	} else if proxyURL == "" {
 		fmt.Println("Without http proxy")
 	} else {
 		fmt.Printf("With http proxy %s\n", proxyURL)
 	}
 
+	rules, err := LoadRules(rulesPath)
+	if err != nil {
+		panic(err)
+	}
+
 	// handler to ask local proxy
-	proxy := createProxy(proxyURL, useragent)
+	var proxyAuth *ProxyAuth
+	if proxyURL != "" || pac != nil {
+		user, password, err := proxyCredentials(proxyURL)
+		if err != nil {
+			panic(err)
+		}
+		if proxyAuth, err = NewProxyAuth(user, password, ntlmHash); err != nil {
+			fmt.Println("Without proxy authentication:", err)
+		}
+	}
+	proxy := createProxy(proxyURL, useragent, proxyAuth)
+	proxy.PAC = pac
+	go proxy.health.Run(healthInterval)
 	proxyHandler := LogHandler("NTLMProxy  <--", proxy)
 
 	// handler to ask remote proxy
-	remoteProxy := LogHandler("Remote     <--", createRemoteProxy(proxy, pURL, "", origin))
+	remoteConn, err := createRemotes(hostURL, proxy)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	remoteConn.Latency = balance == "latency"
+	go remoteConn.Run(healthInterval)
+	expvar.Publish("tunnels", expvar.Func(func() interface{} {
+		return remoteConn.Stats()
+	}))
+	remoteProxy := LogHandler("Remote     <--", Tunnel(remoteConn))
 
 	// cache handler
 	hmap := map[string]http.Handler{
@@ -93,39 +132,95 @@ func main() {
 			http.Error(w, http.StatusText(s), s)
 		})),
 	}
+	// a rule can name the remote server of the hosts
+	for _, r := range remoteConn.Remotes {
+		hmap[r.Name] = LogHandler(fmt.Sprintf("%-11s<--", r.Name), Tunnel(r.Pool))
+	}
 	// read / write to the file
 	f, err := os.OpenFile("data.txt", os.O_RDWR|os.O_CREATE, 0666)
 	if err != nil {
 		panic(err)
 	}
-	cache := NewCacheHandler(nil, hmap, f)
+	cache := NewCacheHandler(nil, hmap, nil)
+	cache.TTL = routeTTL
+	cache.Failures = routeFailures
+	cache.Resolve = resolveRanges
+	if err := cache.Read(f, hmap); err != nil {
+		panic(err)
+	}
 	cache.AutoSaveTo(f)
 
 	// default handler, which is also a local proxy, but will validate the result.
 	// Whenever it finds the request is blocked, store the host to cache and fallback to remote
-	defProxy := createProxy(proxyURL, useragent)
+	defProxy := createProxy(proxyURL, useragent, proxyAuth)
+	defProxy.PAC = pac
+	defProxy.health = proxy.health
 	defProxy.Fallback = remoteProxy
-	defProxy.ValidHTTP = func(req *http.Request, resp *http.Response) error {
-		err := validHTTP(req, resp)
-		if err == nil {
-			//go cache.Set(req.Host, "", proxyHandler)
-		} else {
-			go cache.Set(req.Host, "remote", remoteProxy)
-		}
-		return err
-	}
-	defProxy.ValidConnect = func(req *http.Request, c net.Conn) error {
-		err := handshakeConnect(req.URL, c)
-		if err == nil {
-			// handshaking will make the client establish the connection once more
-			// just remember it when it is running
-			go cache.Set(req.Host, "", proxyHandler)
+	defProxy.MaxReplay = maxReplay
+	defProxy.ValidHTTP = rules.ValidHTTP
+	defProxy.ValidConnect = rules.ValidConnect
+	rules.Dial = defProxy.dial
+	defProxy.Chosen = func(req *http.Request, direct bool) {
+		// handshaking will make the client establish the connection once more
+		// just remember it when it is running
+		if direct {
+			go cache.Observe(req.Host, "", proxyHandler)
 		} else {
-			go cache.Set(req.Host, "remote", remoteProxy)
+			go cache.Observe(req.Host, "remote", remoteProxy)
 		}
-		return err
+	}
+	defProxy.FallbackDial = ConnectDialer(remoteConn)
+	defProxy.Race = raceRoutes
+	// An unreachable proxy is not recorded, it is not blocking the host
+	defProxy.Blocked = func(req *http.Request) {
+		go cache.Observe(req.Host, "remote", remoteProxy)
 	}
 	cache.Default = LogHandler("           <--", defProxy)
+	// the routes learned are probed again as the new hosts, the others are
+	// kept as they are
+	cache.Probe = func(host, name string) (string, http.Handler, error) {
+		if name != "" && name != "remote" {
+			return name, hmap[name], nil
+		}
+		direct, err := defProxy.Probe(host)
+		if err != nil {
+			return "", nil, err
+		}
+		if direct {
+			return "", proxyHandler, nil
+		}
+		return "remote", remoteProxy, nil
+	}
+	go cache.Run(healthInterval)
+
+	if socksPort != "" {
+		socks := &SocksServer{Handler: cache, Datagram: ModeDialer(remoteConn, fetch.MethodDatagram)}
+		if socksAuth != "" {
+			socks.Auth = PasswordAuth(socksAuth)
+		}
+		fmt.Println("Start SOCKS5 listening", ":"+socksPort)
+		go func() {
+			if err := socks.ListenAndServe(":" + socksPort); err != nil {
+				panic(err)
+			}
+		}()
+	}
+
+	if dnsPort != "" {
+		dns := &DNSServer{
+			Remote: func(host string) bool {
+				name, ok := cache.Lookup(host)
+				return ok && name != "proxy" && name != "block" && hmap[name] != nil
+			},
+			Dial: ModeDialer(remoteConn, fetch.MethodDNS),
+		}
+		fmt.Println("Start DNS listening", ":"+dnsPort)
+		go func() {
+			if err := dns.ListenAndServe(":" + dnsPort); err != nil {
+				panic(err)
+			}
+		}()
+	}
 
 	// start handling requests
 	fmt.Println("Start listening", ":"+localPort)
@@ -135,62 +230,120 @@ func main() {
 	}
 }
 
-func createProxy(proxyURL string, agent string) *NTLMProxy {
-	proxy, err := NewNTLMProxy(proxyURL)
-	if err != nil {
-		panic(err)
-	}
-	proxy.Agent = agent
-	return proxy
-}
+// createRemotes returns the Balancer of the remote servers in hosts, a comma
+// separated list of [name=]URL. The servers not named are remote1, remote2...
+func createRemotes(hosts string, proxy *NTLMProxy) (*Balancer, error) {
+	b := &Balancer{}
+	names := map[string]bool{"proxy": true, "block": true, "remote": true}
+	for i, v := range strings.Split(hosts, ",") {
+		name, u := "remote"+strconv.Itoa(i+1), strings.TrimSpace(v)
+		if j := strings.Index(u, "="); j > 0 && !strings.ContainsAny(u[:j], ":/@") {
+			name, u = u[:j], u[j+1:]
+		}
+		if names[name] {
+			return nil, errors.New("Duplicated name of remote server: " + name)
+		}
+		names[name] = true
 
-var errNotFound = errors.New("Not found")
-var errFiltered = errors.New("Filtered")
-
-// check if the request is blocked.
-// just check if the response is redirecting to a known host
-func validHTTP(req *http.Request, resp *http.Response) error {
-	switch {
-	case resp.StatusCode >= 400:
-		return errNotFound
-	case resp.StatusCode >= 300 && resp.StatusCode != http.StatusNotModified:
-		l := resp.Header.Get("Location")
-		u, err := url.Parse(l)
+		pURL, origin, auth, err := parseRemote(u)
 		if err != nil {
-			return err
-		}
-		if u.Host == "alert.scansafe.net" {
-			return errFiltered
+			return nil, err
 		}
+		fmt.Printf("Address of the websocket to connect to: %s [%s]\n", name, pURL)
+		dial := createRemoteConn(proxy, pURL, "", origin, auth)
+		b.Remotes = append(b.Remotes, NewRemote(name, dial, warmTunnels, maxTunnels))
 	}
-	return nil
+	return b, nil
 }
 
-func hasPort(s string) bool { return strings.LastIndex(s, ":") > strings.LastIndex(s, "]") }
+// parseRemote parses the URL of the remote server as
+// scheme://[user:password@]host:port[/path], into the URL of the websocket,
+// its origin, and the user:password.
+func parseRemote(hostURL string) (pURL, origin, auth string, err error) {
+	host := "localhost"
+	port := "8000"
+	proto := "https"
 
-// handshakeConnect sends a tls handshake to the connection.
-// If the reply is not valid (e.g access denied), then we assume it is blocked
-func handshakeConnect(u *url.URL, c net.Conn) error {
-	h := u.Host
-	if hasPort(h) {
-		h = h[:strings.LastIndex(h, ":")]
+	// parse the hostURL
+	sch := strings.SplitN(hostURL, "://", 2)
+	if len(sch) > 1 {
+		proto = sch[0]
 	}
-	cfg := &tls.Config{ServerName: h}
-	tlsConn := tls.Client(c, cfg)
-	return tlsConn.Handshake()
+	addr := sch[len(sch)-1]
+	// the password may contain "/", the user info ends at the last "@"
+	if i := strings.LastIndex(addr, "@"); i >= 0 {
+		auth, addr = addr[:i], addr[i+1:]
+	}
+	path := "/p"
+	if i := strings.Index(addr, "/"); i >= 0 && i < len(addr)-1 {
+		addr, path = addr[:i], addr[i:]
+	} else if i >= 0 {
+		addr = addr[:i]
+	}
+	l := strings.Split(addr, ":")
+	host = l[0]
+	if len(l) > 1 {
+		port = l[1]
+	}
+
+	switch proto {
+	case "http":
+		origin = "http://" + host + "/"
+		pURL = "ws://" + host + ":" + port + path
+	case "https":
+		origin = "https://" + host + "/"
+		pURL = "wss://" + host + ":" + port + path
+	default:
+		return "", "", "", errors.New("Unknown protocol: " + proto)
+	}
+	return pURL, origin, auth, nil
 }
 
-// createRemoteProxy use the NTLMProxy to establish a websocket connection, tunnel to remote server
-func createRemoteProxy(proxy *NTLMProxy, pURL, protocol, origin string) http.Handler {
+// proxyCredentials returns the user of the proxy by the flags, the user info
+// of proxyURL, or the netrc file, in the order. Only the first proxy in the
+// list is looked up.
+func proxyCredentials(proxyURL string) (user, password string, err error) {
+	if proxyUser != "" {
+		return proxyUser, proxyPassword, nil
+	}
+	u, err := url.Parse(strings.TrimSpace(strings.Split(proxyURL, ",")[0]))
+	if err != nil {
+		return "", "", err
+	}
+	if u.User != nil {
+		password, _ := u.User.Password()
+		return u.User.Username(), password, nil
+	}
+	if netrcPath == "" {
+		return "", "", nil
+	}
+	return netrcLookup(netrcPath, u.Hostname())
+}
+
+func createProxy(proxyURL string, agent string, auth *ProxyAuth) *NTLMProxy {
+	proxy, err := NewNTLMProxy(proxyURL, auth)
+	if err != nil {
+		panic(err)
+	}
+	proxy.Agent = agent
+	return proxy
+}
+
+// createRemoteConn use the NTLMProxy to establish a websocket connection, tunnel to remote server.
+// auth is the user:password to the remote server, if not empty.
+func createRemoteConn(proxy *NTLMProxy, pURL, protocol, origin, auth string) funcConn {
+	var h http.Header
+	if auth != "" {
+		h = http.Header{"Authorization": {"Basic " + base64.StdEncoding.EncodeToString([]byte(auth))}}
+	}
 	genConn := func() (net.Conn, error) {
 		//conn, err := ProxyDial(pURL, "", origin)
-		conn, err := proxy.Websocket(pURL, "", origin)
+		conn, err := proxy.Websocket(pURL, "", origin, h)
 		if err != nil {
 			return nil, err
 		}
 
 		return fetch.NewClientConn(conn.UnderlyingConn(), 0x56), nil
 	}
-	genConn = logConnect(genConn)
-	return Tunnel(genConn)
+	return logConnect(genConn)
 }
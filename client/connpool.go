@@ -1,6 +1,11 @@
 package main
 
-import "net"
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
 
 // ConnPool is an interface for create / retrieve conn
 type ConnPool interface {
@@ -22,3 +27,301 @@ func (p SimplePool) Put(conn net.Conn) {
 	//fmt.Println("<<   Put")
 	conn.Close()
 }
+
+// poolWait is how long Get waits for a connection to be closed, if there are
+// too many.
+var poolWait = 30 * time.Second
+
+var errPoolFull = errors.New("Too many connections")
+
+// WarmPool is a ConnPool keeps connections opened ahead, so a request does
+// not wait for the handshakes of a new one. The connections are counted
+// until they are closed, no more than the max are opened.
+//
+// The warm tunnels are open tunnels to the server, they count against the
+// tunnels it allows to the client, so the size should be less than that.
+type WarmPool struct {
+	dial funcConn
+	size int
+
+	// idleTimeout is how long a warm connection is kept, it is replaced
+	// then, before the other side finds it idle. It is kept until it is
+	// used if idleTimeout is not positive.
+	idleTimeout time.Duration
+
+	// slots has a token for each connection opened
+	slots chan struct{}
+	// ready is notified when a warm connection is added
+	ready chan struct{}
+	done  chan struct{}
+
+	lock    sync.Mutex
+	warm    []*pooledConn
+	filling int
+	stats   PoolStats
+}
+
+// PoolStats is the statistics of a WarmPool.
+type PoolStats struct {
+	Warm     int   // connections waiting
+	Open     int   // connections waiting or in use
+	Hits     int64 // Get served by warm connections
+	Misses   int64 // Get opening new connections
+	Dials    int64 // connections opened
+	Failures int64 // failures to open
+	Evicted  int64 // warm connections closed, as idle or dead
+}
+
+// pooledConn releases its slot of the pool when it is closed.
+type pooledConn struct {
+	net.Conn
+	pool  *WarmPool
+	since time.Time
+	once  sync.Once
+}
+
+func (c *pooledConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() {
+		<-c.pool.slots
+		c.pool.fill()
+	})
+	return err
+}
+
+// NewWarmPool returns a WarmPool keeps size connections by dial warm for
+// idleTimeout each, or until they are used if idleTimeout <= 0, with max
+// connections at most.
+func NewWarmPool(dial funcConn, size, max int, idleTimeout time.Duration) *WarmPool {
+	if max < size {
+		max = size
+	}
+	p := &WarmPool{
+		dial:        dial,
+		size:        size,
+		idleTimeout: idleTimeout,
+		slots:       make(chan struct{}, max),
+		ready:       make(chan struct{}, 1),
+		done:        make(chan struct{}),
+	}
+	if idleTimeout > 0 {
+		go p.evict()
+	}
+	p.fill()
+	return p
+}
+
+// Get returns a warm connection, or a new one. It waits for a warm one if
+// there are too many connections.
+func (p *WarmPool) Get() (net.Conn, error) {
+	return p.get(true)
+}
+
+// TryGet is Get, but it fails with errPoolFull rather than waiting.
+func (p *WarmPool) TryGet() (net.Conn, error) {
+	return p.get(false)
+}
+
+// get is Get, waiting only if wait is true.
+func (p *WarmPool) get(wait bool) (net.Conn, error) {
+	var timeout <-chan time.Time
+	if wait {
+		timeout = time.After(poolWait)
+	}
+	for {
+		if c := p.take(); c != nil {
+			if alive(c) {
+				p.lock.Lock()
+				p.stats.Hits++
+				p.lock.Unlock()
+				p.fill()
+				return c, nil
+			}
+			p.lock.Lock()
+			p.stats.Evicted++
+			p.lock.Unlock()
+			c.Close()
+			continue
+		}
+
+		if !wait {
+			select {
+			case p.slots <- struct{}{}:
+				return p.miss()
+			default:
+				return nil, errPoolFull
+			}
+		}
+		select {
+		case p.slots <- struct{}{}:
+			return p.miss()
+		case <-p.ready:
+		case <-timeout:
+			return nil, errPoolFull
+		}
+	}
+}
+
+// miss opens a new connection in the slot taken.
+func (p *WarmPool) miss() (net.Conn, error) {
+	p.lock.Lock()
+	p.stats.Misses++
+	p.lock.Unlock()
+	c, err := p.open()
+	if err != nil {
+		return nil, err
+	}
+	p.fill()
+	return c, nil
+}
+
+// Put keeps conn warm, if it is got from the pool and not used. Otherwise
+// conn is closed.
+func (p *WarmPool) Put(conn net.Conn) {
+	c, ok := conn.(*pooledConn)
+	if !ok || c.pool != p {
+		conn.Close()
+		return
+	}
+	p.lock.Lock()
+	if len(p.warm) < p.size {
+		p.add(c)
+		c = nil
+	}
+	p.lock.Unlock()
+	if c != nil {
+		c.Close()
+	}
+}
+
+// add adds a warm connection with the lock held.
+func (p *WarmPool) add(c *pooledConn) {
+	p.warm = append(p.warm, c)
+	select {
+	case p.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Stats returns the statistics of the pool.
+func (p *WarmPool) Stats() PoolStats {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	s := p.stats
+	s.Warm = len(p.warm)
+	s.Open = len(p.slots)
+	return s
+}
+
+// Close closes the warm connections, and stops keeping them.
+func (p *WarmPool) Close() {
+	close(p.done)
+	p.lock.Lock()
+	warm := p.warm
+	p.warm, p.size = nil, 0
+	p.lock.Unlock()
+	for _, c := range warm {
+		c.Close()
+	}
+}
+
+// take returns the newest warm connection, or nil.
+func (p *WarmPool) take() *pooledConn {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if n := len(p.warm); n > 0 {
+		c := p.warm[n-1]
+		p.warm = p.warm[:n-1]
+		return c
+	}
+	return nil
+}
+
+// open opens a connection with the slot taken.
+func (p *WarmPool) open() (*pooledConn, error) {
+	conn, err := p.dial()
+	p.lock.Lock()
+	if err != nil {
+		p.stats.Failures++
+	} else {
+		p.stats.Dials++
+	}
+	p.lock.Unlock()
+	if err != nil {
+		<-p.slots
+		return nil, err
+	}
+	return &pooledConn{Conn: conn, pool: p, since: time.Now()}, nil
+}
+
+// fill opens the connections lacking in background, while there are slots.
+// A failure is not retried until the next call.
+func (p *WarmPool) fill() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for len(p.warm)+p.filling < p.size {
+		select {
+		case p.slots <- struct{}{}:
+		default:
+			return
+		}
+		p.filling++
+		go func() {
+			c, err := p.open()
+			p.lock.Lock()
+			p.filling--
+			if err == nil && len(p.warm) < p.size {
+				p.add(c)
+				c = nil
+			}
+			p.lock.Unlock()
+			if c != nil {
+				c.Close()
+			}
+		}()
+	}
+}
+
+// evict closes the warm connections idle for idleTimeout, they are replaced
+// by fill.
+func (p *WarmPool) evict() {
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-time.After(p.idleTimeout / 4):
+		}
+		var expired []*pooledConn
+		p.lock.Lock()
+		warm := p.warm[:0]
+		for _, c := range p.warm {
+			if time.Since(c.since) >= p.idleTimeout {
+				expired = append(expired, c)
+			} else {
+				warm = append(warm, c)
+			}
+		}
+		p.warm = warm
+		p.stats.Evicted += int64(len(expired))
+		p.lock.Unlock()
+		for _, c := range expired {
+			c.Close()
+		}
+	}
+}
+
+// alive reports whether c is not closed by the other side. Nothing should be
+// sent on a connection not used yet.
+func alive(c net.Conn) bool {
+	if err := c.SetReadDeadline(time.Now().Add(time.Millisecond)); err != nil {
+		return false
+	}
+	var b [1]byte
+	n, err := c.Read(b[:])
+	c.SetReadDeadline(time.Time{})
+	if n > 0 {
+		return false
+	}
+	var e net.Error
+	return errors.As(err, &e) && e.Timeout()
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// waitStats waits until the stats of p satisfy ok.
+func waitStats(t *testing.T, p *WarmPool, ok func(PoolStats) bool) PoolStats {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s := p.Stats()
+		if ok(s) {
+			return s
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected stats %+v", s)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestWarmPool(t *testing.T) {
+	defer func(d time.Duration) { poolWait = d }(poolWait)
+	poolWait = 50 * time.Millisecond
+
+	var lock sync.Mutex
+	var remotes []net.Conn
+	dial := func() (net.Conn, error) {
+		c, s := net.Pipe()
+		lock.Lock()
+		remotes = append(remotes, s)
+		lock.Unlock()
+		return c, nil
+	}
+	p := NewWarmPool(dial, 2, 3, time.Minute)
+	defer p.Close()
+	waitStats(t, p, func(s PoolStats) bool { return s.Warm == 2 })
+
+	// the warm ones are served, and refilled up to the max
+	var got []net.Conn
+	for i := 0; i < 3; i++ {
+		c, err := p.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, c)
+	}
+	s := waitStats(t, p, func(s PoolStats) bool { return s.Open == 3 })
+	if s.Hits != 3 || s.Misses != 0 || s.Dials != 3 || s.Warm != 0 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+	if _, err := p.Get(); err != errPoolFull {
+		t.Errorf("Get beyond the max: %v", err)
+	}
+
+	// closing one makes room for a warm one
+	got[0].Close()
+	waitStats(t, p, func(s PoolStats) bool { return s.Warm == 1 && s.Open == 3 })
+
+	// the dead ones are evicted, and a new one is dialed
+	lock.Lock()
+	for _, s := range remotes {
+		s.Close()
+	}
+	lock.Unlock()
+	got[1].Close()
+	waitStats(t, p, func(s PoolStats) bool { return s.Warm == 2 })
+	lock.Lock()
+	for _, s := range remotes {
+		s.Close()
+	}
+	lock.Unlock()
+	c, err := p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if s = p.Stats(); s.Evicted == 0 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+	if !alive(c) {
+		t.Error("dead connection is served")
+	}
+}
+
+func TestWarmPoolIdle(t *testing.T) {
+	dial := func() (net.Conn, error) {
+		c, _ := net.Pipe()
+		return c, nil
+	}
+	p := NewWarmPool(dial, 1, 1, 40*time.Millisecond)
+	defer p.Close()
+	// the idle one is replaced
+	waitStats(t, p, func(s PoolStats) bool { return s.Evicted > 0 && s.Warm == 1 })
+}
+
+func TestWarmPoolNoIdle(t *testing.T) {
+	dial := func() (net.Conn, error) {
+		c, _ := net.Pipe()
+		return c, nil
+	}
+	p := NewWarmPool(dial, 1, 1, 0)
+	defer p.Close()
+	waitStats(t, p, func(s PoolStats) bool { return s.Warm == 1 })
+	time.Sleep(50 * time.Millisecond)
+	if s := p.Stats(); s.Evicted != 0 || s.Dials != 1 {
+		t.Fatalf("unexpected stats %+v", s)
+	}
+}
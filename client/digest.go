@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// basicAuthenticator sends the user and password in clear, see RFC 7617.
+type basicAuthenticator struct {
+	user     string
+	password string
+}
+
+func (a *basicAuthenticator) Scheme() string {
+	return "Basic"
+}
+
+func (a *basicAuthenticator) NewSession() AuthSession {
+	return &basicSession{auth: a}
+}
+
+type basicSession struct {
+	auth *basicAuthenticator
+	sent bool
+}
+
+func (s *basicSession) Authorize(req *http.Request, challenge string) (string, error) {
+	// the proxy rejects the password sent
+	if s.sent {
+		return "", errAuthFailed
+	}
+	s.sent = true
+	return "Basic " + encoder.EncodeToString([]byte(s.auth.user+":"+s.auth.password)), nil
+}
+
+// digestAuthenticator answers the nonce of the proxy by the digest of the
+// password, see RFC 7616. The last nonce is reused by the next requests, so
+// they are authorized without a challenge, until the proxy finds it stale.
+type digestAuthenticator struct {
+	user     string
+	password string
+
+	lock   sync.Mutex
+	params map[string]string
+	nc     int
+}
+
+func (a *digestAuthenticator) Scheme() string {
+	return "Digest"
+}
+
+func (a *digestAuthenticator) NewSession() AuthSession {
+	return &digestSession{auth: a}
+}
+
+type digestSession struct {
+	auth *digestAuthenticator
+	// answered is set when the session answers a challenge
+	answered bool
+}
+
+func (s *digestSession) Authorize(req *http.Request, challenge string) (string, error) {
+	a := s.auth
+	a.lock.Lock()
+	if challenge != "" {
+		params := parseAuthParams(challenge)
+		// a new nonce is only expected if the old one is stale
+		if s.answered && !strings.EqualFold(params["stale"], "true") {
+			a.lock.Unlock()
+			return "", errAuthFailed
+		}
+		if params["nonce"] == "" {
+			a.lock.Unlock()
+			return "", errors.New("Invalid Digest challenge: " + challenge)
+		}
+		a.params, a.nc = params, 0
+		s.answered = true
+	}
+	params := a.params
+	a.nc++
+	count := a.nc
+	a.lock.Unlock()
+	if params == nil {
+		return "", nil
+	}
+
+	algorithm := params["algorithm"]
+	if algorithm == "" {
+		algorithm = "MD5"
+	}
+	var h func() hash.Hash
+	switch strings.TrimSuffix(strings.ToUpper(algorithm), "-SESS") {
+	case "MD5":
+		h = md5.New
+	case "SHA-256":
+		h = sha256.New
+	default:
+		return "", errors.New("Unknown Digest algorithm: " + algorithm)
+	}
+	digest := func(s ...string) string {
+		d := h()
+		d.Write([]byte(strings.Join(s, ":")))
+		return hex.EncodeToString(d.Sum(nil))
+	}
+
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	cnonce := hex.EncodeToString(b)
+	nc := fmt.Sprintf("%08x", count)
+	realm, nonce := params["realm"], params["nonce"]
+
+	uri := req.Host
+	if req.Method != "CONNECT" {
+		uri = req.URL.String()
+	}
+	ha1 := digest(s.auth.user, realm, s.auth.password)
+	if strings.HasSuffix(strings.ToUpper(algorithm), "-SESS") {
+		ha1 = digest(ha1, nonce, cnonce)
+	}
+	ha2 := digest(req.Method, uri)
+
+	v := fmt.Sprintf(`Digest username=%s, realm=%s, nonce=%s, uri=%s, algorithm=%s`,
+		quote(s.auth.user), quote(realm), quote(nonce), quote(uri), algorithm)
+	if hasToken(params["qop"], "auth") {
+		v += fmt.Sprintf(`, response=%s, qop=auth, nc=%s, cnonce=%s`,
+			quote(digest(ha1, nonce, nc, cnonce, "auth", ha2)), nc, quote(cnonce))
+	} else {
+		v += ", response=" + quote(digest(ha1, nonce, ha2))
+	}
+	if opaque, ok := params["opaque"]; ok {
+		v += ", opaque=" + quote(opaque)
+	}
+	return v, nil
+}
+
+// hasToken reports whether the comma separated list has token.
+func hasToken(list, token string) bool {
+	for _, v := range strings.Split(list, ",") {
+		if strings.EqualFold(strings.TrimSpace(v), token) {
+			return true
+		}
+	}
+	return false
+}
+
+func quote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestParseChallenges(t *testing.T) {
+	offers := parseChallenges([]string{
+		`Digest realm="a, b", nonce="n\"1", qop="auth,auth-int", Basic realm="c"`,
+		`NTLM`,
+		`Negotiate TlRMTVNTUAACAAAA==`,
+	})
+	want := map[string]string{
+		"digest":    `realm="a, b", nonce="n\"1", qop="auth,auth-int"`,
+		"basic":     `realm="c"`,
+		"ntlm":      "",
+		"negotiate": "TlRMTVNTUAACAAAA==",
+	}
+	if !reflect.DeepEqual(offers, want) {
+		t.Fatalf("%q", offers)
+	}
+	params := parseAuthParams(offers["digest"])
+	if params["realm"] != "a, b" || params["nonce"] != `n"1` || params["qop"] != "auth,auth-int" {
+		t.Fatalf("%q", params)
+	}
+}
+
+// fakeAuthProxy is a proxy requires Basic or Digest authentication of user
+// with password, by the schemes offered.
+type fakeAuthProxy struct {
+	user     string
+	password string
+	offers   []string
+	target   string
+
+	lock   sync.Mutex
+	nonces map[string]bool
+	stale  bool
+}
+
+func (p *fakeAuthProxy) md5(s ...string) string {
+	h := md5.Sum([]byte(strings.Join(s, ":")))
+	return hex.EncodeToString(h[:])
+}
+
+func (p *fakeAuthProxy) authorized(req *http.Request) bool {
+	auth := req.Header.Get("Proxy-Authorization")
+	switch {
+	case strings.HasPrefix(auth, "Basic "):
+		user, password, ok := (&http.Request{Header: http.Header{"Authorization": {auth}}}).BasicAuth()
+		return ok && user == p.user && password == p.password
+	case strings.HasPrefix(auth, "Digest "):
+		v := parseAuthParams(auth[7:])
+		p.lock.Lock()
+		valid := p.nonces[v["nonce"]]
+		p.lock.Unlock()
+		uri := req.RequestURI
+		ha1 := p.md5(p.user, "test", p.password)
+		ha2 := p.md5(req.Method, uri)
+		return valid && v["username"] == p.user && v["uri"] == uri && v["qop"] == "auth" &&
+			v["response"] == p.md5(ha1, v["nonce"], v["nc"], v["cnonce"], "auth", ha2)
+	}
+	return false
+}
+
+func (p *fakeAuthProxy) challenge(stale bool) string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	nonce := strconv.Itoa(len(p.nonces))
+	if p.nonces == nil {
+		p.nonces = map[string]bool{}
+	}
+	p.nonces[nonce] = true
+	s := "HTTP/1.1 407 Proxy Authentication Required\r\n"
+	for _, v := range p.offers {
+		if v == "Digest" {
+			v = `Digest realm="test", qop="auth", nonce="` + nonce + `"`
+			if stale {
+				v += ", stale=true"
+			}
+		}
+		s += "Proxy-Authenticate: " + v + "\r\n"
+	}
+	return s + "Content-Length: 0\r\n\r\n"
+}
+
+func (p *fakeAuthProxy) serve(c net.Conn) {
+	defer c.Close()
+	br := bufio.NewReader(c)
+	for {
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return
+		}
+		io.Copy(ioutil.Discard, req.Body)
+		if !p.authorized(req) {
+			io.WriteString(c, p.challenge(false))
+			continue
+		}
+		// expire the nonce once
+		p.lock.Lock()
+		stale := p.stale
+		if stale {
+			p.nonces, p.stale = map[string]bool{"x": true}, false
+		}
+		p.lock.Unlock()
+		if stale {
+			io.WriteString(c, p.challenge(true))
+			continue
+		}
+
+		if req.Method == "CONNECT" {
+			d, err := net.Dial("tcp", p.target)
+			if err != nil {
+				return
+			}
+			io.WriteString(c, "HTTP/1.1 200 Connection established\r\n\r\n")
+			go func() {
+				io.Copy(d, br)
+				d.Close()
+			}()
+			io.Copy(c, d)
+			return
+		}
+		body := req.Method + " " + req.URL.Path + " " + strings.Fields(req.Header.Get("Proxy-Authorization"))[0]
+		io.WriteString(c, "HTTP/1.1 200 OK\r\nContent-Length: "+strconv.Itoa(len(body))+"\r\n\r\n"+body)
+	}
+}
+
+func TestAuthProxy(t *testing.T) {
+	echo := listen(t, func(c net.Conn) {
+		io.Copy(c, c)
+		c.Close()
+	})
+
+	for _, v := range []struct {
+		offers   []string
+		password string
+		stale    bool
+		scheme   string
+	}{
+		{[]string{"Basic realm=\"test\""}, "secret", false, "Basic"},
+		{[]string{"Basic realm=\"test\"", "Digest"}, "secret", false, "Digest"},
+		{[]string{"Digest"}, "secret", true, "Digest"},
+		{[]string{"Basic realm=\"test\""}, "wrong", false, ""},
+		{[]string{"Digest"}, "wrong", false, ""},
+	} {
+		fake := &fakeAuthProxy{user: "alice", password: "secret", offers: v.offers, target: echo}
+		auth, _ := NewProxyAuth("alice", v.password, "")
+		p, err := NewNTLMProxy("http://"+listen(t, fake.serve), auth)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// CONNECT, twice by the scheme remembered
+		for i := 0; i < 2; i++ {
+			fake.lock.Lock()
+			fake.stale = v.stale
+			fake.lock.Unlock()
+			c, err := p.dial("example.com:443")
+			if (err == nil) != (v.scheme != "") {
+				t.Fatalf("%v: dial %v", v, err)
+			}
+			if err == nil {
+				io.WriteString(c, "ping")
+				b := make([]byte, 4)
+				if _, err := io.ReadFull(c, b); err != nil || string(b) != "ping" {
+					t.Fatalf("%v: %q %v", v, b, err)
+				}
+				c.Close()
+			}
+		}
+		if auth.scheme != v.scheme && v.scheme != "" {
+			t.Fatalf("%v: scheme %s", v, auth.scheme)
+		}
+
+		// plain http, with body
+		auth.scheme = ""
+		ts := httptest.NewServer(p)
+		pURL, _ := url.Parse(ts.URL)
+		client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(pURL)}}
+		for i := 0; i < 2; i++ {
+			resp, err := client.Post("http://example.com/a", "text/plain", strings.NewReader("body"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if ok := resp.StatusCode == 200 && string(b) == "POST /a "+v.scheme; ok != (v.scheme != "") {
+				t.Fatalf("%v: %d %q", v, resp.StatusCode, b)
+			}
+		}
+		ts.Close()
+	}
+}
+
+func TestNetrc(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "netrc")
+	ioutil.WriteFile(path, []byte(`machine other login bob password x
+machine proxy.example.com
+	login alice
+	password secret
+default login guest password guest
+`), 0600)
+	for _, v := range []struct{ host, login, password string }{
+		{"proxy.example.com", "alice", "secret"},
+		{"other", "bob", "x"},
+		{"unknown", "guest", "guest"},
+	} {
+		login, password, err := netrcLookup(path, v.host)
+		if err != nil || login != v.login || password != v.password {
+			t.Fatalf("%s: %s %s %v", v.host, login, password, err)
+		}
+	}
+	if login, _, err := netrcLookup(filepath.Join(t.TempDir(), "none"), "other"); err != nil || login != "" {
+		t.Fatalf("missing file: %q %v", login, err)
+	}
+}
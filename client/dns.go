@@ -0,0 +1,513 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ramuchu/fetch"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dnsTTL is the TTL of the answers from the system resolver, as it does not
+// tell the real one.
+const dnsTTL = 60
+
+// dnsCacheSize is the maximum number of answers kept in cache.
+const dnsCacheSize = 4096
+
+var dnsTimeout = 5 * time.Second
+
+var errDNSTimeout = errors.New("DNS query timeout")
+var errDNSBusy = errors.New("Too many pending DNS queries")
+
+// DNSServer answers the DNS queries of local clients, by UDP and TCP.
+//
+// Names on the remote route are resolved by the remote server through the
+// tunnel, so the corporate resolver cannot poison or refuse them. Addresses
+// (A and AAAA) of other names are resolved by the system resolver, and if it
+// fails, by the remote server. Other types of queries always go remote.
+// Answers are cached according to their TTLs.
+type DNSServer struct {
+	// Remote tells if host must be resolved by the remote server.
+	Remote func(host string) bool
+	// Dial opens a tunnel in DNS mode, see fetch.MethodDNS.
+	Dial func() (net.Conn, error)
+	// Resolver resolves the names of direct route. If it is nil,
+	// net.DefaultResolver is used. It must not query this server.
+	Resolver *net.Resolver
+
+	cache dnsCache
+
+	lock   sync.Mutex
+	tunnel *dnsTunnel
+}
+
+// ListenAndServe listens on addr for both UDP and TCP, and serves the queries.
+func (s *DNSServer) ListenAndServe(addr string) error {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		pc.Close()
+		return err
+	}
+
+	errc := make(chan error, 2)
+	go func() { errc <- s.ServeUDP(pc) }()
+	go func() { errc <- s.ServeTCP(l) }()
+	err = <-errc
+	pc.Close()
+	l.Close()
+	return err
+}
+
+// ServeUDP answers the queries from pc.
+func (s *DNSServer) ServeUDP(pc net.PacketConn) error {
+	b := make([]byte, fetch.MaxDNS)
+	for {
+		n, addr, err := pc.ReadFrom(b)
+		if err != nil {
+			return err
+		}
+		go func(q []byte, addr net.Addr) {
+			resp, err := s.Resolve(q)
+			if err != nil {
+				log.Print("DNS: " + err.Error())
+				return
+			}
+			pc.WriteTo(truncateDNS(resp, udpSize(q)), addr)
+		}(append([]byte(nil), b[:n]...), addr)
+	}
+}
+
+// ServeTCP accepts connections from l, and answers the queries from them.
+func (s *DNSServer) ServeTCP(l net.Listener) error {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serveConn(c)
+	}
+}
+
+func (s *DNSServer) serveConn(c net.Conn) {
+	defer c.Close()
+	b := make([]byte, fetch.MaxDNS)
+	for {
+		c.SetReadDeadline(time.Now().Add(2 * time.Minute))
+		n, err := fetch.ReadDNS(c, b)
+		if err != nil {
+			return
+		}
+		resp, err := s.Resolve(b[:n])
+		if err != nil {
+			log.Print("DNS: " + err.Error())
+			return
+		}
+		if err := fetch.WriteDNS(c, resp); err != nil {
+			return
+		}
+	}
+}
+
+// Resolve returns the response of query q.
+// It only returns error if q cannot be parsed, failures are reported in the response.
+func (s *DNSServer) Resolve(q []byte) ([]byte, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(q)
+	if err != nil {
+		return nil, err
+	}
+	question, err := p.Question()
+	if err != nil {
+		return nil, err
+	}
+
+	key := question.Name.String() + question.Type.String() + question.Class.String()
+	key = strings.ToLower(key)
+	if resp := s.cache.get(key, h.ID); resp != nil {
+		return resp, nil
+	}
+
+	name := strings.TrimSuffix(question.Name.String(), ".")
+	remote := s.Remote != nil && s.Remote(name)
+	var resp []byte
+	var ttl uint32
+	if !remote && (question.Type == dnsmessage.TypeA || question.Type == dnsmessage.TypeAAAA) {
+		resp, err = s.resolveSystem(h, question)
+		ttl = dnsTTL
+	}
+	if resp == nil {
+		if resp, err = s.exchange(q); err == nil {
+			ttl = minTTL(resp)
+		}
+	}
+	if err != nil {
+		log.Print("DNS " + name + ": " + err.Error())
+		return replyDNS(h, question, dnsmessage.RCodeServerFailure, nil, 0)
+	}
+
+	s.cache.set(key, resp, ttl)
+	return resp, nil
+}
+
+// resolveSystem resolves the address by the system resolver.
+// It returns nil if the name cannot be resolved.
+func (s *DNSServer) resolveSystem(h dnsmessage.Header, q dnsmessage.Question) ([]byte, error) {
+	r := s.Resolver
+	if r == nil {
+		r = net.DefaultResolver
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), dnsTimeout)
+	defer cancel()
+	addrs, err := r.LookupIPAddr(ctx, strings.TrimSuffix(q.Name.String(), "."))
+	if err != nil {
+		return nil, nil
+	}
+
+	var ips []net.IP
+	for _, a := range addrs {
+		if (a.IP.To4() != nil) == (q.Type == dnsmessage.TypeA) {
+			ips = append(ips, a.IP)
+		}
+	}
+	return replyDNS(h, q, dnsmessage.RCodeSuccess, ips, dnsTTL)
+}
+
+// exchange sends q to the remote server through the tunnel.
+func (s *DNSServer) exchange(q []byte) ([]byte, error) {
+	s.lock.Lock()
+	t := s.tunnel
+	if t == nil || t.failed() {
+		if s.Dial == nil {
+			s.lock.Unlock()
+			return nil, errors.New("No tunnel for DNS")
+		}
+		conn, err := s.Dial()
+		if err != nil {
+			s.lock.Unlock()
+			return nil, err
+		}
+		t = newDNSTunnel(conn)
+		s.tunnel = t
+	}
+	s.lock.Unlock()
+
+	return t.exchange(q)
+}
+
+// replyDNS builds the response to q with addresses ips.
+func replyDNS(h dnsmessage.Header, q dnsmessage.Question, rcode dnsmessage.RCode, ips []net.IP, ttl uint32) ([]byte, error) {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:                 h.ID,
+		Response:           true,
+		OpCode:             h.OpCode,
+		RecursionDesired:   h.RecursionDesired,
+		RecursionAvailable: true,
+		RCode:              rcode,
+	})
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(q); err != nil {
+		return nil, err
+	}
+	if err := b.StartAnswers(); err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		rh := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: ttl}
+		var err error
+		if ip4 := ip.To4(); ip4 != nil {
+			var a dnsmessage.AResource
+			copy(a.A[:], ip4)
+			err = b.AResource(rh, a)
+		} else {
+			var a dnsmessage.AAAAResource
+			copy(a.AAAA[:], ip.To16())
+			err = b.AAAAResource(rh, a)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return b.Finish()
+}
+
+// minTTL returns the time the response can be cached. For negative answers,
+// it is the minimum TTL in SOA, see RFC 2308.
+func minTTL(resp []byte) uint32 {
+	var m dnsmessage.Message
+	if err := m.Unpack(resp); err != nil {
+		return 0
+	}
+	if m.RCode != dnsmessage.RCodeSuccess && m.RCode != dnsmessage.RCodeNameError {
+		return 0
+	}
+
+	var ttl uint32
+	found := false
+	for _, r := range m.Answers {
+		if !found || r.Header.TTL < ttl {
+			ttl = r.Header.TTL
+			found = true
+		}
+	}
+	if found {
+		return ttl
+	}
+	for _, r := range m.Authorities {
+		if soa, ok := r.Body.(*dnsmessage.SOAResource); ok {
+			if soa.MinTTL < r.Header.TTL {
+				return soa.MinTTL
+			}
+			return r.Header.TTL
+		}
+	}
+	return 0
+}
+
+// udpSize returns the maximum size of response over UDP the client accepts.
+func udpSize(q []byte) int {
+	var p dnsmessage.Parser
+	if _, err := p.Start(q); err != nil {
+		return 512
+	}
+	p.SkipAllQuestions()
+	p.SkipAllAnswers()
+	p.SkipAllAuthorities()
+	for {
+		h, err := p.AdditionalHeader()
+		if err != nil {
+			return 512
+		}
+		if h.Type == dnsmessage.TypeOPT && h.Class > 512 {
+			return int(h.Class)
+		}
+		p.SkipAdditional()
+	}
+}
+
+// truncateDNS removes the records of resp and sets TC bit if it is larger
+// than size, so the client will try again by TCP.
+func truncateDNS(resp []byte, size int) []byte {
+	if len(resp) <= size {
+		return resp
+	}
+	var m dnsmessage.Message
+	if err := m.Unpack(resp); err != nil {
+		return resp
+	}
+	m.Truncated = true
+	m.Answers, m.Authorities, m.Additionals = nil, nil, nil
+	b, err := m.Pack()
+	if err != nil {
+		return resp
+	}
+	return b
+}
+
+type dnsEntry struct {
+	msg    []byte
+	stored time.Time
+	expire time.Time
+}
+
+// dnsCache stores the responses until their TTLs expire.
+type dnsCache struct {
+	lock sync.Mutex
+	m    map[string]*dnsEntry
+}
+
+// get returns the cached response with id, and the TTLs counted down.
+func (c *dnsCache) get(key string, id uint16) []byte {
+	now := time.Now()
+	c.lock.Lock()
+	e, ok := c.m[key]
+	if ok && now.After(e.expire) {
+		delete(c.m, key)
+		ok = false
+	}
+	c.lock.Unlock()
+	if !ok {
+		return nil
+	}
+
+	var m dnsmessage.Message
+	if err := m.Unpack(e.msg); err != nil {
+		return nil
+	}
+	m.ID = id
+	elapsed := uint32(now.Sub(e.stored) / time.Second)
+	for _, rs := range [][]dnsmessage.Resource{m.Answers, m.Authorities, m.Additionals} {
+		for i := range rs {
+			if rs[i].Header.Type == dnsmessage.TypeOPT {
+				continue
+			}
+			if rs[i].Header.TTL > elapsed {
+				rs[i].Header.TTL -= elapsed
+			} else {
+				rs[i].Header.TTL = 0
+			}
+		}
+	}
+	b, err := m.Pack()
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+func (c *dnsCache) set(key string, msg []byte, ttl uint32) {
+	if ttl == 0 {
+		return
+	}
+	now := time.Now()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.m == nil {
+		c.m = make(map[string]*dnsEntry)
+	}
+	if len(c.m) >= dnsCacheSize {
+		for k, e := range c.m {
+			if now.After(e.expire) {
+				delete(c.m, k)
+			}
+		}
+		if len(c.m) >= dnsCacheSize {
+			c.m = make(map[string]*dnsEntry)
+		}
+	}
+	c.m[key] = &dnsEntry{
+		msg:    msg,
+		stored: now,
+		expire: now.Add(time.Duration(ttl) * time.Second),
+	}
+}
+
+// dnsTunnel sends the queries through a tunnel in DNS mode. The queries are
+// given new IDs, so the ones from different clients will not be mixed up.
+type dnsTunnel struct {
+	conn  net.Conn
+	wlock sync.Mutex
+
+	lock    sync.Mutex
+	pending map[uint16]chan []byte
+	next    uint16
+	err     error
+}
+
+func newDNSTunnel(conn net.Conn) *dnsTunnel {
+	t := &dnsTunnel{
+		conn:    conn,
+		pending: make(map[uint16]chan []byte),
+	}
+	go t.read()
+	return t
+}
+
+func (t *dnsTunnel) failed() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.err != nil
+}
+
+func (t *dnsTunnel) exchange(q []byte) ([]byte, error) {
+	if len(q) < 2 {
+		return nil, errors.New("DNS query too short")
+	}
+
+	t.lock.Lock()
+	if t.err != nil {
+		t.lock.Unlock()
+		return nil, t.err
+	}
+	if len(t.pending) > 0xffff {
+		t.lock.Unlock()
+		return nil, errDNSBusy
+	}
+	id := t.next
+	for _, ok := t.pending[id]; ok; _, ok = t.pending[id] {
+		id++
+	}
+	t.next = id + 1
+	ch := make(chan []byte, 1)
+	t.pending[id] = ch
+	t.lock.Unlock()
+
+	m := append([]byte(nil), q...)
+	binary.BigEndian.PutUint16(m, id)
+	t.wlock.Lock()
+	err := fetch.WriteDNS(t.conn, m)
+	t.wlock.Unlock()
+	if err != nil {
+		t.close(err)
+		return nil, err
+	}
+
+	timer := time.NewTimer(dnsTimeout)
+	defer timer.Stop()
+	select {
+	case resp, ok := <-ch:
+		if !ok {
+			t.lock.Lock()
+			defer t.lock.Unlock()
+			return nil, t.err
+		}
+		copy(resp, q[:2])
+		return resp, nil
+	case <-timer.C:
+		t.lock.Lock()
+		delete(t.pending, id)
+		t.lock.Unlock()
+		return nil, errDNSTimeout
+	}
+}
+
+func (t *dnsTunnel) read() {
+	b := make([]byte, fetch.MaxDNS)
+	for {
+		n, err := fetch.ReadDNS(t.conn, b)
+		if err != nil {
+			t.close(err)
+			return
+		}
+		if n < 2 {
+			continue
+		}
+		id := binary.BigEndian.Uint16(b)
+		t.lock.Lock()
+		ch, ok := t.pending[id]
+		delete(t.pending, id)
+		t.lock.Unlock()
+		if ok {
+			ch <- append([]byte(nil), b[:n]...)
+		}
+	}
+}
+
+// close fails all pending queries with err.
+func (t *dnsTunnel) close(err error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.err != nil {
+		return
+	}
+	t.err = err
+	t.conn.Close()
+	for id, ch := range t.pending {
+		close(ch)
+		delete(t.pending, id)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/ramuchu/fetch"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func dnsQuery(t *testing.T, id uint16, name string, typ dnsmessage.Type) []byte {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, RecursionDesired: true})
+	b.StartQuestions()
+	b.Question(dnsmessage.Question{
+		Name:  dnsmessage.MustNewName(name),
+		Type:  typ,
+		Class: dnsmessage.ClassINET,
+	})
+	q, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+func dnsAnswer(t *testing.T, resp []byte) (dnsmessage.Header, []dnsmessage.Resource) {
+	var m dnsmessage.Message
+	if err := m.Unpack(resp); err != nil {
+		t.Fatal(err)
+	}
+	return m.Header, m.Answers
+}
+
+// fakeDNSTunnel answers every A query with 10.0.0.1, and counts the queries.
+func fakeDNSTunnel(t *testing.T, count *int32) func() (net.Conn, error) {
+	return func() (net.Conn, error) {
+		c, s := net.Pipe()
+		go func() {
+			b := make([]byte, fetch.MaxDNS)
+			for {
+				n, err := fetch.ReadDNS(s, b)
+				if err != nil {
+					s.Close()
+					return
+				}
+				atomic.AddInt32(count, 1)
+				var p dnsmessage.Parser
+				h, _ := p.Start(b[:n])
+				q, _ := p.Question()
+				resp, err := replyDNS(h, q, dnsmessage.RCodeSuccess, []net.IP{net.IPv4(10, 0, 0, 1)}, 300)
+				if err != nil {
+					t.Error(err)
+				}
+				fetch.WriteDNS(s, resp)
+			}
+		}()
+		return c, nil
+	}
+}
+
+func TestDNSRemote(t *testing.T) {
+	var count int32
+	s := &DNSServer{
+		Remote: func(host string) bool { return host == "blocked.example.com" },
+		Dial:   fakeDNSTunnel(t, &count),
+	}
+
+	for i, id := range []uint16{0x1234, 0x4321} {
+		resp, err := s.Resolve(dnsQuery(t, id, "blocked.example.com.", dnsmessage.TypeA))
+		if err != nil {
+			t.Fatal(err)
+		}
+		h, answers := dnsAnswer(t, resp)
+		if h.ID != id {
+			t.Fatalf("Wrong ID: expect %x see %x", id, h.ID)
+		}
+		if len(answers) != 1 || answers[0].Body.(*dnsmessage.AResource).A != [4]byte{10, 0, 0, 1} {
+			t.Fatalf("Wrong answers: %v", answers)
+		}
+		if i == 1 && answers[0].Header.TTL > 300 {
+			t.Fatalf("TTL of cached answer: %d", answers[0].Header.TTL)
+		}
+	}
+	if count != 1 {
+		t.Fatalf("The answer is not cached, %d queries", count)
+	}
+
+	// other types always go remote
+	s.Resolve(dnsQuery(t, 1, "localhost.", dnsmessage.TypeTXT))
+	if count != 2 {
+		t.Fatalf("TXT is not sent to remote, %d queries", count)
+	}
+}
+
+func TestDNSDirect(t *testing.T) {
+	var count int32
+	s := &DNSServer{
+		Remote: func(host string) bool { return false },
+		Dial:   fakeDNSTunnel(t, &count),
+	}
+	resp, err := s.Resolve(dnsQuery(t, 7, "localhost.", dnsmessage.TypeA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, answers := dnsAnswer(t, resp)
+	if h.ID != 7 || h.RCode != dnsmessage.RCodeSuccess {
+		t.Fatalf("Wrong header: %v", h)
+	}
+	if len(answers) == 0 || answers[0].Body.(*dnsmessage.AResource).A != [4]byte{127, 0, 0, 1} {
+		t.Fatalf("Wrong answers: %v", answers)
+	}
+	if count != 0 {
+		t.Fatalf("Direct name is sent to remote, %d queries", count)
+	}
+}
+
+func TestDNSTruncate(t *testing.T) {
+	ips := make([]net.IP, 100)
+	for i := range ips {
+		ips[i] = net.IPv4(10, 0, 0, byte(i))
+	}
+	q := dnsQuery(t, 1, "many.example.com.", dnsmessage.TypeA)
+	var p dnsmessage.Parser
+	h, _ := p.Start(q)
+	question, _ := p.Question()
+	resp, err := replyDNS(h, question, dnsmessage.RCodeSuccess, ips, 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := truncateDNS(resp, udpSize(q))
+	if len(b) > 512 {
+		t.Fatalf("Not truncated: %d", len(b))
+	}
+	if h, answers := dnsAnswer(t, b); !h.Truncated || len(answers) != 0 {
+		t.Fatalf("Wrong truncated response: %v %v", h, answers)
+	}
+}
+
+func TestDNSTunnelBusy(t *testing.T) {
+	tun := &dnsTunnel{pending: make(map[uint16]chan []byte)}
+	for i := 0; i <= 0xffff; i++ {
+		tun.pending[uint16(i)] = nil
+	}
+	if _, err := tun.exchange([]byte{0, 0, 1, 0}); err != errDNSBusy {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+// firstTimeout is how long to wait for the first message of the client. The
+// tunnel is not checked if the client waits for the host to speak first.
+var firstTimeout = 3 * time.Second
+
+// replyTimeout is how long to wait for the reply of the host.
+var replyTimeout = 10 * time.Second
+
+// the content types of TLS records, and the types of handshake messages
+const (
+	recordAlert     = 21
+	recordHandshake = 22
+
+	typeServerHello     = 2
+	typeCertificate     = 11
+	typeServerHelloDone = 14
+
+	extSupportedVersions = 43
+)
+
+// isTimeout reports whether err is a timeout of reading.
+func isTimeout(err error) bool {
+	var e net.Error
+	return errors.As(err, &e) && e.Timeout()
+}
+
+// readFirst reads the first message of the client through a tunnel. It is
+// nil if the client sends nothing in firstTimeout.
+func readFirst(c net.Conn) ([]byte, error) {
+	b, err := readRecords(c, firstTimeout)
+	if len(b) == 0 && isTimeout(err) {
+		return nil, nil
+	}
+	return b, err
+}
+
+// exchange sends first to c, and reads the reply. The reply of TLS is read
+// until the certificates of the server, if they are not encrypted. What is
+// read is returned with the error too.
+func exchange(c net.Conn, first []byte) ([]byte, error) {
+	if _, err := c.Write(first); err != nil {
+		return nil, err
+	}
+	reply, err := readRecords(c, replyTimeout)
+	if err != nil || first[0] != recordHandshake || reply[0] != recordHandshake {
+		return reply, err
+	}
+	for {
+		if _, _, done := parseServerFlight(reply); done {
+			return reply, nil
+		}
+		more, err := readRecords(c, replyTimeout)
+		reply = append(reply, more...)
+		if err != nil {
+			return reply, err
+		}
+	}
+}
+
+// readRecords reads the whole TLS records from c, or what is read at once if
+// it is not TLS.
+func readRecords(c net.Conn, timeout time.Duration) ([]byte, error) {
+	c.SetReadDeadline(time.Now().Add(timeout))
+	defer c.SetReadDeadline(time.Time{})
+
+	b := make([]byte, 4096)
+	n, err := c.Read(b)
+	if n == 0 {
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	b = b[:n]
+	// content types of change_cipher_spec, alert, handshake and application_data
+	if b[0] < 20 || b[0] > 23 {
+		return b, nil
+	}
+	// read the rest of the last record
+	for i := 0; i < len(b); {
+		if len(b)-i < 5 {
+			header := make([]byte, 5-(len(b)-i))
+			if _, err := io.ReadFull(c, header); err != nil {
+				return nil, err
+			}
+			b = append(b, header...)
+		}
+		size := 5 + int(binary.BigEndian.Uint16(b[i+3:i+5]))
+		if len(b)-i < size {
+			rest := make([]byte, size-(len(b)-i))
+			if _, err := io.ReadFull(c, rest); err != nil {
+				return nil, err
+			}
+			b = append(b, rest...)
+		}
+		i += size
+	}
+	return b, nil
+}
+
+// parseServerFlight parses the reply of TLS to the ClientHello. It returns
+// the certificates of the server in DER if they are not encrypted, whether
+// the version is TLS 1.3, and whether the reply is read enough to know.
+func parseServerFlight(reply []byte) (certs [][]byte, tls13, done bool) {
+	var hs []byte
+	for len(reply) >= 5 {
+		size := 5 + int(binary.BigEndian.Uint16(reply[3:5]))
+		if len(reply) < size {
+			break
+		}
+		if reply[0] != recordHandshake {
+			// the handshake in clear is over
+			done = true
+			break
+		}
+		hs = append(hs, reply[5:size]...)
+		reply = reply[size:]
+	}
+	for len(hs) >= 4 {
+		size := 4 + (int(hs[1])<<16 | int(hs[2])<<8 | int(hs[3]))
+		if len(hs) < size {
+			break
+		}
+		body := hs[4:size]
+		switch hs[0] {
+		case typeServerHello:
+			if tls13 = isTLS13(body); tls13 {
+				return nil, true, true
+			}
+		case typeCertificate:
+			return parseCertificates(body), false, true
+		case typeServerHelloDone:
+			return nil, false, true
+		}
+		hs = hs[size:]
+	}
+	return nil, tls13, done
+}
+
+// isTLS13 reports whether the ServerHello selects TLS 1.3 by the extension
+// supported_versions.
+func isTLS13(body []byte) bool {
+	// version, random
+	if len(body) < 35 {
+		return false
+	}
+	// session id, cipher suite, compression method
+	i := 35 + int(body[34]) + 3
+	if len(body) < i+2 {
+		return false
+	}
+	exts := body[i+2:]
+	for len(exts) >= 4 {
+		typ, size := binary.BigEndian.Uint16(exts), int(binary.BigEndian.Uint16(exts[2:]))
+		if len(exts) < 4+size {
+			return false
+		}
+		if typ == extSupportedVersions && size == 2 {
+			return binary.BigEndian.Uint16(exts[4:]) == 0x0304
+		}
+		exts = exts[4+size:]
+	}
+	return false
+}
+
+// parseCertificates returns the certificates in the Certificate message of
+// TLS 1.2.
+func parseCertificates(body []byte) [][]byte {
+	var certs [][]byte
+	if len(body) < 3 {
+		return nil
+	}
+	body = body[3:]
+	for len(body) >= 3 {
+		size := int(body[0])<<16 | int(body[1])<<8 | int(body[2])
+		if len(body) < 3+size {
+			break
+		}
+		certs = append(certs, body[3:3+size])
+		body = body[3+size:]
+	}
+	return certs
+}
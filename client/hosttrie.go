@@ -0,0 +1,181 @@
+package main
+
+import (
+	"net"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// the kinds of the patterns of hosts
+const (
+	// example.com matches the host only
+	matchExact = iota
+	// *.example.com matches the subdomains of the host
+	matchWildcard
+	// .example.com matches the host and its subdomains
+	matchSuffix
+)
+
+// hostTrie maps the patterns of hosts to the items, by the labels of the
+// names from the end. The pattern of the most labels matching a host wins,
+// and of the same labels, exact wins wildcard, which wins suffix.
+type hostTrie struct {
+	root trieNode
+}
+
+type trieNode struct {
+	children map[string]*trieNode
+	// the items of the patterns ending at the node, by the kind
+	items [3]*item
+}
+
+// normalizeHost returns host in lower case and punycode, without the port
+// and the trailing dot.
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for i := 0; i < len(host); i++ {
+		if host[i] >= 0x80 {
+			if a, err := idna.Punycode.ToASCII(host); err == nil {
+				return a
+			}
+			break
+		}
+	}
+	return host
+}
+
+// parsePattern returns the labels of pattern from the end, and its kind. A
+// star not followed by a dot, as *example.com, is a suffix.
+func parsePattern(pattern string) ([]string, int) {
+	kind := matchExact
+	switch {
+	case pattern == "*":
+		return nil, matchWildcard
+	case strings.HasPrefix(pattern, "*."):
+		kind, pattern = matchWildcard, pattern[2:]
+	case strings.HasPrefix(pattern, "*"):
+		kind, pattern = matchSuffix, pattern[1:]
+	case strings.HasPrefix(pattern, "."):
+		kind, pattern = matchSuffix, pattern[1:]
+	}
+	return hostLabels(normalizeHost(pattern)), kind
+}
+
+// hostLabels returns the labels of host from the end.
+func hostLabels(host string) []string {
+	if host == "" {
+		return nil
+	}
+	labels := strings.Split(host, ".")
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+	return labels
+}
+
+// node returns the node of labels, it is created if create is set.
+func (t *hostTrie) node(labels []string, create bool) *trieNode {
+	n := &t.root
+	for _, l := range labels {
+		next := n.children[l]
+		if next == nil {
+			if !create {
+				return nil
+			}
+			if n.children == nil {
+				n.children = make(map[string]*trieNode)
+			}
+			next = &trieNode{}
+			n.children[l] = next
+		}
+		n = next
+	}
+	return n
+}
+
+// Set stores it by pattern.
+func (t *hostTrie) Set(pattern string, it *item) {
+	labels, kind := parsePattern(pattern)
+	t.node(labels, true).items[kind] = it
+}
+
+// Get returns the item of pattern itself.
+func (t *hostTrie) Get(pattern string) (*item, bool) {
+	labels, kind := parsePattern(pattern)
+	if n := t.node(labels, false); n != nil && n.items[kind] != nil {
+		return n.items[kind], true
+	}
+	return nil, false
+}
+
+// Match returns the item of the longest pattern matching host.
+func (t *hostTrie) Match(host string) (*item, bool) {
+	host = normalizeHost(host)
+	var found *item
+	n := &t.root
+	for end := len(host); ; {
+		if end <= 0 {
+			for _, kind := range []int{matchExact, matchSuffix} {
+				if it := n.items[kind]; it != nil {
+					return it, true
+				}
+			}
+			break
+		}
+		for _, kind := range []int{matchWildcard, matchSuffix} {
+			if it := n.items[kind]; it != nil {
+				found = it
+				break
+			}
+		}
+		// the next label from the end
+		start := strings.LastIndexByte(host[:end], '.') + 1
+		if n = n.children[host[start:end]]; n == nil {
+			break
+		}
+		end = start - 1
+	}
+	return found, found != nil
+}
+
+// Walk calls fn with the patterns and their items, in the order of the
+// labels from the end.
+func (t *hostTrie) Walk(fn func(pattern string, kind int, it *item)) {
+	t.root.walk(nil, fn)
+}
+
+func (n *trieNode) walk(labels []string, fn func(pattern string, kind int, it *item)) {
+	host := make([]string, len(labels))
+	for i, l := range labels {
+		host[len(labels)-1-i] = l
+	}
+	name := strings.Join(host, ".")
+	for kind, it := range n.items {
+		if it == nil {
+			continue
+		}
+		switch {
+		case kind == matchWildcard && name == "":
+			fn("*", kind, it)
+		case kind == matchWildcard:
+			fn("*."+name, kind, it)
+		case kind == matchSuffix:
+			fn("."+name, kind, it)
+		default:
+			fn(name, kind, it)
+		}
+	}
+	keys := make([]string, 0, len(n.children))
+	for k := range n.children {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		n.children[k].walk(append(labels[:len(labels):len(labels)], k), fn)
+	}
+}
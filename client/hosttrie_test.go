@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/cznic/b"
+)
+
+func TestHostTrie(t *testing.T) {
+	var tr hostTrie
+	for _, p := range []string{"example.com", "*.example.com", ".sub.example.com", "Bücher.de", "[::1]:443", "*"} {
+		tr.Set(p, &item{name: p})
+	}
+	for _, v := range []struct {
+		host, want string
+	}{
+		{"example.com", "example.com"},
+		{"EXAMPLE.com:443", "example.com"},
+		{"example.com.", "example.com"},
+		{"www.example.com", "*.example.com"},
+		{"sub.example.com", ".sub.example.com"},
+		{"a.sub.example.com:8080", ".sub.example.com"},
+		{"badexample.com", "*"},
+		{"xn--bcher-kva.de", "Bücher.de"},
+		{"bücher.de:80", "Bücher.de"},
+		{"[::1]:80", "[::1]:443"},
+		{"com", "*"},
+	} {
+		it, ok := tr.Match(v.host)
+		if !ok || it.name != v.want {
+			t.Fatalf("%s: %v %v", v.host, it, ok)
+		}
+	}
+	if it, ok := tr.Get("*.EXAMPLE.com"); !ok || it.name != "*.example.com" {
+		t.Fatalf("get %v %v", it, ok)
+	}
+	if _, ok := tr.Get("example.com:443"); !ok {
+		t.Fatal("get with port")
+	}
+	var patterns []string
+	tr.Walk(func(pattern string, kind int, it *item) {
+		patterns = append(patterns, pattern)
+	})
+	if fmt.Sprint(patterns) != "[* ::1 example.com *.example.com .sub.example.com xn--bcher-kva.de]" {
+		t.Fatalf("walk %v", patterns)
+	}
+}
+
+// compareHost is the order of hosts of the b.Tree replaced by hostTrie,
+// compared from the end, with wild card at the beginning.
+func compareHost(a, b string) int {
+	var i int
+	an, bn := len(a), len(b)
+	var as, bs byte
+	for i = 1; i <= an && i <= bn; i++ {
+		as, bs = a[an-i], b[bn-i]
+		if as != bs {
+			switch {
+			case i == an && as == '*', i == bn && bs == '*':
+				return 0
+			case as > bs:
+				return +1
+			default:
+				return -1
+			}
+		}
+	}
+	return 0
+}
+
+// benchHosts returns n hosts to store, and the hosts to look up, half of
+// them are found.
+func benchHosts(n int) (stored, lookup []string) {
+	for i := 0; i < n; i++ {
+		stored = append(stored, fmt.Sprintf("host%d.domain%d.com", i, i%100))
+		lookup = append(lookup, fmt.Sprintf("host%d.domain%d.com", i, i%100), fmt.Sprintf("other%d.domain%d.com", i, i%100))
+	}
+	return stored, lookup
+}
+
+func BenchmarkHostTrie(bm *testing.B) {
+	for _, n := range []int{100, 10000} {
+		bm.Run(fmt.Sprint(n), func(bm *testing.B) {
+			var tr hostTrie
+			stored, lookup := benchHosts(n)
+			for _, h := range stored {
+				tr.Set(h, &item{})
+			}
+			bm.ResetTimer()
+			for i := 0; i < bm.N; i++ {
+				tr.Match(lookup[i%len(lookup)])
+			}
+		})
+	}
+}
+
+func BenchmarkBTree(bm *testing.B) {
+	for _, n := range []int{100, 10000} {
+		bm.Run(fmt.Sprint(n), func(bm *testing.B) {
+			tr := b.TreeNew(func(a, b interface{}) int {
+				return compareHost(a.(string), b.(string))
+			})
+			stored, lookup := benchHosts(n)
+			for _, h := range stored {
+				tr.Set(h, &item{})
+			}
+			bm.ResetTimer()
+			for i := 0; i < bm.N; i++ {
+				if e, ok := tr.Seek(lookup[i%len(lookup)]); ok {
+					e.Next()
+					e.Close()
+				}
+			}
+		})
+	}
+}
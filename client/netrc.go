@@ -0,0 +1,68 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// defaultNetrc returns $NETRC, or .netrc in the home directory.
+func defaultNetrc() string {
+	if s := os.Getenv("NETRC"); s != "" {
+		return s
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".netrc")
+}
+
+// netrcLookup returns the login and password of host in the netrc file at
+// path, or the default entry if host is not listed. It returns empty strings
+// if the file does not exist.
+func netrcLookup(path, host string) (login, password string, err error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", "", nil
+	} else if err != nil {
+		return "", "", err
+	}
+
+	type entry struct{ login, password string }
+	var cur, def *entry
+	match := false
+	f := strings.Fields(string(b))
+	for i := 0; i < len(f); i++ {
+		switch f[i] {
+		case "machine", "default":
+			if match {
+				return cur.login, cur.password, nil
+			}
+			cur = &entry{}
+			if f[i] == "default" {
+				def = cur
+			} else if i++; i < len(f) {
+				match = f[i] == host
+			}
+		case "login", "password", "account":
+			i++
+			if cur == nil || i >= len(f) {
+				continue
+			}
+			if f[i-1] == "login" {
+				cur.login = f[i]
+			} else if f[i-1] == "password" {
+				cur.password = f[i]
+			}
+		}
+	}
+	if match {
+		return cur.login, cur.password, nil
+	}
+	if def != nil {
+		return def.login, def.password, nil
+	}
+	return "", "", nil
+}
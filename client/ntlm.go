@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"golang.org/x/crypto/md4"
+)
+
+// The NTLM messages, see [MS-NLMP].
+const (
+	ntlmNegotiate    = 1
+	ntlmChallenge    = 2
+	ntlmAuthenticate = 3
+
+	ntlmUnicode          = 0x00000001
+	ntlmOEM              = 0x00000002
+	ntlmRequestTarget    = 0x00000004
+	ntlmNTLM             = 0x00000200
+	ntlmAlwaysSign       = 0x00008000
+	ntlmExtendedSecurity = 0x00080000
+	ntlmTargetInfo       = 0x00800000
+	ntlm128              = 0x20000000
+	ntlm56               = 0x80000000
+
+	ntlmFlags = ntlmUnicode | ntlmOEM | ntlmRequestTarget | ntlmNTLM | ntlmAlwaysSign |
+		ntlmExtendedSecurity | ntlmTargetInfo | ntlm128 | ntlm56
+
+	avEOL       = 0
+	avFlags     = 6
+	avTimestamp = 7
+
+	// avFlags of the AUTHENTICATE message has MIC
+	avFlagMIC = 0x2
+)
+
+var ntlmSignature = []byte("NTLMSSP\x00")
+
+var errNTLMChallenge = errors.New("Invalid NTLM challenge")
+
+// ntlmContext is a NTLM handshake, in pure Go or by SSPI.
+type ntlmContext interface {
+	// Update returns the AUTHENTICATE message of the CHALLENGE message.
+	Update(challenge []byte) ([]byte, error)
+}
+
+// ntlmHandshake sends the NEGOTIATE message first, then the AUTHENTICATE
+// message in response to the challenge.
+type ntlmHandshake struct {
+	start   func() (ntlmContext, []byte, error)
+	context ntlmContext
+	done    bool
+}
+
+func (h *ntlmHandshake) Authorize(req *http.Request, challenge string) (string, error) {
+	if challenge == "" {
+		// the proxy rejects the handshake
+		if h.context != nil {
+			return "", errAuthFailed
+		}
+		context, b, err := h.start()
+		if err != nil {
+			return "", errors.New("Cannot create client context: " + err.Error())
+		}
+		h.context = context
+		return "NTLM " + encoder.EncodeToString(b), nil
+	}
+	if h.context == nil || h.done {
+		return "", errAuthFailed
+	}
+	h.done = true
+	b, err := encoder.DecodeString(challenge)
+	if err != nil {
+		return "", errors.New("Cannot decode challenge: " + challenge)
+	}
+	if b, err = h.context.Update(b); err != nil {
+		return "", errors.New("Failed to response challenge: " + err.Error())
+	}
+	return "NTLM " + encoder.EncodeToString(b), nil
+}
+
+// ntlmAuthenticator is a pure Go NTLMv2 Authenticator.
+type ntlmAuthenticator struct {
+	domain string
+	user   string
+	hash   []byte
+}
+
+// NewNTLMAuthenticator returns the NTLMv2 Authenticator of user in domain.
+func NewNTLMAuthenticator(domain, user, password string) Authenticator {
+	h := md4.New()
+	h.Write(utf16le(password))
+	return &ntlmAuthenticator{domain: domain, user: user, hash: h.Sum(nil)}
+}
+
+// NewNTLMHashAuthenticator returns the NTLMv2 Authenticator of user in
+// domain, with the hex of its NT hash rather than the password.
+func NewNTLMHashAuthenticator(domain, user, hash string) (Authenticator, error) {
+	b, err := hex.DecodeString(hash)
+	if err != nil || len(b) != md4.Size {
+		return nil, errors.New("Invalid NT hash")
+	}
+	return &ntlmAuthenticator{domain: domain, user: user, hash: b}, nil
+}
+
+func (a *ntlmAuthenticator) Scheme() string {
+	return "NTLM"
+}
+
+func (a *ntlmAuthenticator) NewSession() AuthSession {
+	return &ntlmHandshake{start: a.start}
+}
+
+func (a *ntlmAuthenticator) start() (ntlmContext, []byte, error) {
+	// without domain and workstation
+	msg := make([]byte, 32)
+	copy(msg, ntlmSignature)
+	binary.LittleEndian.PutUint32(msg[8:], ntlmNegotiate)
+	binary.LittleEndian.PutUint32(msg[12:], ntlmFlags)
+	return &ntlmSession{auth: a, negotiate: msg}, msg, nil
+}
+
+type ntlmSession struct {
+	auth      *ntlmAuthenticator
+	negotiate []byte
+}
+
+func (s *ntlmSession) Update(challenge []byte) ([]byte, error) {
+	if len(challenge) < 48 || !bytes.Equal(challenge[:8], ntlmSignature) ||
+		binary.LittleEndian.Uint32(challenge[8:]) != ntlmChallenge {
+		return nil, errNTLMChallenge
+	}
+	flags := binary.LittleEndian.Uint32(challenge[20:]) & ntlmFlags
+	serverChallenge := challenge[24:32]
+	targetInfo, ok := ntlmField(challenge, 40)
+	if !ok {
+		return nil, errNTLMChallenge
+	}
+
+	clientChallenge := make([]byte, 8)
+	if _, err := rand.Read(clientChallenge); err != nil {
+		return nil, err
+	}
+	// Use the time of server if it is given, and prove the messages are
+	// not modified by MIC.
+	timestamp, hasTime := avPair(targetInfo, avTimestamp)
+	if !hasTime {
+		timestamp = make([]byte, 8)
+		binary.LittleEndian.PutUint64(timestamp, uint64(time.Now().UnixNano()/100+116444736000000000))
+	} else {
+		targetInfo = setAvFlags(targetInfo, avFlagMIC)
+	}
+
+	ntowf := ntowfv2(s.auth.hash, s.auth.user, s.auth.domain)
+	nt, lm, key := ntlmv2Response(ntowf, serverChallenge, clientChallenge, timestamp, targetInfo)
+	if hasTime {
+		lm = make([]byte, 24)
+	}
+
+	str := func(s string) []byte {
+		if flags&ntlmUnicode != 0 {
+			return utf16le(s)
+		}
+		return []byte(s)
+	}
+	payload := [][]byte{lm, nt, str(s.auth.domain), str(s.auth.user), nil, nil}
+
+	// header, version and MIC, then payload
+	msg := make([]byte, 88)
+	copy(msg, ntlmSignature)
+	binary.LittleEndian.PutUint32(msg[8:], ntlmAuthenticate)
+	for i, b := range payload {
+		f := msg[12+8*i:]
+		binary.LittleEndian.PutUint16(f, uint16(len(b)))
+		binary.LittleEndian.PutUint16(f[2:], uint16(len(b)))
+		binary.LittleEndian.PutUint32(f[4:], uint32(len(msg)))
+		msg = append(msg, b...)
+	}
+	binary.LittleEndian.PutUint32(msg[60:], flags)
+
+	if hasTime {
+		mac := hmac.New(md5.New, key)
+		mac.Write(s.negotiate)
+		mac.Write(challenge)
+		mac.Write(msg)
+		copy(msg[72:], mac.Sum(nil))
+	}
+	return msg, nil
+}
+
+// ntlmField returns the field of msg, described at offset by its length,
+// max length and offset.
+func ntlmField(msg []byte, offset int) ([]byte, bool) {
+	if len(msg) < offset+8 {
+		return nil, false
+	}
+	n := int(binary.LittleEndian.Uint16(msg[offset:]))
+	start := int(binary.LittleEndian.Uint32(msg[offset+4:]))
+	if start+n > len(msg) {
+		return nil, false
+	}
+	return msg[start : start+n], true
+}
+
+// avPair returns the value of id in the AV_PAIR list.
+func avPair(info []byte, id uint16) ([]byte, bool) {
+	for len(info) >= 4 {
+		k := binary.LittleEndian.Uint16(info)
+		n := int(binary.LittleEndian.Uint16(info[2:]))
+		if k == avEOL || len(info) < 4+n {
+			break
+		}
+		if k == id {
+			return info[4 : 4+n], true
+		}
+		info = info[4+n:]
+	}
+	return nil, false
+}
+
+// setAvFlags returns a copy of info with flags added to its MsvAvFlags.
+func setAvFlags(info []byte, flags uint32) []byte {
+	var out []byte
+	for len(info) >= 4 {
+		k := binary.LittleEndian.Uint16(info)
+		n := int(binary.LittleEndian.Uint16(info[2:]))
+		if k == avEOL || len(info) < 4+n {
+			break
+		}
+		if k == avFlags && n == 4 {
+			flags |= binary.LittleEndian.Uint32(info[4:])
+		} else {
+			out = append(out, info[:4+n]...)
+		}
+		info = info[4+n:]
+	}
+	out = append(out, avFlags, 0, 4, 0, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(out[len(out)-4:], flags)
+	return append(out, avEOL, 0, 0, 0)
+}
+
+// ntowfv2 returns the NTLMv2 key of user in domain, from the NT hash.
+func ntowfv2(hash []byte, user, domain string) []byte {
+	mac := hmac.New(md5.New, hash)
+	mac.Write(utf16le(strings.ToUpper(user) + domain))
+	return mac.Sum(nil)
+}
+
+// ntlmv2Response returns the NT and LM challenge responses, and the session
+// base key.
+func ntlmv2Response(ntowf, serverChallenge, clientChallenge, timestamp, targetInfo []byte) (nt, lm, key []byte) {
+	temp := []byte{1, 1, 0, 0, 0, 0, 0, 0}
+	temp = append(temp, timestamp...)
+	temp = append(temp, clientChallenge...)
+	temp = append(temp, 0, 0, 0, 0)
+	temp = append(temp, targetInfo...)
+	temp = append(temp, 0, 0, 0, 0)
+
+	mac := hmac.New(md5.New, ntowf)
+	mac.Write(serverChallenge)
+	mac.Write(temp)
+	proof := mac.Sum(nil)
+	nt = append(proof, temp...)
+
+	mac.Reset()
+	mac.Write(serverChallenge)
+	mac.Write(clientChallenge)
+	lm = append(mac.Sum(nil), clientChallenge...)
+
+	mac = hmac.New(md5.New, ntowf)
+	mac.Write(proof)
+	key = mac.Sum(nil)
+	return nt, lm, key
+}
+
+func utf16le(s string) []byte {
+	u := utf16.Encode([]rune(s))
+	b := make([]byte, 2*len(u))
+	for i, v := range u {
+		binary.LittleEndian.PutUint16(b[2*i:], v)
+	}
+	return b
+}
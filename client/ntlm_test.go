@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"unicode/utf16"
+)
+
+func unhex(s string) []byte {
+	b, err := hex.DecodeString(strings.Replace(s, " ", "", -1))
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// The example of NTLMv2 authentication in [MS-NLMP] 4.2.4
+func TestNTLMv2Response(t *testing.T) {
+	a := NewNTLMAuthenticator("Domain", "User", "Password").(*ntlmAuthenticator)
+	ntowf := ntowfv2(a.hash, a.user, a.domain)
+	if want := unhex("0c868a403bfd7a93a3001ef22ef02e3f"); !bytes.Equal(ntowf, want) {
+		t.Fatalf("NTOWFv2: expect %x see %x", want, ntowf)
+	}
+
+	targetInfo := unhex("02000c0044006f006d00610069006e00 01000c005300650072007600650072000000 0000")
+	nt, lm, key := ntlmv2Response(ntowf, unhex("0123456789abcdef"), unhex("aaaaaaaaaaaaaaaa"), make([]byte, 8), targetInfo)
+	if want := unhex("68cd0ab851e51c96aabc927bebef6a1c"); !bytes.Equal(nt[:16], want) {
+		t.Fatalf("NTProofStr: expect %x see %x", want, nt[:16])
+	}
+	if want := unhex("86c35097ac9cec102554764a57cccc19aaaaaaaaaaaaaaaa"); !bytes.Equal(lm, want) {
+		t.Fatalf("LMv2: expect %x see %x", want, lm)
+	}
+	if want := unhex("8de40ccadbc14a82f15cb0ad0de95ca3"); !bytes.Equal(key, want) {
+		t.Fatalf("Session key: expect %x see %x", want, key)
+	}
+}
+
+func TestNTLMHash(t *testing.T) {
+	a, err := NewNTLMHashAuthenticator("Domain", "User", "a4f49c406510bdcab6824ee7c30fd852")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(a.(*ntlmAuthenticator).hash, NewNTLMAuthenticator("Domain", "User", "Password").(*ntlmAuthenticator).hash) {
+		t.Fatal("Wrong NT hash")
+	}
+	if _, err := NewNTLMHashAuthenticator("Domain", "User", "a4f4"); err == nil {
+		t.Fatal("expect error of short hash")
+	}
+}
+
+func decodeUTF16(b []byte) string {
+	u := make([]uint16, len(b)/2)
+	for i := range u {
+		u[i] = binary.LittleEndian.Uint16(b[2*i:])
+	}
+	return string(utf16.Decode(u))
+}
+
+// fakeNTLMProxy is a proxy requires NTLMv2 authentication of
+// DOMAIN\user with password, on each connection.
+type fakeNTLMProxy struct {
+	t        *testing.T
+	user     string
+	password string
+	target   string
+
+	negotiates int32
+}
+
+func (p *fakeNTLMProxy) challenge() []byte {
+	name := utf16le("DOMAIN")
+	info := append([]byte{2, 0, byte(len(name)), 0}, name...)
+	info = append(info, avTimestamp, 0, 8, 0, 1, 2, 3, 4, 5, 6, 7, 8)
+	info = append(info, 0, 0, 0, 0)
+
+	msg := make([]byte, 56)
+	copy(msg, ntlmSignature)
+	binary.LittleEndian.PutUint32(msg[8:], ntlmChallenge)
+	binary.LittleEndian.PutUint16(msg[12:], uint16(len(name)))
+	binary.LittleEndian.PutUint16(msg[14:], uint16(len(name)))
+	binary.LittleEndian.PutUint32(msg[16:], 56)
+	binary.LittleEndian.PutUint32(msg[20:], ntlmFlags)
+	copy(msg[24:], "SrvChlng")
+	binary.LittleEndian.PutUint16(msg[40:], uint16(len(info)))
+	binary.LittleEndian.PutUint16(msg[42:], uint16(len(info)))
+	binary.LittleEndian.PutUint32(msg[44:], uint32(56+len(name)))
+	msg = append(msg, name...)
+	return append(msg, info...)
+}
+
+// verify checks the AUTHENTICATE message, and its MIC.
+func (p *fakeNTLMProxy) verify(negotiate, challenge, msg []byte) bool {
+	nt, ok1 := ntlmField(msg, 20)
+	domain, ok2 := ntlmField(msg, 28)
+	user, ok3 := ntlmField(msg, 36)
+	if !ok1 || !ok2 || !ok3 || len(nt) < 16 || decodeUTF16(domain)+`\`+decodeUTF16(user) != p.user {
+		return false
+	}
+	a := NewNTLMAuthenticator("", "", p.password).(*ntlmAuthenticator)
+	ntowf := ntowfv2(a.hash, decodeUTF16(user), decodeUTF16(domain))
+	mac := hmac.New(md5.New, ntowf)
+	mac.Write(challenge[24:32])
+	mac.Write(nt[16:])
+	proof := mac.Sum(nil)
+	if !hmac.Equal(proof, nt[:16]) {
+		return false
+	}
+	if v, ok := avPair(nt[44:], avFlags); !ok || binary.LittleEndian.Uint32(v)&avFlagMIC == 0 {
+		p.t.Error("MIC is not flagged")
+		return false
+	}
+
+	mac = hmac.New(md5.New, ntowf)
+	mac.Write(proof)
+	mac = hmac.New(md5.New, mac.Sum(nil))
+	mic := append([]byte{}, msg[72:88]...)
+	zeroed := append([]byte{}, msg...)
+	copy(zeroed[72:88], make([]byte, 16))
+	mac.Write(negotiate)
+	mac.Write(challenge)
+	mac.Write(zeroed)
+	return hmac.Equal(mic, mac.Sum(nil))
+}
+
+func (p *fakeNTLMProxy) serve(c net.Conn) {
+	defer c.Close()
+	br := bufio.NewReader(c)
+	var negotiate, challenge []byte
+	authed := false
+	for {
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return
+		}
+		io.Copy(ioutil.Discard, req.Body)
+		var msg []byte
+		if auth := req.Header.Get("Proxy-Authorization"); strings.HasPrefix(auth, "NTLM ") {
+			msg, _ = encoder.DecodeString(auth[5:])
+		}
+		switch {
+		case len(msg) > 12 && msg[8] == ntlmNegotiate:
+			atomic.AddInt32(&p.negotiates, 1)
+			negotiate, challenge = msg, p.challenge()
+			io.WriteString(c, "HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: NTLM "+
+				encoder.EncodeToString(challenge)+"\r\nContent-Length: 0\r\n\r\n")
+			continue
+		case len(msg) > 88 && msg[8] == ntlmAuthenticate && p.verify(negotiate, challenge, msg):
+			authed = true
+		case authed && msg == nil:
+		default:
+			io.WriteString(c, "HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: NTLM\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+			return
+		}
+
+		if req.Method == "CONNECT" {
+			d, err := net.Dial("tcp", p.target)
+			if err != nil {
+				return
+			}
+			io.WriteString(c, "HTTP/1.1 200 Connection established\r\n\r\n")
+			go func() {
+				io.Copy(d, br)
+				d.Close()
+			}()
+			io.Copy(c, d)
+			return
+		}
+		body := "hello " + req.URL.Path
+		io.WriteString(c, "HTTP/1.1 200 OK\r\nContent-Length: "+strconv.Itoa(len(body))+"\r\n\r\n"+body)
+	}
+}
+
+// listen serves each connection to a new listener by fn.
+func listen(t *testing.T, fn func(c net.Conn)) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go fn(c)
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestNTLMProxy(t *testing.T) {
+	echo := listen(t, func(c net.Conn) {
+		io.Copy(c, c)
+		c.Close()
+	})
+	fake := &fakeNTLMProxy{t: t, user: `DOMAIN\alice`, password: "secret", target: echo}
+	proxyURL := "http://" + listen(t, fake.serve)
+
+	for _, v := range []struct {
+		user, password string
+		ok             bool
+	}{
+		{`DOMAIN\alice`, "secret", true},
+		{"alice@DOMAIN", "secret", true},
+		{`DOMAIN\alice`, "wrong", false},
+	} {
+		auth, _ := NewProxyAuth(v.user, v.password, "")
+		p, err := NewNTLMProxy(proxyURL, auth)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// CONNECT
+		c, err := p.dial("example.com:443")
+		if (err == nil) != v.ok {
+			t.Fatalf("%v: dial %v", v, err)
+		}
+		if err == nil {
+			io.WriteString(c, "ping")
+			b := make([]byte, 4)
+			if _, err := io.ReadFull(c, b); err != nil || string(b) != "ping" {
+				t.Fatalf("%v: %q %v", v, b, err)
+			}
+			c.Close()
+		}
+
+		// plain http
+		ts := httptest.NewServer(p)
+		pURL, _ := url.Parse(ts.URL)
+		client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(pURL)}}
+		resp, err := client.Get("http://example.com/a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		ts.Close()
+		if ok := resp.StatusCode == 200 && string(b) == "hello /a"; ok != v.ok {
+			t.Fatalf("%v: %d %q", v, resp.StatusCode, b)
+		}
+	}
+}
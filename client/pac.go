@@ -0,0 +1,280 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dop251/goja"
+)
+
+// pacCacheTTL is how long the proxies found for a host are kept.
+var pacCacheTTL = 5 * time.Minute
+
+// pacTimeout is the max time to run FindProxyForURL.
+var pacTimeout = time.Second
+
+// maxPACCache is the max number of hosts cached.
+const maxPACCache = 4096
+
+// pacHelpers are the functions of the PAC standard, besides the ones in Go.
+const pacHelpers = `
+function isPlainHostName(host) {
+	return host.indexOf('.') < 0;
+}
+function dnsDomainIs(host, domain) {
+	return host.length >= domain.length && host.substring(host.length - domain.length) == domain;
+}
+function localHostOrDomainIs(host, hostdom) {
+	return host == hostdom || hostdom.lastIndexOf(host + '.', 0) == 0;
+}
+function isResolvable(host) {
+	return dnsResolve(host) !== null;
+}
+function dnsDomainLevels(host) {
+	return host.split('.').length - 1;
+}
+function shExpMatch(str, shexp) {
+	var re = shexp.replace(/[.+^${}()|[\]\\]/g, '\\$&').replace(/\*/g, '.*').replace(/\?/g, '.');
+	return new RegExp('^' + re + '$').test(str);
+}
+function pacArgs(args) {
+	args = Array.prototype.slice.call(args);
+	var gmt = args[args.length - 1] == 'GMT';
+	if (gmt) args.pop();
+	return {args: args, gmt: gmt, now: new Date()};
+}
+function pacRange(lo, hi, v) {
+	return lo <= hi ? lo <= v && v <= hi : v >= lo || v <= hi;
+}
+var pacDays = {SUN: 0, MON: 1, TUE: 2, WED: 3, THU: 4, FRI: 5, SAT: 6};
+var pacMonths = {JAN: 0, FEB: 1, MAR: 2, APR: 3, MAY: 4, JUN: 5, JUL: 6, AUG: 7, SEP: 8, OCT: 9, NOV: 10, DEC: 11};
+function weekdayRange() {
+	var a = pacArgs(arguments);
+	var day = a.gmt ? a.now.getUTCDay() : a.now.getDay();
+	var lo = pacDays[a.args[0]], hi = a.args.length > 1 ? pacDays[a.args[1]] : lo;
+	return lo !== undefined && hi !== undefined && pacRange(lo, hi, day);
+}
+function dateRange() {
+	var a = pacArgs(arguments);
+	var now = {
+		d: a.gmt ? a.now.getUTCDate() : a.now.getDate(),
+		m: a.gmt ? a.now.getUTCMonth() : a.now.getMonth(),
+		y: a.gmt ? a.now.getUTCFullYear() : a.now.getFullYear()
+	};
+	// each argument is a day, a month name, or a year
+	function parse(list) {
+		var v = {};
+		for (var i = 0; i < list.length; i++) {
+			if (typeof list[i] == 'string') v.m = pacMonths[list[i]];
+			else if (list[i] > 31) v.y = list[i];
+			else v.d = list[i];
+		}
+		return v;
+	}
+	var n = a.args.length;
+	if (n == 0 || n > 1 && n % 2 == 1) return false;
+	var lo = parse(a.args.slice(0, n == 1 ? 1 : n / 2)), hi = n == 1 ? lo : parse(a.args.slice(n / 2));
+	function key(v) {
+		return ('y' in lo ? v.y * 10000 : 0) + ('m' in lo ? v.m * 100 : 0) + ('d' in lo ? v.d : 0);
+	}
+	return pacRange(key(lo), key(hi), key(now));
+}
+function timeRange() {
+	var a = pacArgs(arguments), t = a.args;
+	var h = a.gmt ? a.now.getUTCHours() : a.now.getHours();
+	var m = a.gmt ? a.now.getUTCMinutes() : a.now.getMinutes();
+	var s = a.gmt ? a.now.getUTCSeconds() : a.now.getSeconds();
+	var now = h * 3600 + m * 60 + s;
+	switch (t.length) {
+	case 1:
+		return h == t[0];
+	case 2:
+		return pacRange(t[0] * 3600, t[1] * 3600 - 1, now);
+	case 4:
+		return pacRange(t[0] * 3600 + t[1] * 60, t[2] * 3600 + t[3] * 60, now);
+	case 6:
+		return pacRange(t[0] * 3600 + t[1] * 60 + t[2], t[3] * 3600 + t[4] * 60 + t[5], now);
+	}
+	return false;
+}
+`
+
+// PAC chooses the proxies of the requests by FindProxyForURL of a proxy
+// auto-config script. The results are cached for each host.
+type PAC struct {
+	lock sync.Mutex
+	vm   *goja.Runtime
+	find goja.Callable
+
+	cacheLock sync.Mutex
+	cache     map[string]pacEntry
+}
+
+type pacEntry struct {
+	proxies []*url.URL
+	expires time.Time
+}
+
+// LoadPAC reads the PAC script from a file, or a http(s) URL.
+func LoadPAC(location string) (*PAC, error) {
+	var b []byte
+	var err error
+	if strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://") {
+		// The script is usually on the local network, not via the proxy
+		client := &http.Client{Transport: &http.Transport{}, Timeout: 30 * time.Second}
+		var resp *http.Response
+		if resp, err = client.Get(location); err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, errors.New("Cannot get PAC: " + resp.Status)
+		}
+		b, err = ioutil.ReadAll(resp.Body)
+	} else {
+		b, err = ioutil.ReadFile(strings.TrimPrefix(location, "file://"))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return NewPAC(string(b))
+}
+
+// NewPAC compiles the PAC script.
+func NewPAC(script string) (*PAC, error) {
+	vm := goja.New()
+	vm.Set("dnsResolve", func(host string) interface{} {
+		if ip := resolveIP(host); ip != nil {
+			return ip.String()
+		}
+		return nil
+	})
+	vm.Set("myIpAddress", myIPAddress)
+	vm.Set("isInNet", isInNet)
+	vm.Set("alert", func(msg string) {
+		log.Print("PAC: " + msg)
+	})
+	if _, err := vm.RunString(pacHelpers); err != nil {
+		return nil, err
+	}
+	if _, err := vm.RunString(script); err != nil {
+		return nil, errors.New("Invalid PAC: " + err.Error())
+	}
+	find, ok := goja.AssertFunction(vm.Get("FindProxyForURL"))
+	if !ok {
+		return nil, errors.New("Invalid PAC: FindProxyForURL is not defined")
+	}
+	return &PAC{vm: vm, find: find, cache: map[string]pacEntry{}}, nil
+}
+
+// FindProxy returns the proxies for u in the order to try, nil is DIRECT.
+func (p *PAC) FindProxy(u *url.URL) ([]*url.URL, error) {
+	host := u.Hostname()
+	p.cacheLock.Lock()
+	e, ok := p.cache[host]
+	p.cacheLock.Unlock()
+	if ok && time.Now().Before(e.expires) {
+		return e.proxies, nil
+	}
+
+	// Only the host is given for https, as the browsers do
+	s := u.String()
+	if u.Scheme == "https" {
+		s = "https://" + u.Host + "/"
+	}
+	p.lock.Lock()
+	timer := time.AfterFunc(pacTimeout, func() {
+		p.vm.Interrupt("timeout")
+	})
+	v, err := p.find(goja.Undefined(), p.vm.ToValue(s), p.vm.ToValue(host))
+	timer.Stop()
+	p.vm.ClearInterrupt()
+	p.lock.Unlock()
+	if err != nil {
+		return nil, errors.New("FindProxyForURL: " + err.Error())
+	}
+	proxies, err := parsePACResult(v.String())
+	if err != nil {
+		return nil, err
+	}
+
+	p.cacheLock.Lock()
+	if len(p.cache) >= maxPACCache {
+		p.cache = map[string]pacEntry{}
+	}
+	p.cache[host] = pacEntry{proxies: proxies, expires: time.Now().Add(pacCacheTTL)}
+	p.cacheLock.Unlock()
+	return proxies, nil
+}
+
+// parsePACResult parses the result of FindProxyForURL, such as
+// "PROXY a:8080; DIRECT". The kinds of proxy not supported are skipped.
+func parsePACResult(s string) ([]*url.URL, error) {
+	var proxies []*url.URL
+	for _, v := range strings.Split(s, ";") {
+		f := strings.Fields(v)
+		if len(f) == 0 {
+			continue
+		}
+		switch strings.ToUpper(f[0]) {
+		case "DIRECT":
+			proxies = append(proxies, nil)
+		case "PROXY", "HTTP":
+			if len(f) > 1 {
+				proxies = append(proxies, &url.URL{Scheme: "http", Host: f[1]})
+			}
+		}
+	}
+	if len(proxies) == 0 && strings.TrimSpace(s) != "" {
+		return nil, errors.New("No supported proxy in: " + s)
+	}
+	if len(proxies) == 0 {
+		proxies = append(proxies, nil)
+	}
+	return proxies, nil
+}
+
+// resolveIP returns the IP of host, preferring IPv4, or nil.
+func resolveIP(host string) net.IP {
+	if ip := net.ParseIP(host); ip != nil {
+		return ip
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil || len(ips) == 0 {
+		return nil
+	}
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			return ip
+		}
+	}
+	return ips[0]
+}
+
+// myIPAddress returns the address of the interface to the internet.
+func myIPAddress() string {
+	// UDP does not send anything to connect
+	c, err := net.Dial("udp", "8.8.8.8:53")
+	if err != nil {
+		return "127.0.0.1"
+	}
+	defer c.Close()
+	return c.LocalAddr().(*net.UDPAddr).IP.String()
+}
+
+// isInNet reports whether host is in the network of pattern and mask, e.g.
+// "10.0.0.0" and "255.0.0.0".
+func isInNet(host, pattern, mask string) bool {
+	ip, p, m := resolveIP(host).To4(), net.ParseIP(pattern).To4(), net.ParseIP(mask).To4()
+	if ip == nil || p == nil || m == nil {
+		return false
+	}
+	return ip.Mask(net.IPMask(m)).Equal(p.Mask(net.IPMask(m)))
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+const testPAC = `
+var calls = 0;
+function FindProxyForURL(url, host) {
+	calls++;
+	if (isPlainHostName(host) || isInNet(host, "10.0.0.0", "255.0.0.0"))
+		return "DIRECT";
+	if (dnsDomainIs(host, ".corp.example.com"))
+		return "PROXY corp:8080; DIRECT";
+	if (shExpMatch(url, "http://*.test/*") && weekdayRange("SUN", "SAT") && timeRange(0, 24) && dateRange(1, 31))
+		return "SOCKS s:1080; PROXY test:3128";
+	if (host == "socks.example")
+		return "SOCKS s:1080";
+	return "PROXY " + PROXY;
+}
+`
+
+func TestPAC(t *testing.T) {
+	pac, err := NewPAC("var PROXY = 'default:8080';" + testPAC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []struct {
+		url, want string
+	}{
+		{"http://intranet/", "[<nil>]"},
+		{"http://10.1.2.3/", "[<nil>]"},
+		{"https://www.corp.example.com/a", "[http://corp:8080 <nil>]"},
+		{"http://a.test/b", "[http://test:3128]"},
+		{"http://example.com/", "[http://default:8080]"},
+		{"http://example.com/other", "[http://default:8080]"},
+	} {
+		u, _ := url.Parse(v.url)
+		proxies, err := pac.FindProxy(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var s []string
+		for _, p := range proxies {
+			if p == nil {
+				s = append(s, "<nil>")
+			} else {
+				s = append(s, p.String())
+			}
+		}
+		if got := "[" + strings.Join(s, " ") + "]"; got != v.want {
+			t.Fatalf("%s: expect %s see %s", v.url, v.want, got)
+		}
+	}
+	// cached by host
+	if calls := pac.vm.Get("calls").ToInteger(); calls != 5 {
+		t.Fatalf("FindProxyForURL is called %d times", calls)
+	}
+
+	if _, err := pac.FindProxy(&url.URL{Scheme: "http", Host: "socks.example"}); err == nil {
+		t.Fatal("expect error of SOCKS only")
+	}
+	if _, err := NewPAC("function f() {}"); err == nil {
+		t.Fatal("expect error without FindProxyForURL")
+	}
+	loop, _ := NewPAC("function FindProxyForURL(url, host) { for (;;) {} }")
+	if _, err := loop.FindProxy(&url.URL{Scheme: "http", Host: "a"}); err == nil {
+		t.Fatal("expect timeout")
+	}
+}
+
+func TestPACProxy(t *testing.T) {
+	// the proxy serves example.com, the others are DIRECT
+	fake := &fakeNTLMProxy{t: t, user: `DOMAIN\alice`, password: "secret"}
+	proxyAddr := listen(t, fake.serve)
+	direct := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("direct " + r.URL.Path))
+	}))
+	defer direct.Close()
+
+	pac, err := NewPAC(`function FindProxyForURL(url, host) {
+		return host == "example.com" ? "PROXY ` + proxyAddr + `" : "DIRECT";
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth, _ := NewProxyAuth(`DOMAIN\alice`, "secret", "")
+	p, err := NewNTLMProxy("", auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.PAC = pac
+	ts := httptest.NewServer(p)
+	defer ts.Close()
+	pURL, _ := url.Parse(ts.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(pURL)}}
+
+	for _, v := range []struct{ url, want string }{
+		{"http://example.com/a", "hello /a"},
+		{direct.URL + "/b", "direct /b"},
+	} {
+		resp, err := client.Get(v.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(b) != v.want {
+			t.Fatalf("%s: %d %q", v.url, resp.StatusCode, b)
+		}
+	}
+
+	// CONNECT DIRECT
+	c, err := p.dial(direct.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.(*net.TCPConn); !ok {
+		t.Fatalf("dial %T via proxy", c)
+	}
+	c.Close()
+}
+
+func TestPACFailover(t *testing.T) {
+	// the first proxy is down, the requests go to the next one
+	fake := &fakeNTLMProxy{t: t, user: `DOMAIN\alice`, password: "secret"}
+	proxyAddr := listen(t, fake.serve)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := l.Addr().String()
+	l.Close()
+
+	pac, err := NewPAC(`function FindProxyForURL(url, host) {
+		return "PROXY ` + down + `; PROXY ` + proxyAddr + `";
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth, _ := NewProxyAuth(`DOMAIN\alice`, "secret", "")
+	p, err := NewNTLMProxy("", auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.PAC = pac
+	ts := httptest.NewServer(p)
+	defer ts.Close()
+	pURL, _ := url.Parse(ts.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(pURL)}}
+
+	resp, err := client.Get("http://example.com/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(b) != "hello /a" {
+		t.Fatalf("%d %q", resp.StatusCode, b)
+	}
+}
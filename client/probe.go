@@ -0,0 +1,100 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// Probe checks whether host can be reached through the proxy, as the requests
+// to a new host are checked. A host with a port other than 80 is checked by a
+// ClientHello of TLS, the others by a GET of http. It returns an error if the
+// proxy is down, so the route is unknown.
+func (p *NTLMProxy) Probe(host string) (direct bool, err error) {
+	if _, port, err := net.SplitHostPort(host); err == nil && port != "80" {
+		return p.probeConnect(host)
+	}
+	return p.probeHTTP(host)
+}
+
+// probeConnect sends a ClientHello to addr through the proxy, and checks the
+// reply by ValidConnect.
+func (p *NTLMProxy) probeConnect(addr string) (bool, error) {
+	remote, pURL, err := p.dialVia(addr)
+	if err != nil {
+		return false, err
+	}
+	defer remote.Close()
+
+	name, _, _ := net.SplitHostPort(addr)
+	first, err := clientHello(name)
+	if err != nil {
+		return false, err
+	}
+	reply, err := exchange(remote, first)
+	if err == nil && p.ValidConnect != nil {
+		err = p.ValidConnect(&http.Request{Method: "CONNECT", Host: addr, URL: &url.URL{Host: addr}}, first, reply)
+	}
+	if err == nil {
+		return true, nil
+	}
+	if pURL != nil && !p.health.check(pURL.Host) {
+		return false, err
+	}
+	return false, nil
+}
+
+// probeHTTP gets the root of host through the proxy, and checks the response
+// by ValidHTTP.
+func (p *NTLMProxy) probeHTTP(host string) (bool, error) {
+	r, err := http.NewRequest("GET", "http://"+host+"/", nil)
+	if err != nil {
+		return false, err
+	}
+	r.Header = p.makeHeader()
+	proxies, err := p.candidates(r.URL)
+	if err != nil {
+		return false, err
+	}
+	var resp *http.Response
+	var c *proxyConn
+	pURL := proxies[0]
+	if pURL == nil {
+		resp, err = p.transport.RoundTrip(r)
+	} else {
+		resp, c, err = p.roundTrip(r, pURL.Host)
+	}
+	if err != nil {
+		return false, err
+	}
+	if p.ValidHTTP != nil {
+		err = p.ValidHTTP(r, resp)
+	}
+	resp.Body.Close()
+	if c != nil {
+		c.Close()
+	}
+	if err == nil {
+		return true, nil
+	}
+	if pURL != nil && !p.health.check(pURL.Host) {
+		return false, err
+	}
+	return false, nil
+}
+
+// clientHello returns a ClientHello of TLS to the server name.
+func clientHello(name string) ([]byte, error) {
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+	// The handshake stops when the pipe is closed
+	go tls.Client(c, &tls.Config{ServerName: name, InsecureSkipVerify: true}).Handshake()
+	first, err := readRecords(s, replyTimeout)
+	if err == nil && (len(first) == 0 || first[0] != recordHandshake) {
+		err = errors.New("Invalid ClientHello")
+	}
+	return first, err
+}
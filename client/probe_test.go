@@ -0,0 +1,59 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestProbe(t *testing.T) {
+	p, err := NewNTLMProxy("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules, _ := LoadRules("")
+	p.ValidConnect = rules.ValidConnect
+	p.ValidHTTP = rules.ValidHTTP
+
+	page := listen(t, func(c net.Conn) {
+		c.Read(make([]byte, 4096))
+		io.WriteString(c, "HTTP/1.1 403 Forbidden\r\nContent-Length: 0\r\n\r\n")
+		c.Close()
+	})
+	for _, v := range []struct {
+		host   string
+		direct bool
+	}{
+		{tlsServer(t, "Test CA", 0), true},
+		{page, false},
+	} {
+		if direct, err := p.Probe(v.host); err != nil || direct != v.direct {
+			t.Fatalf("%s: %v %v", v.host, direct, err)
+		}
+	}
+	if _, err := p.Probe(strings.TrimSuffix(page, page[strings.LastIndex(page, ":"):]) + ":1"); err == nil {
+		t.Fatal("unreachable host is probed")
+	}
+
+	status := http.StatusOK
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer ts.Close()
+	host := strings.TrimPrefix(ts.URL, "http://")
+	for _, v := range []struct {
+		status int
+		direct bool
+	}{
+		{http.StatusOK, true},
+		{http.StatusServiceUnavailable, false},
+	} {
+		status = v.status
+		if direct, err := p.probeHTTP(host); err != nil || direct != v.direct {
+			t.Fatalf("%d: %v %v", v.status, direct, err)
+		}
+	}
+}
@@ -1,23 +1,19 @@
 package main
 
 import (
-	"bufio"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"strings"
-	"sync"
 
-	"github.com/alexbrainman/sspi"
-	"github.com/alexbrainman/sspi/ntlm"
 	"github.com/gorilla/websocket"
+	"github.com/ramuchu/fetch"
 )
 
 var encoder = base64.StdEncoding
@@ -27,61 +23,71 @@ var encoder = base64.StdEncoding
 // It implements http.Handler, and if it found the response or connection is
 // not valid, it will call Fallback handler.
 type NTLMProxy struct {
-	cred      *sspi.Credentials
+	auth      *ProxyAuth
 	transport *http.Transport
-	proxyURL  *url.URL
+	proxies   []*url.URL
+	conns     proxyConns
+	health    *proxyHealth
 
 	Agent string
 
-	ValidHTTP    func(req *http.Request, resp *http.Response) error
-	ValidConnect func(req *http.Request, c net.Conn) error
-	Fallback     http.Handler
-}
-
-type bytePool sync.Pool
+	// PAC chooses the proxies of each request, rather than the ones given
+	// to NewNTLMProxy, if it is set.
+	PAC *PAC
 
-// for buffer reuse
-var ntlmPool = bytePool(sync.Pool{
-	New: func() interface{} {
-		return make([]byte, ntlm.PackageInfo.MaxToken)
-	},
-})
-
-func (p *bytePool) Get() []byte {
-	return (*sync.Pool)(p).Get().([]byte)
-}
+	ValidHTTP func(req *http.Request, resp *http.Response) error
+	// ValidConnect checks the reply of the host to the first message of the
+	// client, e.g. the ServerHello to the ClientHello of TLS. The tunnel is
+	// not consumed by checking, the reply is passed on if it is valid.
+	ValidConnect func(req *http.Request, first, reply []byte) error
+	Fallback     http.Handler
 
-func (p *bytePool) Put(b []byte) {
-	(*sync.Pool)(p).Put(b)
+	// Blocked is called if the response or connection of req is not valid,
+	// while the proxy is up.
+	Blocked func(req *http.Request)
+
+	// FallbackDial dials addr by the other route, e.g. the remote server,
+	// for the CONNECT not valid. The client is told the tunnel is established
+	// before it is checked, so it cannot be served by Fallback.
+	FallbackDial func(addr string) (net.Conn, error)
+	// Race validates the proxy and FallbackDial at the same time for
+	// CONNECT, and takes the one valid first, rather than falling back after
+	// the proxy fails.
+	Race bool
+	// Chosen is called when the route of a CONNECT is validated, direct is
+	// set if it is the proxy.
+	Chosen func(req *http.Request, direct bool)
+
+	// MaxReplay is the size of a request body kept to be sent again by
+	// Fallback. The requests with larger body do not fall back.
+	MaxReplay int64
 }
 
-// NewNTLMProxy return a NTLMProxy connects to the proxy at proxyURL.
-func NewNTLMProxy(proxyURL string) (*NTLMProxy, error) {
-	var pURL *url.URL
-	if proxyURL != "" {
-		var err error
-		pURL, err = url.Parse(proxyURL)
+// NewNTLMProxy return a NTLMProxy connects to the proxy at proxyURL,
+// authenticated by auth. proxyURL can be a comma separated list, the proxies
+// are tried in the order while the others are unreachable. The user info in
+// proxyURL is ignored.
+func NewNTLMProxy(proxyURL string, auth *ProxyAuth) (*NTLMProxy, error) {
+	var proxies []*url.URL
+	for _, v := range strings.Split(proxyURL, ",") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		pURL, err := url.Parse(v)
 		if err != nil {
 			return nil, err
 		}
+		pURL.User = nil
+		proxies = append(proxies, pURL)
 	}
 
-	cred, err := ntlm.AcquireCurrentUserCredentials()
-	if err != nil {
-		return nil, err
-	}
 	p := &NTLMProxy{
-		cred: cred,
+		auth: auth,
 		transport: &http.Transport{
-			Proxy: func(r *http.Request) (*url.URL, error) {
-				if r.URL.Scheme == "https" {
-					return nil, nil
-				}
-				return pURL, nil
-			},
 			Dial: net.Dial,
 		},
-		proxyURL: pURL,
+		proxies: proxies,
+		health:  newProxyHealth(),
 	}
 	return p, nil
 }
@@ -98,21 +104,32 @@ func (p *NTLMProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 // dial create a connection to r via proxy. The returned Conn will be ready for tls handshake.
 func (p *NTLMProxy) dial(addr string) (net.Conn, error) {
-	if p.proxyURL == nil {
-		// No proxy, just normal Dial...
-		return p.transport.Dial("tcp", addr)
-	}
+	c, _, err := p.dialVia(addr)
+	return c, err
+}
 
-	// Follows the messages in https://msdn.microsoft.com/en-us/library/cc669093.aspx
-	// But we starts with NEGOTIATE message directly. Message (3) in the link.
-	context, b, err := ntlm.NewClientContext(p.cred)
+// dialVia is dial, and returns the proxy connected, nil if it is DIRECT.
+// It fails over to the next proxy if one is unreachable.
+func (p *NTLMProxy) dialVia(addr string) (net.Conn, *url.URL, error) {
+	proxies, err := p.candidates(&url.URL{Scheme: "https", Host: addr})
 	if err != nil {
-		return nil, errors.New("Cannot create client context: " + err.Error())
+		return nil, nil, err
 	}
+	for _, pURL := range proxies {
+		var c net.Conn
+		if c, err = p.dialProxyTo(pURL, addr); !isProxyError(err) {
+			return c, pURL, err
+		}
+		log.Print(err.Error())
+	}
+	return nil, nil, err
+}
 
-	remote, err := p.transport.Dial("tcp", p.proxyURL.Host)
-	if err != nil {
-		return nil, errors.New("Failed to dial: " + err.Error())
+// dialProxyTo creates a connection to addr via the proxy at pURL.
+func (p *NTLMProxy) dialProxyTo(pURL *url.URL, addr string) (net.Conn, error) {
+	if pURL == nil {
+		// No proxy, just normal Dial...
+		return p.transport.Dial("tcp", addr)
 	}
 
 	pr := &http.Request{
@@ -122,286 +139,249 @@ func (p *NTLMProxy) dial(addr string) (net.Conn, error) {
 		Header: p.makeHeader(),
 	}
 
-	cb := ntlmPool.Get()
-	defer func() {
-		ntlmPool.Put(cb)
-	}()
-
-	// 1st request: Client -> Proxy handshake
-	n := encoder.EncodedLen(len(b))
-	if cap(cb) < n {
-		cb = make([]byte, n)
-	}
-	encoder.Encode(cb, b)
-	pr.Header.Set("Proxy-Authorization", fmt.Sprintf("NTLM %s", cb[:n]))
-	pr.WriteProxy(remote)
-
-	// Read response.
-	// Okay to use and discard buffered reader here, because
-	// TLS server will not speak until spoken to.
-	br := bufio.NewReader(remote)
-	resp, err := http.ReadResponse(br, pr)
+	// On an authenticated connection, the handshake is skipped. Otherwise it
+	// starts with the scheme chosen last time, e.g. NTLM NEGOTIATE message
+	// directly, see https://msdn.microsoft.com/en-us/library/cc669093.aspx
+	resp, c, err := p.roundTrip(pr, pURL.Host)
 	if err != nil {
-		remote.Close()
-		return nil, errors.New("server failed response: " + err.Error())
-	}
-	//dumpResp(resp, true)
-
-	// 1st reply: Proxy -> Client challenge
-	// If the proxy didn't request for challenge, just tunnel the connection if ok
-	if resp.StatusCode != http.StatusProxyAuthRequired {
-		if resp.StatusCode != http.StatusOK {
-			// we do not know how to handle it, just let user do it
-			remote.Close()
-			return nil, errors.New("Unknown challenge: " + resp.Status)
-		}
-
-		return remote, nil
-	}
-
-	// comsume the body, so we can reuse the connection
-	io.Copy(ioutil.Discard, resp.Body)
-	resp.Body.Close()
-
-	// Get the challenge from header
-	auth := resp.Header.Get("Proxy-Authenticate")
-	f := strings.SplitN(auth, " ", 2)
-	if len(f) < 2 {
-		remote.Close()
-		return nil, errors.New("Unknown Proxy-Authenticate: " + auth)
-	}
-	encodedChg := f[1]
-	challenge := ntlmPool.Get()
-	defer func() {
-		ntlmPool.Put(challenge)
-	}()
-	n = encoder.EncodedLen(len(encodedChg))
-	if cap(challenge) < n {
-		challenge = make([]byte, n)
-	}
-
-	_, err = encoder.Decode(challenge, []byte(encodedChg))
-	if err != nil {
-		remote.Close()
-		return nil, errors.New("Cannot decode challenge: " + auth)
-	}
-
-	b, err = context.Update(challenge[:n])
-	if err != nil {
-		remote.Close()
-		return nil, errors.New("Failed to response challenge: " + err.Error())
+		return nil, err
 	}
 
-	// 2nd request: Client -> Proxy response
 	// After the proxy reply, the connection is ready to use
-	n = encoder.EncodedLen(len(b))
-	if cap(cb) < n {
-		cb = make([]byte, n)
-	}
-	encoder.Encode(cb, b)
-	pr.Header.Set("Proxy-Connection", "Keep-Alive")
-	pr.Header.Set("Proxy-Authorization", fmt.Sprintf("NTLM %s", cb[:n]))
-
-	pr.WriteProxy(remote)
-	resp, err = http.ReadResponse(br, pr)
-	if err != nil {
-		remote.Close()
-		return nil, errors.New("Failed reply challenge: " + err.Error())
-	}
-
-	// something goes wrong... let the user handle it
 	if resp.StatusCode != http.StatusOK {
-		remote.Close()
-		return nil, errors.New("Unknown error: " + resp.Status)
+		// we do not know how to handle it, just let user do it
+		c.Close()
+		return nil, errors.New("Unknown challenge: " + resp.Status)
 	}
-
-	// reply to client
-	return remote, nil
+	// Okay to keep the buffered reader here, because
+	// TLS server will not speak until spoken to.
+	return &bufConn{Conn: c.Conn, r: c.br}, nil
 }
 
 // handleConnect handles https request.
 func (p *NTLMProxy) handleConnect(w http.ResponseWriter, r *http.Request) {
+	if p.Race && p.FallbackDial != nil && p.ValidConnect != nil {
+		p.raceConnect(w, r)
+		return
+	}
+
 	// Get a connection via proxy
-	remote, err := p.dial(r.URL.Host)
+	remote, pURL, err := p.dialVia(r.URL.Host)
+	if err != nil {
+		http.Error(w, "Failed to establish tunnel connection: "+err.Error(), proxyErrorCode(err))
+		return
+	}
+	conn, err := hijack(w)
 	if err != nil {
-		http.Error(w, "Failed to establish tunnel connection: "+err.Error(), http.StatusInternalServerError)
+		remote.Close()
 		return
 	}
+	// tell the client its ready
+	conn.Write([]byte("HTTP/1.1 200 OK\r\n\r\n"))
 
-	// Check if the connection is valid
+	// Check if the connection is valid by the reply to the first message of
+	// the client, which is passed on if it is valid.
 	if p.ValidConnect != nil {
-		err := p.ValidConnect(r, remote)
-		// The connection is used by checking, we have to close it
+		first, err := readFirst(conn)
 		if err != nil {
+			conn.Close()
 			remote.Close()
-			log.Print("Failed to establish connection to " + r.Host + ": " + err.Error())
-			if p.Fallback == nil {
-				http.Error(w, "Failed to establish connection: "+err.Error(), http.StatusInternalServerError)
-			} else {
-				p.Fallback.ServeHTTP(w, r)
-			}
 			return
 		}
-		// The request is able to go through proxy, just establish again
-		remote, err = p.dial(r.URL.Host)
+		if len(first) == 0 {
+			// the host speaks first, it is not checked again next time
+			if p.Chosen != nil {
+				p.Chosen(r, true)
+			}
+		} else {
+			reply, err := exchange(remote, first)
+			if err == nil {
+				err = p.ValidConnect(r, first, reply)
+			}
+			switch {
+			case err == nil:
+				if p.Chosen != nil {
+					p.Chosen(r, true)
+				}
+				conn.Write(reply)
+			case isTimeout(err):
+				// a slow host is not blocked, the rest of the reply
+				// follows in the tunnel
+				conn.Write(reply)
+			default:
+				remote.Close()
+				log.Print("Failed to establish connection to " + r.Host + ": " + err.Error())
+				if remote = p.fallbackConn(r, pURL, first); remote == nil {
+					conn.Close()
+					return
+				}
+			}
+		}
+	}
+
+	// start tunnel
+	go copyAndClose(remote, conn)
+	go copyAndClose(conn, remote)
+}
+
+// fallbackConn returns the connection by FallbackDial for the CONNECT not
+// valid by the proxy at pURL, with first sent. It returns nil if the proxy is
+// down, or there is no fallback.
+func (p *NTLMProxy) fallbackConn(r *http.Request, pURL *url.URL, first []byte) net.Conn {
+	if pURL != nil && !p.health.check(pURL.Host) {
+		return nil
 	}
+	if p.Blocked != nil {
+		p.Blocked(r)
+	}
+	if p.FallbackDial == nil {
+		return nil
+	}
+	remote, err := p.FallbackDial(r.URL.Host)
+	if err != nil {
+		log.Print("Failed to fall back " + r.Host + ": " + err.Error())
+		return nil
+	}
+	if _, err := remote.Write(first); err != nil {
+		remote.Close()
+		return nil
+	}
+	return remote
+}
 
+// hijack takes the connection of w.
+func hijack(w http.ResponseWriter) (net.Conn, error) {
 	hj, ok := w.(http.Hijacker)
 	if !ok {
 		http.Error(w, "webserver doesn't support hijacking", http.StatusInternalServerError)
-		fmt.Println(err.Error())
-		remote.Close()
-		return
+		fmt.Println("webserver doesn't support hijacking")
+		return nil, errors.New("Hijacking is not supported")
 	}
-	conn, _, err := hj.Hijack()
+	conn, rw, err := hj.Hijack()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		fmt.Println(err.Error())
-		remote.Close()
-		return
+		return nil, err
 	}
-
-	// tell the client its ready
-	conn.Write([]byte("HTTP/1.1 200 OK\r\n\r\n"))
-
-	// start tunnel
-	go copyAndClose(remote, conn)
-	go copyAndClose(conn, remote)
+	if rw.Reader.Buffered() > 0 {
+		return &bufConn{Conn: conn, r: rw.Reader}, nil
+	}
+	return conn, nil
 }
 
 // handleHTTP handles http request.
 func (p *NTLMProxy) handleHTTP(w http.ResponseWriter, r *http.Request) {
-	// temporary store the body, so will not be consumed in handshake
-	body := r.Body
-	method := r.Method
-	length := r.ContentLength
-	r.Body = nil
-	r.Method = "GET"
-	r.ContentLength = 0
-
-	// Create client context for NTLM challenge
-	context, b, err := ntlm.NewClientContext(p.cred)
-	if err != nil {
-		http.Error(w, "Cannot create client context: "+err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	cb := ntlmPool.Get()
-	defer func() {
-		ntlmPool.Put(cb)
-	}()
-
-	// 1st request: Client -> Proxy handshake
-	n := encoder.EncodedLen(len(b))
-	if cap(cb) < n {
-		cb = make([]byte, n)
+	// The connection of client is not the one to proxy
+	protocol := fetch.Upgrade(r.Header)
+	fetch.RemoveHopHeaders(r.Header)
+	fetch.SetUpgrade(r.Header, protocol)
+	r.Close = false
+
+	// keep the body, so it can be sent again by Fallback
+	if p.Fallback != nil {
+		s, err := spoolBody(r, p.MaxReplay)
+		if err != nil {
+			http.Error(w, "Failed to read the request body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if s != nil {
+			defer s.Close()
+		}
 	}
-	encoder.Encode(cb, b)
-	r.Header.Set("Proxy-Authorization", fmt.Sprintf("NTLM %s", cb[:n]))
 
-	resp, err := p.transport.RoundTrip(r)
+	proxies, err := p.candidates(r.URL)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-
-	// 1st reply: Proxy -> Client challenge
-	// If the proxy didn't request for challenge, just send back to client
-	if resp.StatusCode != http.StatusProxyAuthRequired {
-		if body != nil || method != "GET" {
-			io.Copy(ioutil.Discard, resp.Body)
-			// Resend the request again, with body and correct method
-			r.Body = body
-			r.Method = method
-			r.ContentLength = length
+	var resp *http.Response
+	var c *proxyConn
+	var pURL *url.URL
+	for i := range proxies {
+		if pURL = proxies[i]; pURL == nil || r.URL.Scheme == "https" {
+			pURL = nil
 			resp, err = p.transport.RoundTrip(r)
-			if err != nil {
-				http.Error(w, "Failed to get response: "+err.Error(), http.StatusInternalServerError)
-				return
-			}
+		} else {
+			// The proxy will reply the content we want, after the handshake
+			resp, c, err = p.roundTrip(r, pURL.Host)
 		}
-
-		// although it replies early, still need to validate
-		if p.ValidHTTP != nil {
-			if err := p.ValidHTTP(r, resp); err != nil {
-				if p.Fallback != nil {
-					p.Fallback.ServeHTTP(w, r)
-					return
-				}
-				log.Print("Invalid response from " + r.Host)
-			}
+		// Fail over, if the body can be sent again
+		var e *proxyError
+		if !errors.As(err, &e) || i == len(proxies)-1 || e.sent && !replayable(r) {
+			break
 		}
-		pushResponse(w, resp)
-		return
+		log.Print(err.Error())
 	}
-
-	io.Copy(ioutil.Discard, resp.Body)
-	resp.Body.Close()
-
-	auth := resp.Header.Get("Proxy-Authenticate")
-	f := strings.SplitN(auth, " ", 2)
-	if len(f) < 2 {
-		http.Error(w, "Unknown Proxy-Authenticate: "+auth, http.StatusInternalServerError)
-		return
-	}
-	encodedChg := f[1]
-	challenge := ntlmPool.Get()
-	defer func() {
-		ntlmPool.Put(challenge)
-	}()
-	n = encoder.EncodedLen(len(encodedChg))
-	if cap(challenge) < n {
-		challenge = make([]byte, n)
-	}
-	_, err = encoder.Decode(challenge, []byte(encodedChg))
 	if err != nil {
-		http.Error(w, "Cannot decode challenge: "+auth, http.StatusInternalServerError)
+		http.Error(w, "Failed to get response: "+err.Error(), proxyErrorCode(err))
 		return
 	}
-
-	b, err = context.Update(challenge[:n])
-	if err != nil {
-		http.Error(w, "Failed to response challenge: "+err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	// 2nd request: Client -> Proxy response
-	// The proxy will reply the content we want at the same time
-	n = encoder.EncodedLen(len(b))
-	if cap(cb) < n {
-		cb = make([]byte, n)
-	}
-	encoder.Encode(cb, b)
-	r.Header.Set("Proxy-Connection", "Keep-Alive")
-	r.Header.Set("Proxy-Authorization", fmt.Sprintf("NTLM %s", cb[:n]))
-
-	r.Body = body
-	r.Method = method
-	r.ContentLength = length
-	resp, err = p.transport.RoundTrip(r)
-	if err != nil {
-		http.Error(w, "Failed to get response: "+err.Error(), http.StatusInternalServerError)
-		return
+	if c != nil && resp.StatusCode == http.StatusSwitchingProtocols {
+		// the connection is piped to client from now on
+		resp.Body = &bufConn{Conn: c.Conn, r: c.br}
+		c = nil
 	}
 
-	//dumpResp(resp, true)
-
 	// if response is not valid, fallback
 	if p.ValidHTTP != nil {
 		if err := p.ValidHTTP(r, resp); err != nil {
+			// The proxy may reply an error as it is going down
+			if pURL != nil && !p.health.check(pURL.Host) {
+				resp.Body.Close()
+				if c != nil {
+					c.Close()
+				}
+				http.Error(w, "Proxy is unreachable: "+resp.Status, http.StatusBadGateway)
+				return
+			}
+			if p.Blocked != nil {
+				p.Blocked(r)
+			}
 			if p.Fallback != nil {
-				p.Fallback.ServeHTTP(w, r)
+				resp.Body.Close()
+				if c != nil {
+					c.Close()
+				}
+				p.fallback(w, r)
 				return
 			}
 			log.Print("Invalid response from " + r.Host)
 		}
 	}
 
-	pushResponse(w, resp)
+	keepAlive := !resp.Close
+	err = pushResponse(w, resp)
+	if c != nil {
+		if err != nil || !keepAlive {
+			c.Close()
+		} else {
+			p.putConn(c)
+		}
+	}
+}
+
+// proxyErrorCode returns the status code of err, 502 if the proxy is
+// unreachable.
+func proxyErrorCode(err error) int {
+	if isProxyError(err) {
+		return http.StatusBadGateway
+	}
+	return http.StatusInternalServerError
 }
 
-// Websocket creates a websocket via the proxy
-func (p *NTLMProxy) Websocket(urlStr, protocol, origin string) (ws *websocket.Conn, err error) {
+// fallback serves r by Fallback, if its body can be sent again.
+func (p *NTLMProxy) fallback(w http.ResponseWriter, r *http.Request) {
+	if !replayable(r) {
+		log.Print("Too large to fall back " + r.Host)
+		http.Error(w, "Request body is too large to retry on the remote route", http.StatusBadGateway)
+		return
+	}
+	p.Fallback.ServeHTTP(w, r)
+}
+
+// Websocket creates a websocket via the proxy, header is added to the
+// handshake request.
+func (p *NTLMProxy) Websocket(urlStr, protocol, origin string, header http.Header) (ws *websocket.Conn, err error) {
 	var protocols []string
 	if protocol != "" {
 		protocols = []string{protocol}
@@ -414,6 +394,9 @@ func (p *NTLMProxy) Websocket(urlStr, protocol, origin string) (ws *websocket.Co
 	}
 
 	h := p.makeHeader()
+	for k, v := range header {
+		h[k] = v
+	}
 	h.Add("Origin", strings.ToLower(origin))
 	// Create a websocket from connection
 	conn, resp, err := dialer.Dial(urlStr, h)
@@ -431,20 +414,53 @@ func (p *NTLMProxy) makeHeader() http.Header {
 	return h
 }
 
-// pushResponse writes the response to the ResponseWriter
-func pushResponse(w http.ResponseWriter, resp *http.Response) {
+// pushResponse writes the response to the ResponseWriter. The connection to
+// client is managed by the http server, so it can be kept alive.
+//
+// If resp switches protocols, its Body must be the upgraded connection, and
+// it is piped to the client.
+func pushResponse(w http.ResponseWriter, resp *http.Response) error {
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		return pushUpgrade(w, resp)
+	}
+	fetch.RemoveHopHeaders(resp.Header)
+	h := w.Header()
+	for k, v := range resp.Header {
+		h[k] = v
+	}
+	w.WriteHeader(resp.StatusCode)
+	_, err := io.Copy(w, resp.Body)
+	return err
+}
+
+// pushUpgrade writes the 101 response to client, and copies the data between
+// the client and the upgraded connection.
+func pushUpgrade(w http.ResponseWriter, resp *http.Response) error {
+	up, ok := resp.Body.(io.ReadWriter)
+	if !ok {
+		http.Error(w, "Cannot switch protocols", http.StatusBadGateway)
+		return errors.New("Upgraded connection is not writable")
+	}
 	hj, ok := w.(http.Hijacker)
 	if !ok {
 		http.Error(w, "webserver doesn't support hijacking", http.StatusInternalServerError)
-		return
+		return errors.New("Cannot hijack")
 	}
-	conn, _, err := hj.Hijack()
+	c, brw, err := hj.Hijack()
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return err
 	}
-	defer conn.Close()
-	resp.Write(conn)
+	defer c.Close()
+	if err := fetch.WriteUpgrade(c, resp); err != nil {
+		return err
+	}
+	go func() {
+		io.Copy(up, brw)
+		resp.Body.Close()
+	}()
+	_, err = io.Copy(c, up)
+	return err
 }
 
 func dumpReq(req *http.Request, body bool) {
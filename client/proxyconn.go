@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"expvar"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// maxIdleProxyConns is the maximum number of keep-alive connections to the
+// proxy waiting for requests.
+const maxIdleProxyConns = 8
+
+// idleProxyTimeout is how long a keep-alive connection to the proxy can wait
+// for next request.
+var idleProxyTimeout = 60 * time.Second
+
+// proxyStats counts the connections and handshakes with the proxy, it is
+// served at /debug/vars.
+//
+//	dials       new connections to the proxy
+//	reused      requests on the idle connections
+//	handshakes  requests rejected by 407 at first
+//	challenges  407 replies, for each round of the handshakes
+//	skipped     authenticated requests without handshake
+var proxyStats = expvar.NewMap("proxy")
+
+// proxyConn is a keep-alive connection to the proxy.
+type proxyConn struct {
+	net.Conn
+	br   *bufio.Reader
+	addr string
+
+	// authed is set if the connection is authenticated by a connection
+	// based scheme, so the requests on it need no handshake.
+	authed bool
+	reused bool
+	since  time.Time
+}
+
+// proxyConns is the pool of the idle connections to the proxy.
+type proxyConns struct {
+	lock sync.Mutex
+	idle []*proxyConn
+}
+
+// getConn returns an idle connection to the proxy at addr, the
+// authenticated first, or a new one.
+func (p *NTLMProxy) getConn(addr string) (*proxyConn, error) {
+	p.conns.lock.Lock()
+	var c *proxyConn
+	for i := len(p.conns.idle) - 1; i >= 0; i-- {
+		v := p.conns.idle[i]
+		if time.Since(v.since) >= idleProxyTimeout {
+			v.Close()
+			p.conns.idle = append(p.conns.idle[:i], p.conns.idle[i+1:]...)
+			continue
+		}
+		if v.addr == addr && (c == nil || v.authed && !c.authed) {
+			c = v
+		}
+	}
+	if c != nil {
+		for i, v := range p.conns.idle {
+			if v == c {
+				p.conns.idle = append(p.conns.idle[:i], p.conns.idle[i+1:]...)
+				break
+			}
+		}
+	}
+	p.conns.lock.Unlock()
+
+	if c != nil {
+		proxyStats.Add("reused", 1)
+		c.reused = true
+		return c, nil
+	}
+	return p.dialProxy(addr)
+}
+
+// putConn keeps c for the next request.
+func (p *NTLMProxy) putConn(c *proxyConn) {
+	c.since = time.Now()
+	p.conns.lock.Lock()
+	defer p.conns.lock.Unlock()
+	if len(p.conns.idle) >= maxIdleProxyConns {
+		p.conns.idle[0].Close()
+		p.conns.idle = append(p.conns.idle[:0], p.conns.idle[1:]...)
+	}
+	p.conns.idle = append(p.conns.idle, c)
+}
+
+// dialProxy opens a new connection to the proxy at addr.
+func (p *NTLMProxy) dialProxy(addr string) (*proxyConn, error) {
+	conn, err := p.transport.Dial("tcp", addr)
+	if err != nil {
+		p.health.set(addr, err)
+		return nil, &proxyError{addr: addr, err: errors.New("Failed to dial: " + err.Error())}
+	}
+	proxyStats.Add("dials", 1)
+	return &proxyConn{Conn: conn, br: bufio.NewReader(conn), addr: addr}, nil
+}
+
+// roundTrip sends r to the proxy at addr on a keep-alive connection, and runs
+// the handshake if the proxy requires. The body of r is not sent until it is
+// authorized, a probe request without body is sent instead in handshake.
+//
+// It returns the response with the connection it is read from. A response of
+// CONNECT or switching protocols takes the connection, the others should be
+// read to the end before the connection is put back.
+func (p *NTLMProxy) roundTrip(r *http.Request, addr string) (*http.Response, *proxyConn, error) {
+	body, method, length := r.Body, r.Method, r.ContentLength
+	defer func() {
+		r.Body, r.Method, r.ContentLength = body, method, length
+	}()
+
+	c, err := p.getConn(addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	auth, final, err := p.auth.start(r, c.authed)
+	if err != nil {
+		c.Close()
+		return nil, nil, err
+	}
+	skipped := final
+	hasBody := body != nil && body != http.NoBody
+	sent, challenged := false, false
+	// fail marks the proxyError if the body has been sent
+	fail := func(err error) error {
+		var e *proxyError
+		if errors.As(err, &e) {
+			e.sent = sent
+		}
+		return err
+	}
+	for round := 0; ; round++ {
+		probe := hasBody && !final
+		if probe {
+			r.Method, r.Body, r.ContentLength = "GET", nil, 0
+		} else {
+			r.Method, r.Body, r.ContentLength = method, body, length
+			if sent {
+				if r.GetBody == nil {
+					c.Close()
+					return nil, nil, errors.New("Cannot send the request body again")
+				}
+				if r.Body, err = r.GetBody(); err != nil {
+					c.Close()
+					return nil, nil, err
+				}
+			}
+			sent = hasBody
+		}
+
+		var resp *http.Response
+		if err = r.WriteProxy(c); err == nil {
+			resp, err = http.ReadResponse(c.br, r)
+		}
+		if err != nil {
+			c.Close()
+			// An idle connection may have been closed by the proxy
+			if c.reused && (!sent || r.GetBody != nil) {
+				if c, err = p.dialProxy(addr); err != nil {
+					return nil, nil, fail(err)
+				}
+				continue
+			}
+			return nil, nil, p.proxyFailure(addr, errors.New("server failed response: "+err.Error()), sent)
+		}
+		//dumpResp(resp, true)
+
+		if resp.StatusCode != http.StatusProxyAuthRequired {
+			if probe && resp.StatusCode != http.StatusSwitchingProtocols {
+				// The proxy replies the probe, send it again with body
+				if c, err = p.drain(c, resp); err != nil {
+					return nil, nil, fail(err)
+				}
+				final = true
+				continue
+			}
+			if skipped {
+				proxyStats.Add("skipped", 1)
+			}
+			c.authed = c.authed || auth.connected()
+			return resp, c, nil
+		}
+
+		if !challenged {
+			proxyStats.Add("handshakes", 1)
+			challenged = true
+		}
+		proxyStats.Add("challenges", 1)
+		if round == maxAuthRounds {
+			return resp, c, nil
+		}
+		skipped, c.authed = false, false
+		if c, err = p.drain(c, resp); err != nil {
+			return nil, nil, fail(err)
+		}
+
+		// Response the challenge from header
+		r.Method = method
+		if final, err = auth.respond(r, resp); err != nil {
+			c.Close()
+			return nil, nil, err
+		}
+		r.Header.Set("Proxy-Connection", "Keep-Alive")
+	}
+}
+
+// drain consumes the body of resp, so c can be reused. It returns a new
+// connection if the proxy closes c.
+func (p *NTLMProxy) drain(c *proxyConn, resp *http.Response) (*proxyConn, error) {
+	_, err := io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if err == nil && !resp.Close {
+		c.reused = false
+		return c, nil
+	}
+	c.Close()
+	return p.dialProxy(c.addr)
+}
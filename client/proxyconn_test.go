@@ -0,0 +1,78 @@
+package main
+
+import (
+	"expvar"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func proxyStat(name string) int64 {
+	if v, ok := proxyStats.Get(name).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func TestProxyConnReuse(t *testing.T) {
+	echo := listen(t, func(c net.Conn) {
+		io.Copy(c, c)
+		c.Close()
+	})
+	fake := &fakeNTLMProxy{t: t, user: `DOMAIN\alice`, password: "secret", target: echo}
+	auth, _ := NewProxyAuth(`DOMAIN\alice`, "secret", "")
+	p, err := NewNTLMProxy("http://"+listen(t, fake.serve), auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(p)
+	defer ts.Close()
+	pURL, _ := url.Parse(ts.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(pURL)}}
+
+	handshakes, skipped := proxyStat("handshakes"), proxyStat("skipped")
+	for i := 0; i < 4; i++ {
+		var resp *http.Response
+		if i%2 == 0 {
+			resp, err = client.Get("http://example.com/a")
+		} else {
+			resp, err = client.Post("http://example.com/a", "text/plain", strings.NewReader("body"))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != 200 || string(b) != "hello /a" {
+			t.Fatalf("%d %q", resp.StatusCode, b)
+		}
+	}
+
+	// CONNECT on the authenticated connection
+	c, err := p.dial("example.com:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(c, "ping")
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(c, b); err != nil || string(b) != "ping" {
+		t.Fatalf("%q %v", b, err)
+	}
+	c.Close()
+
+	if n := atomic.LoadInt32(&fake.negotiates); n != 1 {
+		t.Fatalf("%d NTLM handshakes", n)
+	}
+	if n := proxyStat("handshakes") - handshakes; n != 1 {
+		t.Fatalf("handshakes counted %d", n)
+	}
+	if n := proxyStat("skipped") - skipped; n != 4 {
+		t.Fatalf("skipped counted %d", n)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"net/http"
+)
+
+var errRaceLost = errors.New("Lost the race")
+
+// connectRace is a CONNECT sent by the proxy and FallbackDial at the same
+// time.
+type connectRace struct {
+	r *http.Request
+	// first is the first message of the client, it is set when ready is
+	// closed
+	first   []byte
+	ready   chan struct{}
+	cancel  chan struct{}
+	results chan raceResult
+}
+
+// raceResult is the connection of a route validated with the reply, or the
+// failure.
+type raceResult struct {
+	conn   net.Conn
+	reply  []byte
+	direct bool
+	err    error
+}
+
+// raceConnect tells the client the tunnel is established, and sends its first
+// message by both routes. The tunnel takes the route replying valid first,
+// the other is canceled.
+func (p *NTLMProxy) raceConnect(w http.ResponseWriter, r *http.Request) {
+	race := &connectRace{
+		r:       r,
+		ready:   make(chan struct{}),
+		cancel:  make(chan struct{}),
+		results: make(chan raceResult, 2),
+	}
+	go p.runRoute(race, true, p.dial)
+	go p.runRoute(race, false, p.FallbackDial)
+
+	conn, err := hijack(w)
+	if err == nil {
+		// tell the client its ready
+		conn.Write([]byte("HTTP/1.1 200 OK\r\n\r\n"))
+		if race.first, err = readFirst(conn); err != nil {
+			conn.Close()
+		}
+	}
+	close(race.ready)
+	if err != nil {
+		close(race.cancel)
+		return
+	}
+
+	var errs []string
+	for i := 0; i < 2; i++ {
+		res := <-race.results
+		if res.err != nil {
+			route := "proxy"
+			if !res.direct {
+				route = "remote"
+			}
+			errs = append(errs, route+": "+res.err.Error())
+			continue
+		}
+		close(race.cancel)
+		if i == 0 {
+			// close the loser when it is done
+			go func() {
+				if res := <-race.results; res.conn != nil {
+					res.conn.Close()
+				}
+			}()
+		}
+		if len(race.first) > 0 {
+			if p.Chosen != nil {
+				p.Chosen(r, res.direct)
+			}
+			conn.Write(res.reply)
+		} else if res.direct && p.Chosen != nil {
+			// the host speaks first, it is not checked again next time
+			p.Chosen(r, true)
+		}
+		go copyAndClose(res.conn, conn)
+		go copyAndClose(conn, res.conn)
+		return
+	}
+	log.Print("Failed to establish connection to " + r.Host + ": " + errs[0] + "; " + errs[1])
+	conn.Close()
+}
+
+// runRoute dials the host of the race by dial, sends the first message of
+// the client, and validates the reply.
+func (p *NTLMProxy) runRoute(race *connectRace, direct bool, dial func(string) (net.Conn, error)) {
+	c, err := dial(race.r.URL.Host)
+	if err != nil {
+		race.results <- raceResult{direct: direct, err: err}
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-race.cancel:
+			c.Close()
+		case <-done:
+		}
+	}()
+
+	var reply []byte
+	select {
+	case <-race.ready:
+		if first := race.first; len(first) > 0 {
+			if reply, err = exchange(c, first); err == nil {
+				err = p.ValidConnect(race.r, first, reply)
+			}
+		}
+	case <-race.cancel:
+	}
+	close(done)
+
+	select {
+	case <-race.cancel:
+		if err == nil {
+			err = errRaceLost
+		}
+	default:
+	}
+	if err != nil {
+		c.Close()
+		race.results <- raceResult{direct: direct, err: err}
+		return
+	}
+	race.results <- raceResult{conn: c, reply: reply, direct: direct}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConnectValidation(t *testing.T) {
+	// modes of the routes, "fail" the validation, or "hang" without reply
+	var lock sync.Mutex
+	var modes map[string]string
+	mode := func(route string) string {
+		lock.Lock()
+		defer lock.Unlock()
+		return modes[route]
+	}
+	canceled := make(chan string, 2)
+	serve := func(route, prefix string) func(c net.Conn) {
+		return func(c net.Conn) {
+			defer c.Close()
+			if mode(route) == "hang" {
+				io.Copy(ioutil.Discard, c)
+				canceled <- route
+				return
+			}
+			b := make([]byte, 1024)
+			for {
+				n, err := c.Read(b)
+				if err != nil {
+					return
+				}
+				c.Write(append([]byte(prefix), b[:n]...))
+			}
+		}
+	}
+	direct := listen(t, serve("direct", ""))
+	remote := listen(t, serve("remote", "R"))
+
+	p, err := NewNTLMProxy("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.FallbackDial = func(addr string) (net.Conn, error) {
+		return net.Dial("tcp", remote)
+	}
+	p.ValidConnect = func(r *http.Request, first, reply []byte) error {
+		if string(first) != "hi" {
+			t.Errorf("first message %q", first)
+		}
+		route := "direct"
+		if string(reply) != "hi" {
+			route = "remote"
+		}
+		if mode(route) == "fail" {
+			return errors.New("blocked")
+		}
+		return nil
+	}
+	chosen := make(chan bool, 2)
+	p.Chosen = func(r *http.Request, direct bool) {
+		chosen <- direct
+	}
+	blocked := make(chan bool, 2)
+	p.Blocked = func(r *http.Request) {
+		blocked <- true
+	}
+	ts := httptest.NewServer(p)
+	defer ts.Close()
+
+	for _, v := range []struct {
+		race           bool
+		direct, remote string
+		// reply is empty if the connection is closed
+		reply string
+	}{
+		{false, "", "", "hi"},
+		{false, "fail", "", "Rhi"},
+		{true, "", "hang", "hi"},
+		{true, "hang", "", "Rhi"},
+		{true, "fail", "", "Rhi"},
+		{true, "fail", "fail", ""},
+	} {
+		lock.Lock()
+		modes = map[string]string{"direct": v.direct, "remote": v.remote}
+		lock.Unlock()
+		p.Race = v.race
+
+		c, err := net.Dial("tcp", ts.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(c, "CONNECT "+direct+" HTTP/1.1\r\nHost: "+direct+"\r\n\r\n")
+		br := bufio.NewReader(c)
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("%v: %v %v", v, resp, err)
+		}
+		io.WriteString(c, "hi")
+		b, err := ioutil.ReadAll(io.LimitReader(br, int64(len(v.reply))))
+		if err != nil || string(b) != v.reply {
+			t.Fatalf("%v: %q %v", v, b, err)
+		}
+		if v.reply == "" {
+			if _, err := br.ReadByte(); err != io.EOF {
+				t.Fatalf("%v: connection is not closed: %v", v, err)
+			}
+		} else if v.race || v.direct == "" {
+			if d := <-chosen; d != (v.reply == "hi") {
+				t.Fatalf("%v: chosen direct %v", v, d)
+			}
+		} else {
+			<-blocked
+		}
+		c.Close()
+		for _, m := range []string{v.direct, v.remote} {
+			if m == "hang" {
+				<-canceled
+			}
+		}
+	}
+}
+
+func TestConnectTimeouts(t *testing.T) {
+	oldFirst, oldReply := firstTimeout, replyTimeout
+	firstTimeout, replyTimeout = 50*time.Millisecond, 50*time.Millisecond
+	defer func() { firstTimeout, replyTimeout = oldFirst, oldReply }()
+
+	// the host speaks first, or replies late
+	first := listen(t, func(c net.Conn) {
+		io.WriteString(c, "S")
+		io.Copy(c, c)
+		c.Close()
+	})
+	slow := listen(t, func(c net.Conn) {
+		c.Read(make([]byte, 2))
+		time.Sleep(200 * time.Millisecond)
+		io.WriteString(c, "late")
+		io.Copy(ioutil.Discard, c)
+		c.Close()
+	})
+
+	p, err := NewNTLMProxy("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.ValidConnect = func(r *http.Request, first, reply []byte) error {
+		return nil
+	}
+	chosen := make(chan string, 2)
+	p.Chosen = func(r *http.Request, direct bool) {
+		chosen <- r.Host
+	}
+	p.Blocked = func(r *http.Request) {
+		t.Errorf("%s is blocked", r.Host)
+	}
+	ts := httptest.NewServer(p)
+	defer ts.Close()
+
+	for _, v := range []struct {
+		addr, send, reply string
+		chosen            bool
+	}{
+		{first, "", "S", true},
+		{slow, "hi", "late", false},
+	} {
+		c, err := net.Dial("tcp", ts.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(c, "CONNECT "+v.addr+" HTTP/1.1\r\nHost: "+v.addr+"\r\n\r\n")
+		br := bufio.NewReader(c)
+		if resp, err := http.ReadResponse(br, nil); err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: %v %v", v.addr, resp, err)
+		}
+		io.WriteString(c, v.send)
+		b, err := ioutil.ReadAll(io.LimitReader(br, int64(len(v.reply))))
+		if err != nil || string(b) != v.reply {
+			t.Fatalf("%s: %q %v", v.addr, b, err)
+		}
+		c.Close()
+		select {
+		case h := <-chosen:
+			if !v.chosen || h != v.addr {
+				t.Fatalf("%s: %s is chosen", v.addr, h)
+			}
+		default:
+			if v.chosen {
+				t.Fatalf("%s is not chosen", v.addr)
+			}
+		}
+	}
+}
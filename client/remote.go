@@ -0,0 +1,235 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// breakerFailures is the number of dial failures in a row that open the
+// circuit of a remote server.
+const breakerFailures = 3
+
+// breakerCooldown is how long a remote server with the circuit open is
+// skipped, unless all are down, before it is probed again.
+var breakerCooldown = 30 * time.Second
+
+// warmIdle is how long a warm tunnel is kept, less than the idle timeout of
+// the server.
+var warmIdle = 60 * time.Second
+
+var errNoRemote = errors.New("No remote server")
+
+// Remote is a remote server with its pool of tunnels. Its circuit is opened
+// by the failures to dial, and closed by the next success.
+type Remote struct {
+	Name string
+	Pool *WarmPool
+
+	dial funcConn
+
+	lock     sync.Mutex
+	failures int
+	// opened is when the circuit is opened, zero if it is closed
+	opened time.Time
+	// latency is the moving average of the time to dial
+	latency time.Duration
+}
+
+// RemoteStats is the statistics of a remote server.
+type RemoteStats struct {
+	PoolStats
+	Down    bool
+	Latency time.Duration
+}
+
+// NewRemote returns a Remote keeps size tunnels by dial warm, with max
+// tunnels at most.
+func NewRemote(name string, dial funcConn, size, max int) *Remote {
+	r := &Remote{Name: name}
+	r.dial = func() (net.Conn, error) {
+		start := time.Now()
+		c, err := dial()
+		r.observe(time.Since(start), err)
+		return c, err
+	}
+	r.Pool = NewWarmPool(r.dial, size, max, warmIdle)
+	return r
+}
+
+// observe records a dial taking d.
+func (r *Remote) observe(d time.Duration, err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if err != nil {
+		r.failures++
+		if r.failures >= breakerFailures {
+			if r.opened.IsZero() {
+				log.Print("Remote " + r.Name + " is down: " + err.Error())
+			}
+			r.opened = time.Now()
+		}
+		return
+	}
+	if !r.opened.IsZero() {
+		log.Print("Remote " + r.Name + " is up")
+	}
+	r.failures, r.opened = 0, time.Time{}
+	if r.latency == 0 {
+		r.latency = d
+	} else {
+		r.latency = (r.latency*7 + d) / 8
+	}
+}
+
+// Down reports whether the circuit of r is open.
+func (r *Remote) Down() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return !r.opened.IsZero()
+}
+
+// cooling reports whether the circuit of r is open, and its cooldown is not
+// over.
+func (r *Remote) cooling() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return !r.opened.IsZero() && time.Since(r.opened) < breakerCooldown
+}
+
+// Latency returns the moving average of the time to dial r.
+func (r *Remote) Latency() time.Duration {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.latency
+}
+
+// Stats returns the statistics of r.
+func (r *Remote) Stats() RemoteStats {
+	s := RemoteStats{PoolStats: r.Pool.Stats()}
+	r.lock.Lock()
+	s.Down, s.Latency = !r.opened.IsZero(), r.latency
+	r.lock.Unlock()
+	return s
+}
+
+// Balancer is a ConnPool spreads the tunnels over the remote servers, by
+// round robin, or to the one of lowest latency. The servers down are tried
+// at last.
+type Balancer struct {
+	Remotes []*Remote
+	// Latency chooses the remote server of lowest latency first.
+	Latency bool
+
+	next uint32
+}
+
+// balancedConn is a tunnel with the remote server it is from.
+type balancedConn struct {
+	net.Conn
+	remote *Remote
+}
+
+// Get returns a tunnel from the first remote server can open it. The remote
+// servers in their cooldown are skipped, unless all are down.
+func (b *Balancer) Get() (net.Conn, error) {
+	err := errNoRemote
+	// the first pass does not wait for the busy ones
+	var busy []*Remote
+	for _, r := range b.order() {
+		var c net.Conn
+		if c, err = r.Pool.TryGet(); err == nil {
+			return &balancedConn{Conn: c, remote: r}, nil
+		}
+		if err == errPoolFull {
+			busy = append(busy, r)
+			continue
+		}
+		log.Print("Remote " + r.Name + ": " + err.Error())
+	}
+	for _, r := range busy {
+		var c net.Conn
+		if c, err = r.Pool.Get(); err == nil {
+			return &balancedConn{Conn: c, remote: r}, nil
+		}
+		log.Print("Remote " + r.Name + ": " + err.Error())
+	}
+	return nil, err
+}
+
+// Put gives conn back to the pool of its remote server.
+func (b *Balancer) Put(conn net.Conn) {
+	if c, ok := conn.(*balancedConn); ok {
+		c.remote.Pool.Put(c.Conn)
+		return
+	}
+	conn.Close()
+}
+
+// order returns the remote servers in the order to try, without the ones in
+// their cooldown unless all are.
+func (b *Balancer) order() []*Remote {
+	n := len(b.Remotes)
+	if n == 0 {
+		return nil
+	}
+	start := int(atomic.AddUint32(&b.next, 1)-1) % n
+	var up, down, cooling []*Remote
+	for i := 0; i < n; i++ {
+		r := b.Remotes[(start+i)%n]
+		switch {
+		case r.cooling():
+			cooling = append(cooling, r)
+		case r.Down():
+			down = append(down, r)
+		default:
+			up = append(up, r)
+		}
+	}
+	if len(up)+len(down) == 0 {
+		return cooling
+	}
+	if b.Latency {
+		sort.SliceStable(up, func(i, j int) bool {
+			return up[i].Latency() < up[j].Latency()
+		})
+	}
+	return append(up, down...)
+}
+
+// Stats returns the statistics of the remote servers by their names.
+func (b *Balancer) Stats() map[string]RemoteStats {
+	m := make(map[string]RemoteStats, len(b.Remotes))
+	for _, r := range b.Remotes {
+		m[r.Name] = r.Stats()
+	}
+	return m
+}
+
+// Run probes the remote servers down every interval, it never returns.
+func (b *Balancer) Run(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		b.probe()
+	}
+}
+
+// probe dials the remote servers down after their cooldown, a success closes
+// the circuit.
+func (b *Balancer) probe() {
+	for _, r := range b.Remotes {
+		r.lock.Lock()
+		due := !r.opened.IsZero() && time.Since(r.opened) >= breakerCooldown
+		r.lock.Unlock()
+		if !due {
+			continue
+		}
+		if c, err := r.dial(); err == nil {
+			c.Close()
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeDial returns a dial to a remote server, which fails while *down is set.
+func fakeDial(down *int32, delay time.Duration) funcConn {
+	return func() (net.Conn, error) {
+		time.Sleep(delay)
+		if atomic.LoadInt32(down) != 0 {
+			return nil, errors.New("refused")
+		}
+		c, s := net.Pipe()
+		go func() {
+			// keep s open until c is closed
+			s.Read(make([]byte, 1))
+			s.Close()
+		}()
+		return c, nil
+	}
+}
+
+func TestBalancer(t *testing.T) {
+	var downA, downB int32
+	a := NewRemote("a", fakeDial(&downA, 0), 0, 4)
+	b := NewRemote("b", fakeDial(&downB, 20*time.Millisecond), 0, 4)
+	defer a.Pool.Close()
+	defer b.Pool.Close()
+	balancer := &Balancer{Remotes: []*Remote{a, b}}
+
+	get := func() *Remote {
+		c, err := balancer.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		return c.(*balancedConn).remote
+	}
+
+	// round robin
+	if r1, r2 := get(), get(); r1 == r2 {
+		t.Errorf("round robin chooses %s twice", r1.Name)
+	}
+
+	// the lowest latency
+	balancer.Latency = true
+	for i := 0; i < 3; i++ {
+		if r := get(); r != a {
+			t.Errorf("latency chooses %s", r.Name)
+		}
+	}
+
+	// the circuit of a is opened, b is chosen
+	atomic.StoreInt32(&downA, 1)
+	for i := 0; i < breakerFailures; i++ {
+		if _, err := a.Pool.Get(); err == nil {
+			t.Fatal("dial should fail")
+		}
+	}
+	if !a.Down() {
+		t.Fatal("circuit is not opened")
+	}
+	for i := 0; i < 3; i++ {
+		if r := get(); r != b {
+			t.Errorf("remote down is chosen")
+		}
+	}
+
+	// a in its cooldown is not dialed, b fails too
+	failures := a.Pool.Stats().Failures
+	atomic.StoreInt32(&downB, 1)
+	if _, err := balancer.Get(); err == nil {
+		t.Error("Get should fail")
+	}
+	if n := a.Pool.Stats().Failures; n != failures {
+		t.Errorf("a is dialed %d times in its cooldown", n-failures)
+	}
+
+	// a recovers by the probe
+	defer func(d time.Duration) { breakerCooldown = d }(breakerCooldown)
+	breakerCooldown = 0
+	atomic.StoreInt32(&downA, 0)
+	balancer.probe()
+	if a.Down() {
+		t.Fatal("circuit is not closed")
+	}
+	if r := get(); r != a {
+		t.Errorf("%s is chosen, after a recovers", r.Name)
+	}
+}
+
+func TestBalancerBusy(t *testing.T) {
+	var downA, downB int32
+	a := NewRemote("a", fakeDial(&downA, 0), 0, 1)
+	b := NewRemote("b", fakeDial(&downB, 0), 0, 1)
+	defer a.Pool.Close()
+	defer b.Pool.Close()
+	balancer := &Balancer{Remotes: []*Remote{a, b}}
+
+	// the slots of a are full, b is chosen at once
+	c, err := a.Pool.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		start := time.Now()
+		c, err := balancer.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r := c.(*balancedConn).remote; r != b {
+			t.Errorf("%s is chosen, with the slots full", r.Name)
+		}
+		if d := time.Since(start); d > time.Second {
+			t.Errorf("Get waits %v for the busy remote", d)
+		}
+		c.Close()
+	}
+	c.Close()
+
+	// a in its cooldown is still tried when all are down
+	atomic.StoreInt32(&downA, 1)
+	atomic.StoreInt32(&downB, 1)
+	for i := 0; i < breakerFailures; i++ {
+		a.Pool.Get()
+		b.Pool.Get()
+	}
+	if !a.Down() || !b.Down() {
+		t.Fatal("circuit is not opened")
+	}
+	atomic.StoreInt32(&downA, 0)
+	c, err = balancer.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if c.(*balancedConn).remote != a {
+		t.Error("a is not chosen, when all are down")
+	}
+}
+
+func TestParseRemote(t *testing.T) {
+	tests := []struct {
+		in, pURL, origin, auth string
+	}{
+		{"example.com", "wss://example.com:8000/p", "https://example.com/", ""},
+		{"http://u:p@example.com:80/ws", "ws://example.com:80/ws", "http://example.com/", "u:p"},
+		{"https://u:a/b@c@example.com/ws", "wss://example.com:8000/ws", "https://example.com/", "u:a/b@c"},
+	}
+	for _, v := range tests {
+		pURL, origin, auth, err := parseRemote(v.in)
+		if err != nil || pURL != v.pURL || origin != v.origin || auth != v.auth {
+			t.Errorf("parseRemote(%q) = %q %q %q %v", v.in, pURL, origin, auth, err)
+		}
+	}
+	if _, _, _, err := parseRemote("ftp://example.com"); err == nil {
+		t.Error("unknown protocol is accepted")
+	}
+}
@@ -0,0 +1,506 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxBodyCheck is the bytes of a response body checked by the body rules.
+const maxBodyCheck = 16 << 10
+
+// defaultRules are the rules without the rules file, any error or the
+// redirect to the block page of ScanSafe, and any alert of TLS.
+const defaultRules = `
+error	status=400-599
+scansafe	location=alert.scansafe.net
+alert	alert=*
+`
+
+// tlsAlerts are the names of TLS alerts, see RFC 8446.
+var tlsAlerts = map[string]int{
+	"close_notify":            0,
+	"unexpected_message":      10,
+	"bad_record_mac":          20,
+	"record_overflow":         22,
+	"handshake_failure":       40,
+	"bad_certificate":         42,
+	"unsupported_certificate": 43,
+	"certificate_revoked":     44,
+	"certificate_expired":     45,
+	"certificate_unknown":     46,
+	"illegal_parameter":       47,
+	"unknown_ca":              48,
+	"access_denied":           49,
+	"decode_error":            50,
+	"decrypt_error":           51,
+	"protocol_version":        70,
+	"insufficient_security":   71,
+	"internal_error":          80,
+	"user_canceled":           90,
+	"unsupported_extension":   110,
+	"unrecognized_name":       112,
+}
+
+// interceptors are the issuers of the known TLS interception, they are
+// matched by issuer=intercepted.
+var interceptors = globRegexps([]string{
+	"*Zscaler*", "*Fortinet*", "*FortiGate*", "*Palo Alto*", "*Netskope*",
+	"*Cisco Umbrella*", "*Blue Coat*", "*BlueCoat*", "*Forcepoint*",
+	"*Websense*", "*McAfee Web Gateway*", "*Sophos*", "*Check Point*",
+	"*Barracuda*", "*Menlo Security*", "*iboss*", "*Kaspersky*", "*Avast*",
+})
+
+// Rules are the signatures of the replies of a proxy blocking the host, e.g.
+// its block page. A reply matching any rule is blocked.
+type Rules struct {
+	rules []*rule
+
+	// Dial dials addr through the proxy. The certificates of TLS 1.3 are
+	// encrypted, they are only checked by a handshake on a new connection,
+	// for the rules of certificates with host.
+	Dial func(addr string) (net.Conn, error)
+	// Roots verifies the certificates of TLS 1.2, the system roots if it
+	// is nil.
+	Roots *x509.CertPool
+
+	lock sync.Mutex
+	// certs are the certificates probed by Dial, by the host
+	certs map[string]probedCerts
+}
+
+// probedCerts are the certificates of a host probed at time.
+type probedCerts struct {
+	chain []*x509.Certificate
+	time  time.Time
+}
+
+// certsTTL is how long the certificates probed are kept.
+var certsTTL = 10 * time.Minute
+
+// rule matches a reply if all its conditions match.
+type rule struct {
+	name     string
+	hosts    []*regexp.Regexp
+	status   [][2]int
+	location *regexp.Regexp
+	headers  []headerRule
+	body     *regexp.Regexp
+	// alerts are the descriptions of TLS alerts, -1 is any
+	alerts []int
+	// issuers and expect are the issuers of the certificates of TLS
+	issuers []*regexp.Regexp
+	expect  []*regexp.Regexp
+}
+
+type headerRule struct {
+	key   string
+	value *regexp.Regexp
+}
+
+// blockError is the reply matching a rule.
+type blockError struct {
+	rule string
+}
+
+func (e *blockError) Error() string {
+	return "Blocked by rule " + e.rule
+}
+
+// LoadRules reads the rules from the file at path, or the default rules if
+// path is empty.
+func LoadRules(path string) (*Rules, error) {
+	if path == "" {
+		return ReadRules(strings.NewReader(defaultRules))
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadRules(f)
+}
+
+// ReadRules reads the rules from r. Each line is the name of a rule and its
+// conditions as key=value, separated by spaces, e.g.
+//
+//	zscaler	status=403	header=Server:Zscaler*
+//	bluecoat	status=200-299	body=(?i)access\sdenied.*blue\s?coat
+//	fortinet	location=*.fortinet.net
+//	denied	alert=access_denied,49
+//	inspected	host=*.bank.com,mail.example.com	issuer=intercepted
+//	pinned	host=*.example.org	expect=DigiCert*,Let's*
+//
+// The conditions are
+//
+//	host      the hosts requested, * is any characters
+//	status    the status codes, or ranges of them, e.g. 403,500-599
+//	location  the host of Location
+//	header    a header and its value, e.g. Server:Zscaler*, it can be repeated
+//	body      a regular expression of the first 16KB of the body
+//	alert     the names or codes of TLS alerts, * is any
+//	issuer    the issuers in the certificates of TLS, intercepted is the
+//	          known TLS interception
+//	expect    the issuers expected, it matches if none is in the certificates
+//
+// The rules of issuer and expect require host, as the certificates of TLS 1.3
+// are only seen by another handshake to the hosts.
+//
+// Spaces cannot be in the values, \s can be in the regular expressions.
+// Lines starting with # are ignored.
+func ReadRules(r io.Reader) (*Rules, error) {
+	rs := &Rules{}
+	scr := bufio.NewScanner(r)
+	for scr.Scan() {
+		line := strings.TrimSpace(scr.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		t := strings.Fields(line)
+		if len(t) < 2 {
+			return nil, errors.New("Failed to parse rule: " + line)
+		}
+		ru := &rule{name: t[0]}
+		for _, kv := range t[1:] {
+			if err := ru.parse(kv); err != nil {
+				return nil, errors.New("Failed to parse rule " + ru.name + ": " + err.Error())
+			}
+		}
+		if ru.isCert() && ru.hosts == nil {
+			return nil, errors.New("Failed to parse rule " + ru.name + ": issuer and expect require host")
+		}
+		rs.rules = append(rs.rules, ru)
+	}
+	return rs, scr.Err()
+}
+
+// parse adds a condition as key=value to ru.
+func (ru *rule) parse(kv string) error {
+	f := strings.SplitN(kv, "=", 2)
+	if len(f) != 2 || f[1] == "" {
+		return errors.New("Invalid condition: " + kv)
+	}
+	var err error
+	switch f[0] {
+	case "host":
+		ru.hosts = globRegexps(strings.Split(f[1], ","))
+	case "status":
+		for _, v := range strings.Split(f[1], ",") {
+			lo, hi := v, v
+			if i := strings.Index(v, "-"); i >= 0 {
+				lo, hi = v[:i], v[i+1:]
+			}
+			var r [2]int
+			if r[0], err = strconv.Atoi(lo); err != nil {
+				return errors.New("Invalid status: " + v)
+			}
+			if r[1], err = strconv.Atoi(hi); err != nil {
+				return errors.New("Invalid status: " + v)
+			}
+			ru.status = append(ru.status, r)
+		}
+	case "location":
+		ru.location = globRegexp(f[1])
+	case "header":
+		h := strings.SplitN(f[1], ":", 2)
+		if len(h) != 2 {
+			return errors.New("Invalid header: " + f[1])
+		}
+		ru.headers = append(ru.headers, headerRule{key: h[0], value: globRegexp(h[1])})
+	case "body":
+		if ru.body, err = regexp.Compile(f[1]); err != nil {
+			return err
+		}
+	case "alert":
+		for _, v := range strings.Split(f[1], ",") {
+			code, ok := tlsAlerts[strings.ToLower(v)]
+			switch {
+			case v == "*":
+				code = -1
+			case !ok:
+				if code, err = strconv.Atoi(v); err != nil {
+					return errors.New("Unknown alert: " + v)
+				}
+			}
+			ru.alerts = append(ru.alerts, code)
+		}
+	case "issuer":
+		for _, v := range strings.Split(f[1], ",") {
+			if v == "intercepted" {
+				ru.issuers = append(ru.issuers, interceptors...)
+			} else {
+				ru.issuers = append(ru.issuers, globRegexp(v))
+			}
+		}
+	case "expect":
+		ru.expect = globRegexps(strings.Split(f[1], ","))
+	default:
+		return errors.New("Unknown condition: " + kv)
+	}
+	return nil
+}
+
+// globRegexp returns the regular expression of the pattern with * as any
+// characters, ignoring case.
+func globRegexp(pattern string) *regexp.Regexp {
+	s := strings.Replace(regexp.QuoteMeta(pattern), `\*`, ".*", -1)
+	return regexp.MustCompile("(?i)^" + s + "$")
+}
+
+func globRegexps(patterns []string) []*regexp.Regexp {
+	var res []*regexp.Regexp
+	for _, v := range patterns {
+		res = append(res, globRegexp(v))
+	}
+	return res
+}
+
+// matchAny reports whether any of names matches any of res.
+func matchAny(res []*regexp.Regexp, names []string) bool {
+	for _, re := range res {
+		for _, v := range names {
+			if re.MatchString(v) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchHost reports whether the host of req is one of ru.
+func (ru *rule) matchHost(req *http.Request) bool {
+	return ru.hosts == nil || matchAny(ru.hosts, []string{req.URL.Hostname()})
+}
+
+// isCert reports whether ru is of the certificates of TLS.
+func (ru *rule) isCert() bool {
+	return ru.issuers != nil || ru.expect != nil
+}
+
+// matchHTTP reports whether resp of req matches ru. The body is only read if
+// the others match, it is read by body.
+func (ru *rule) matchHTTP(req *http.Request, resp *http.Response, body func() []byte) bool {
+	if ru.alerts != nil || ru.isCert() || !ru.matchHost(req) {
+		return false
+	}
+	if ru.status != nil {
+		ok := false
+		for _, r := range ru.status {
+			ok = ok || r[0] <= resp.StatusCode && resp.StatusCode <= r[1]
+		}
+		if !ok {
+			return false
+		}
+	}
+	if ru.location != nil {
+		u, err := url.Parse(resp.Header.Get("Location"))
+		if err != nil || u.Host == "" || !ru.location.MatchString(u.Hostname()) {
+			return false
+		}
+	}
+	for _, h := range ru.headers {
+		ok := false
+		for _, v := range resp.Header[http.CanonicalHeaderKey(h.key)] {
+			ok = ok || h.value.MatchString(v)
+		}
+		if !ok {
+			return false
+		}
+	}
+	return ru.body == nil || ru.body.Match(body())
+}
+
+// matchAlert reports whether the TLS alert of code to req matches ru.
+func (ru *rule) matchAlert(req *http.Request, code int) bool {
+	if !ru.matchHost(req) {
+		return false
+	}
+	for _, v := range ru.alerts {
+		if v == -1 || v == code {
+			return true
+		}
+	}
+	return false
+}
+
+// matchCert reports whether the issuers of chain match ru.
+func (ru *rule) matchCert(chain []*x509.Certificate) bool {
+	names := issuers(chain)
+	if ru.issuers != nil && !matchAny(ru.issuers, names) {
+		return false
+	}
+	return ru.expect == nil || !matchAny(ru.expect, names)
+}
+
+// issuers returns the names of the issuers in chain, the common names and
+// the organizations.
+func issuers(chain []*x509.Certificate) []string {
+	var names []string
+	for _, c := range chain {
+		names = append(names, c.Issuer.CommonName)
+		names = append(names, c.Issuer.Organization...)
+	}
+	return names
+}
+
+// ValidHTTP returns the error if resp of req matches a rule. The body checked
+// is kept in resp.
+func (rs *Rules) ValidHTTP(req *http.Request, resp *http.Response) error {
+	var b []byte
+	read := false
+	body := func() []byte {
+		// the body of switching protocols is the stream of the new protocol
+		if !read && resp.StatusCode != http.StatusSwitchingProtocols {
+			read = true
+			b, _ = ioutil.ReadAll(io.LimitReader(resp.Body, maxBodyCheck))
+			resp.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(b), resp.Body), resp.Body}
+		}
+		return b
+	}
+	for _, ru := range rs.rules {
+		if ru.matchHTTP(req, resp, body) {
+			log.Print("Blocked by rule " + ru.name + ": " + req.Host)
+			return &blockError{rule: ru.name}
+		}
+	}
+	return nil
+}
+
+// validCerts checks the certificates in the reply of TLS by the rules.
+func (rs *Rules) validCerts(req *http.Request, reply []byte) error {
+	der, tls13, _ := parseServerFlight(reply)
+	var chain []*x509.Certificate
+	for _, b := range der {
+		if c, err := x509.ParseCertificate(b); err == nil {
+			chain = append(chain, c)
+		}
+	}
+	probed := false
+	for _, ru := range rs.rules {
+		if !ru.isCert() || !ru.matchHost(req) {
+			continue
+		}
+		if chain == nil && tls13 && rs.Dial != nil && !probed {
+			probed = true
+			chain = rs.probeCerts(req)
+		}
+		if chain != nil && ru.matchCert(chain) {
+			log.Print("Blocked by rule " + ru.name + ": " + req.Host)
+			return &blockError{rule: ru.name}
+		}
+	}
+	if matchAny(interceptors, issuers(chain)) {
+		log.Print("TLS of " + req.Host + " is intercepted by " + chain[0].Issuer.String())
+	}
+	if chain != nil && !tls13 {
+		// the proxy may intercept with a CA the client does not trust
+		return rs.verify(req, chain)
+	}
+	return nil
+}
+
+// verify checks chain of the host of req against Roots.
+func (rs *Rules) verify(req *http.Request, chain []*x509.Certificate) error {
+	opts := x509.VerifyOptions{
+		DNSName:       req.URL.Hostname(),
+		Roots:         rs.Roots,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, c := range chain[1:] {
+		opts.Intermediates.AddCert(c)
+	}
+	if _, err := chain[0].Verify(opts); err != nil {
+		return errors.New("Invalid certificate: " + err.Error())
+	}
+	return nil
+}
+
+// probeCerts returns the certificates of the host of req by a handshake
+// through Dial, or nil. They are kept for certsTTL, so a host is not dialed
+// twice for every CONNECT.
+func (rs *Rules) probeCerts(req *http.Request) []*x509.Certificate {
+	host := req.URL.Host
+	rs.lock.Lock()
+	p, ok := rs.certs[host]
+	rs.lock.Unlock()
+	if ok && time.Since(p.time) < certsTTL {
+		return p.chain
+	}
+
+	chain := rs.handshake(req)
+	rs.lock.Lock()
+	if rs.certs == nil {
+		rs.certs = make(map[string]probedCerts)
+	}
+	rs.certs[host] = probedCerts{chain: chain, time: time.Now()}
+	rs.lock.Unlock()
+	return chain
+}
+
+// handshake returns the certificates of the host of req by a handshake
+// through Dial, or nil.
+func (rs *Rules) handshake(req *http.Request) []*x509.Certificate {
+	c, err := rs.Dial(req.URL.Host)
+	if err != nil {
+		return nil
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(replyTimeout))
+	// The certificates are only inspected, nothing is sent
+	tc := tls.Client(c, &tls.Config{ServerName: req.URL.Hostname(), InsecureSkipVerify: true})
+	if err := tc.Handshake(); err != nil {
+		return nil
+	}
+	return tc.ConnectionState().PeerCertificates
+}
+
+// ValidConnect checks the reply of the host to the ClientHello. A proxy
+// blocking the host replies an alert, or a page of http, rather than the
+// ServerHello. The alerts, pages and certificates are checked by the rules.
+// Other protocols are not checked.
+func (rs *Rules) ValidConnect(req *http.Request, hello, reply []byte) error {
+	if len(hello) == 0 || hello[0] != recordHandshake {
+		return nil
+	}
+	switch {
+	case len(reply) == 0:
+		return errors.New("No reply of TLS")
+	case len(reply) > 5 && reply[0] == recordHandshake && reply[5] == typeServerHello:
+		return rs.validCerts(req, reply)
+	case len(reply) >= 7 && reply[0] == recordAlert:
+		for _, ru := range rs.rules {
+			if ru.matchAlert(req, int(reply[6])) {
+				log.Print("Blocked by rule " + ru.name + ": " + req.Host)
+				return &blockError{rule: ru.name}
+			}
+		}
+		return nil
+	case bytes.HasPrefix(reply, []byte("HTTP/")):
+		if resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(reply)), req); err == nil {
+			err = rs.ValidHTTP(req, resp)
+			resp.Body.Close()
+			if err != nil {
+				return err
+			}
+		}
+		return errors.New("Not TLS: " + strings.SplitN(string(reply), "\r\n", 2)[0])
+	}
+	return errors.New("Invalid reply of TLS")
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidConnect(t *testing.T) {
+	rules, _ := LoadRules("")
+	req := httptest.NewRequest("CONNECT", "example.com:443", nil)
+	ts := httptest.NewTLSServer(nil)
+	defer ts.Close()
+	blocked := listen(t, func(c net.Conn) {
+		c.Write([]byte("HTTP/1.1 403 Forbidden\r\nContent-Length: 0\r\n\r\n"))
+		c.Close()
+	})
+
+	for _, v := range []struct {
+		addr  string
+		valid bool
+	}{
+		{ts.Listener.Addr().String(), true},
+		{blocked, false},
+	} {
+		// take the ClientHello of a real client
+		c, s := net.Pipe()
+		go tls.Client(c, &tls.Config{ServerName: "example.com"}).Handshake()
+		hello, err := readFirst(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Close()
+
+		remote, err := net.Dial("tcp", v.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reply, err := exchange(remote, hello)
+		remote.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := rules.ValidConnect(req, hello, reply); (err == nil) != v.valid {
+			t.Errorf("%s: %v", v.addr, err)
+		}
+	}
+	if err := rules.ValidConnect(req, []byte("GET / HTTP/1.1\r\n"), []byte("anything")); err != nil {
+		t.Errorf("not TLS is checked: %v", err)
+	}
+}
+
+func TestRules(t *testing.T) {
+	rules, err := ReadRules(strings.NewReader(`
+# block pages of the proxies
+zscaler	status=403	header=Server:Zscaler*
+bluecoat	status=200-299	body=(?i)access\sdenied
+fortinet	location=*.fortinet.net
+denied	alert=access_denied,112
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", "http://example.com/", nil)
+	for _, v := range []struct {
+		resp string
+		rule string
+	}{
+		{"HTTP/1.1 403 Forbidden\r\nServer: Zscaler/6.1\r\nContent-Length: 0\r\n\r\n", "zscaler"},
+		{"HTTP/1.1 403 Forbidden\r\nServer: nginx\r\nContent-Length: 0\r\n\r\n", ""},
+		{"HTTP/1.1 200 OK\r\nContent-Length: 22\r\n\r\n<h1>Access Denied</h1>", "bluecoat"},
+		{"HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello", ""},
+		{"HTTP/1.1 302 Found\r\nLocation: https://block.fortinet.net/x\r\nContent-Length: 0\r\n\r\n", "fortinet"},
+	} {
+		resp, err := http.ReadResponse(bufio.NewReader(strings.NewReader(v.resp)), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = rules.ValidHTTP(req, resp)
+		var e *blockError
+		if errors.As(err, &e) != (v.rule != "") || e != nil && e.rule != v.rule {
+			t.Errorf("%q: %v", v.resp, err)
+		}
+		// the body checked is kept
+		if b, _ := ioutil.ReadAll(resp.Body); !strings.HasSuffix(v.resp, "\r\n\r\n"+string(b)) {
+			t.Errorf("body %q", b)
+		}
+	}
+
+	hello := []byte{recordHandshake, 3, 1, 0, 1, 1}
+	for code, valid := range map[byte]bool{49: false, 112: false, 40: true} {
+		if err := rules.ValidConnect(req, hello, []byte{recordAlert, 3, 3, 0, 2, 2, code}); (err == nil) != valid {
+			t.Errorf("alert %d: %v", code, err)
+		}
+	}
+	// the page replied to the ClientHello is checked by the rules
+	err = rules.ValidConnect(req, hello, []byte("HTTP/1.1 403 Forbidden\r\nServer: Zscaler\r\n\r\n"))
+	if err == nil || err.Error() != "Blocked by rule zscaler" {
+		t.Errorf("page: %v", err)
+	}
+
+	for _, v := range []string{"x status=abc", "x alert=nope", "x color=red", "x", "x issuer=intercepted"} {
+		if _, err := ReadRules(strings.NewReader(v)); err == nil {
+			t.Errorf("%q is accepted", v)
+		}
+	}
+}
+
+// testRoots has the CAs of tlsServer.
+var testRoots = x509.NewCertPool()
+
+// tlsServer listens TLS up to version max, with a certificate issued by a CA
+// named issuer, which is added to testRoots.
+func tlsServer(t *testing.T, issuer string, max uint16) string {
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: issuer},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	leaf := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		DNSNames:     []string{"example.com", "*.example.com", "*.example.org", "*.bank.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, ca, ca, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ca, err = x509.ParseCertificate(caDER); err != nil {
+		t.Fatal(err)
+	}
+	testRoots.AddCert(ca)
+	der, err := x509.CreateCertificate(rand.Reader, leaf, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		MaxVersion:   max,
+	}
+	return listen(t, func(c net.Conn) {
+		tls.Server(c, cfg).Handshake()
+		c.Close()
+	})
+}
+
+func TestCertRules(t *testing.T) {
+	rules, err := ReadRules(strings.NewReader(`
+inspected	host=*.bank.com	issuer=intercepted
+pinned	host=*.example.org	expect=Public*
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules.Roots = testRoots
+	zscaler12 := tlsServer(t, "Zscaler Intermediate Root CA", tls.VersionTLS12)
+	zscaler13 := tlsServer(t, "Zscaler Intermediate Root CA", tls.VersionTLS13)
+	public12 := tlsServer(t, "Public Root CA", tls.VersionTLS12)
+
+	check := func(addr, host string) error {
+		c, s := net.Pipe()
+		go tls.Client(c, &tls.Config{ServerName: host}).Handshake()
+		hello, err := readFirst(s)
+		s.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		remote, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer remote.Close()
+		reply, err := exchange(remote, hello)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rules.ValidConnect(httptest.NewRequest("CONNECT", host+":443", nil), hello, reply)
+	}
+	for _, v := range []struct {
+		addr, host, rule string
+	}{
+		{zscaler12, "www.bank.com", "inspected"},
+		{zscaler12, "www.example.com", ""},
+		{public12, "www.example.org", ""},
+		{zscaler12, "www.example.org", "pinned"},
+		// the certificates of TLS 1.3 are not seen without Dial
+		{zscaler13, "www.bank.com", ""},
+	} {
+		err := check(v.addr, v.host)
+		if v.rule == "" && err != nil || v.rule != "" && (err == nil || err.Error() != "Blocked by rule "+v.rule) {
+			t.Errorf("%s: %v", v.host, err)
+		}
+	}
+
+	// the certificates of TLS 1.2 are verified
+	if err := check(public12, "www.other.net"); err == nil || !strings.HasPrefix(err.Error(), "Invalid certificate") {
+		t.Errorf("wrong host: %v", err)
+	}
+	rules.Roots = x509.NewCertPool()
+	if err := check(public12, "www.example.org"); err == nil || !strings.HasPrefix(err.Error(), "Invalid certificate") {
+		t.Errorf("untrusted CA: %v", err)
+	}
+	rules.Roots = testRoots
+
+	dials := 0
+	rules.Dial = func(addr string) (net.Conn, error) {
+		dials++
+		return net.Dial("tcp", zscaler13)
+	}
+	for i := 0; i < 2; i++ {
+		if err := check(zscaler13, "www.bank.com"); err == nil {
+			t.Error("TLS 1.3 is not probed")
+		}
+	}
+	// the certificates probed are kept, the hosts of no rule are not probed
+	if err := check(zscaler13, "www.example.com"); err != nil {
+		t.Error(err)
+	}
+	if dials != 1 {
+		t.Errorf("%d probes", dials)
+	}
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/ramuchu/fetch"
+)
+
+// Constants of SOCKS5, see RFC 1928 and RFC 1929 (username/password).
+const (
+	socksVersion = 0x05
+
+	socksAuthNone         = 0x00
+	socksAuthPassword     = 0x02
+	socksAuthNoAcceptable = 0xff
+
+	socksPasswordVersion = 0x01
+
+	socksCmdConnect = 0x01
+	socksCmdUDP     = 0x03
+
+	socksRepSucceeded           = 0x00
+	socksRepGeneralFailure      = 0x01
+	socksRepNotAllowed          = 0x02
+	socksRepHostUnreachable     = 0x04
+	socksRepCommandNotSupported = 0x07
+	socksRepAddrNotSupported    = 0x08
+)
+
+var errSocksVersion = errors.New("Unsupported SOCKS version")
+var errSocksAuth = errors.New("SOCKS authentication failed")
+
+// SocksServer accepts SOCKS5 clients and passes their requests to Handler.
+//
+// Every CONNECT is turned into a http CONNECT request, so it is routed in the
+// same way as the http proxy: direct, remote, or block.
+type SocksServer struct {
+	Handler http.Handler
+	// Auth checks the username and password sent by the client.
+	// If it is nil, no authentication is required.
+	Auth func(user, password string) bool
+	// Datagram opens a tunnel in datagram mode for UDP ASSOCIATE.
+	// If it is nil, UDP ASSOCIATE is not supported.
+	Datagram func() (net.Conn, error)
+}
+
+// PasswordAuth returns an Auth accepting userPassword, as user:password. The
+// user ends at the first colon, the password may contain colons.
+func PasswordAuth(userPassword string) func(user, password string) bool {
+	wantUser, wantPassword := userPassword, ""
+	if i := strings.IndexByte(userPassword, ':'); i >= 0 {
+		wantUser, wantPassword = userPassword[:i], userPassword[i+1:]
+	}
+	return func(user, password string) bool {
+		// Both are compared, so the time does not tell which one is wrong
+		u := subtle.ConstantTimeCompare([]byte(user), []byte(wantUser))
+		p := subtle.ConstantTimeCompare([]byte(password), []byte(wantPassword))
+		return u&p == 1
+	}
+}
+
+// ListenAndServe listens on the TCP address addr and then calls Serve.
+func (s *SocksServer) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts connections on l, and serves each of them in a new goroutine.
+func (s *SocksServer) Serve(l net.Listener) error {
+	defer l.Close()
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serveConn(c)
+	}
+}
+
+func (s *SocksServer) serveConn(c net.Conn) {
+	if err := s.handshake(c); err != nil {
+		log.Print("SOCKS handshake: " + err.Error())
+		c.Close()
+		return
+	}
+
+	// VER CMD RSV
+	var hdr [3]byte
+	if _, err := io.ReadFull(c, hdr[:]); err != nil {
+		c.Close()
+		return
+	}
+	if hdr[0] != socksVersion {
+		c.Close()
+		return
+	}
+	addr, err := fetch.ReadAddr(c)
+	if err != nil {
+		writeSocksReply(c, socksRepAddrNotSupported, nil)
+		c.Close()
+		return
+	}
+
+	switch hdr[1] {
+	case socksCmdConnect:
+		s.serveConnect(c, addr)
+	case socksCmdUDP:
+		if s.Datagram == nil {
+			writeSocksReply(c, socksRepCommandNotSupported, nil)
+			c.Close()
+			return
+		}
+		s.serveUDP(c, addr)
+	default:
+		writeSocksReply(c, socksRepCommandNotSupported, nil)
+		c.Close()
+	}
+}
+
+// handshake negotiates the authentication method with the client.
+func (s *SocksServer) handshake(c net.Conn) error {
+	// VER NMETHODS METHODS
+	var hdr [2]byte
+	if _, err := io.ReadFull(c, hdr[:]); err != nil {
+		return err
+	}
+	if hdr[0] != socksVersion {
+		return errSocksVersion
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(c, methods); err != nil {
+		return err
+	}
+
+	want := byte(socksAuthNone)
+	if s.Auth != nil {
+		want = socksAuthPassword
+	}
+	if bytes.IndexByte(methods, want) < 0 {
+		c.Write([]byte{socksVersion, socksAuthNoAcceptable})
+		return errors.New("No acceptable authentication method")
+	}
+	if _, err := c.Write([]byte{socksVersion, want}); err != nil {
+		return err
+	}
+	if want == socksAuthNone {
+		return nil
+	}
+
+	// VER ULEN UNAME PLEN PASSWD
+	if _, err := io.ReadFull(c, hdr[:]); err != nil {
+		return err
+	}
+	if hdr[0] != socksPasswordVersion {
+		return errSocksVersion
+	}
+	user := make([]byte, hdr[1])
+	if _, err := io.ReadFull(c, user); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(c, hdr[1:]); err != nil {
+		return err
+	}
+	password := make([]byte, hdr[1])
+	if _, err := io.ReadFull(c, password); err != nil {
+		return err
+	}
+	if !s.Auth(string(user), string(password)) {
+		c.Write([]byte{socksPasswordVersion, 0x01})
+		return errSocksAuth
+	}
+	_, err := c.Write([]byte{socksPasswordVersion, 0x00})
+	return err
+}
+
+// serveConnect passes the CONNECT to Handler as if it came from a http client.
+func (s *SocksServer) serveConnect(c net.Conn, addr string) {
+	r := &http.Request{
+		Method:     "CONNECT",
+		URL:        &url.URL{Host: addr},
+		Host:       addr,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+		RemoteAddr: c.RemoteAddr().String(),
+	}
+	w := &socksResponse{conn: c, header: http.Header{}}
+	s.Handler.ServeHTTP(w, r)
+	if !w.hijacked {
+		// the handler refused it without writing anything
+		if !w.replied {
+			writeSocksReply(c, socksRepGeneralFailure, nil)
+		}
+		c.Close()
+	}
+}
+
+// serveUDP relays the datagrams of the client through a tunnel until c is closed.
+// addr is where the client will send from, it may be empty (0.0.0.0:0).
+func (s *SocksServer) serveUDP(c net.Conn, addr string) {
+	defer c.Close()
+
+	local := c.LocalAddr().(*net.TCPAddr)
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: local.IP, Zone: local.Zone})
+	if err != nil {
+		writeSocksReply(c, socksRepGeneralFailure, nil)
+		return
+	}
+	defer pc.Close()
+
+	tunnel, err := s.Datagram()
+	if err != nil {
+		log.Print("SOCKS UDP: " + err.Error())
+		writeSocksReply(c, socksRepGeneralFailure, nil)
+		return
+	}
+	defer tunnel.Close()
+
+	if err := writeSocksReply(c, socksRepSucceeded, pc.LocalAddr()); err != nil {
+		return
+	}
+
+	var clientIP net.IP
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		if ip := net.ParseIP(host); ip != nil && !ip.IsUnspecified() {
+			clientIP = ip
+		}
+	}
+	u := &socksUDP{pc: pc, tunnel: tunnel, clientIP: clientIP}
+	go u.up()
+	go u.down()
+
+	// The association ends when the control connection is closed.
+	io.Copy(ioutil.Discard, c)
+}
+
+// socksUDP relays a SOCKS UDP association, see section 7 of RFC 1928.
+type socksUDP struct {
+	pc       *net.UDPConn
+	tunnel   net.Conn
+	clientIP net.IP
+
+	lock   sync.Mutex
+	client *net.UDPAddr
+}
+
+// up reads the packets from the client, and sends them to the tunnel.
+func (u *socksUDP) up() {
+	b := make([]byte, fetch.MaxDatagram)
+	for {
+		n, from, err := u.pc.ReadFromUDP(b)
+		if err != nil {
+			u.tunnel.Close()
+			return
+		}
+		if u.clientIP != nil && !u.clientIP.Equal(from.IP) {
+			continue
+		}
+		// RSV(2) FRAG(1) ATYP DST.ADDR DST.PORT DATA, fragments are not supported
+		if n < 4 || b[2] != 0 {
+			continue
+		}
+		r := bytes.NewReader(b[3:n])
+		addr, err := fetch.ReadAddr(r)
+		if err != nil {
+			continue
+		}
+
+		u.lock.Lock()
+		u.client = from
+		u.lock.Unlock()
+
+		if err := fetch.WriteDatagram(u.tunnel, addr, b[n-r.Len():n]); err != nil {
+			u.pc.Close()
+			return
+		}
+	}
+}
+
+// down reads the packets from the tunnel, and sends them to the client.
+func (u *socksUDP) down() {
+	b := make([]byte, fetch.MaxDatagram)
+	out := make([]byte, 0, fetch.MaxDatagram+262)
+	for {
+		n, addr, err := fetch.ReadDatagram(u.tunnel, b)
+		if err != nil {
+			u.pc.Close()
+			return
+		}
+
+		u.lock.Lock()
+		client := u.client
+		u.lock.Unlock()
+		if client == nil {
+			continue
+		}
+
+		out = fetch.AppendAddr(append(out[:0], 0, 0, 0), addr)
+		out = append(out, b[:n]...)
+		u.pc.WriteToUDP(out, client)
+	}
+}
+
+func writeSocksReply(w io.Writer, rep byte, bound net.Addr) error {
+	var addr string
+	if bound != nil {
+		addr = bound.String()
+	}
+	b := fetch.AppendAddr([]byte{socksVersion, rep, 0x00}, addr)
+	_, err := w.Write(b)
+	return err
+}
+
+// socksRep translates the http status code to SOCKS reply.
+func socksRep(code int) byte {
+	switch {
+	case code >= 200 && code < 300:
+		return socksRepSucceeded
+	case code == http.StatusForbidden:
+		return socksRepNotAllowed
+	case code == http.StatusBadGateway, code == http.StatusGatewayTimeout:
+		return socksRepHostUnreachable
+	}
+	return socksRepGeneralFailure
+}
+
+// socksResponse adapts a SOCKS client to http.ResponseWriter, so the handlers
+// for http CONNECT can serve it.
+//
+// The status of the response, either written by WriteHeader or the http
+// response written to the hijacked conn, is translated to the SOCKS reply.
+type socksResponse struct {
+	conn     net.Conn
+	header   http.Header
+	replied  bool
+	hijacked bool
+}
+
+func (w *socksResponse) Header() http.Header {
+	return w.header
+}
+
+func (w *socksResponse) WriteHeader(code int) {
+	if w.replied {
+		return
+	}
+	w.replied = true
+	writeSocksReply(w.conn, socksRep(code), nil)
+}
+
+// Write discards the body, as SOCKS has no way to send it to client.
+func (w *socksResponse) Write(p []byte) (int, error) {
+	if !w.replied {
+		w.WriteHeader(http.StatusOK)
+	}
+	return len(p), nil
+}
+
+// Hijack implements http.Hijacker
+func (w *socksResponse) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if w.replied {
+		return nil, nil, errors.New("Response has been written")
+	}
+	w.hijacked = true
+	c := &socksConn{Conn: w.conn, w: w}
+	return c, bufio.NewReadWriter(bufio.NewReader(c), bufio.NewWriter(c)), nil
+}
+
+// socksConn reads the http response header written by the handler, sends
+// the SOCKS reply instead, and passes the rest through.
+type socksConn struct {
+	net.Conn
+	w   *socksResponse
+	buf []byte
+}
+
+func (c *socksConn) Write(p []byte) (int, error) {
+	if c.w.replied {
+		return c.Conn.Write(p)
+	}
+
+	c.buf = append(c.buf, p...)
+	i := bytes.Index(c.buf, []byte("\r\n\r\n"))
+	if i < 0 {
+		if len(c.buf) > 4096 {
+			c.w.WriteHeader(http.StatusBadGateway)
+			return 0, errors.New("Response header too long")
+		}
+		return len(p), nil
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(c.buf[:i+4])), nil)
+	if err != nil {
+		c.w.WriteHeader(http.StatusBadGateway)
+		return 0, err
+	}
+	c.w.WriteHeader(resp.StatusCode)
+	if socksRep(resp.StatusCode) != socksRepSucceeded {
+		return 0, errors.New("Failed to connect: " + resp.Status)
+	}
+
+	rest := c.buf[i+4:]
+	c.buf = nil
+	if len(rest) > 0 {
+		if _, err := c.Conn.Write(rest); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/ramuchu/fetch"
+)
+
+func startSocks(t *testing.T, s *SocksServer) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	return l.Addr().String()
+}
+
+// echoConnect accepts CONNECT to want, and echoes what the client sends.
+func echoConnect(t *testing.T, want string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "CONNECT" || r.Host != want || r.URL.Host != want {
+			t.Errorf("unexpected request: %s %s %s", r.Method, r.Host, r.URL.Host)
+			http.Error(w, "unexpected", http.StatusBadRequest)
+			return
+		}
+		c, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		go func() {
+			c.Write([]byte("HTTP/1.1 200 OK\r\n\r\n"))
+			io.Copy(c, c)
+			c.Close()
+		}()
+	})
+}
+
+func socksDial(t *testing.T, addr string, auth []byte, req []byte) (net.Conn, byte) {
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	method := byte(socksAuthNone)
+	if auth != nil {
+		method = socksAuthPassword
+	}
+	c.Write([]byte{socksVersion, 1, method})
+	b := make([]byte, 2)
+	if _, err := io.ReadFull(c, b); err != nil {
+		t.Fatal(err)
+	}
+	if b[1] != method {
+		c.Close()
+		return nil, b[1]
+	}
+	if auth != nil {
+		c.Write(auth)
+		if _, err := io.ReadFull(c, b); err != nil {
+			t.Fatal(err)
+		}
+		if b[1] != 0 {
+			c.Close()
+			return nil, b[1]
+		}
+	}
+
+	c.Write(req)
+	b = make([]byte, 3)
+	if _, err := io.ReadFull(c, b); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fetch.ReadAddr(c); err != nil {
+		t.Fatal(err)
+	}
+	return c, b[1]
+}
+
+func TestSocksConnect(t *testing.T) {
+	for _, v := range []struct {
+		addr string
+		req  []byte
+	}{
+		{"example.com:443", []byte{5, 1, 0, 3, 11, 'e', 'x', 'a', 'm', 'p', 'l', 'e', '.', 'c', 'o', 'm', 1, 187}},
+		{"10.1.2.3:22", []byte{5, 1, 0, 1, 10, 1, 2, 3, 0, 22}},
+		{"[::1]:8080", []byte{5, 1, 0, 4, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x1f, 0x90}},
+	} {
+		addr := startSocks(t, &SocksServer{Handler: echoConnect(t, v.addr)})
+		c, rep := socksDial(t, addr, nil, v.req)
+		if rep != socksRepSucceeded {
+			t.Fatalf("%s: reply %d", v.addr, rep)
+		}
+		msg := []byte("hello " + v.addr)
+		c.Write(msg)
+		b := make([]byte, len(msg))
+		if _, err := io.ReadFull(c, b); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, msg) {
+			t.Fatalf("%s: echo %q", v.addr, b)
+		}
+		c.Close()
+	}
+}
+
+func TestSocksAuth(t *testing.T) {
+	s := &SocksServer{
+		Handler: echoConnect(t, "example.com:443"),
+		Auth: func(user, password string) bool {
+			return user == "user" && password == "pass"
+		},
+	}
+	addr := startSocks(t, s)
+	req := []byte{5, 1, 0, 3, 11, 'e', 'x', 'a', 'm', 'p', 'l', 'e', '.', 'c', 'o', 'm', 1, 187}
+
+	if c, rep := socksDial(t, addr, nil, req); c != nil || rep != socksAuthNoAcceptable {
+		t.Fatalf("no auth: reply %d", rep)
+	}
+	if c, rep := socksDial(t, addr, []byte{1, 4, 'u', 's', 'e', 'r', 4, 'b', 'a', 'd', '!'}, req); c != nil || rep == 0 {
+		t.Fatalf("wrong password: reply %d", rep)
+	}
+	c, rep := socksDial(t, addr, []byte{1, 4, 'u', 's', 'e', 'r', 4, 'p', 'a', 's', 's'}, req)
+	if rep != socksRepSucceeded {
+		t.Fatalf("reply %d", rep)
+	}
+	c.Close()
+}
+
+func TestPasswordAuth(t *testing.T) {
+	auth := PasswordAuth("user:pa:ss")
+	for _, v := range []struct {
+		user, password string
+		ok             bool
+	}{
+		{"user", "pa:ss", true},
+		{"user:pa", "ss", false},
+		{"user", "pa:s", false},
+		{"", "", false},
+	} {
+		if auth(v.user, v.password) != v.ok {
+			t.Fatalf("%q %q: %v", v.user, v.password, !v.ok)
+		}
+	}
+}
+
+func TestSocksRefused(t *testing.T) {
+	req := []byte{5, 1, 0, 1, 10, 1, 2, 3, 0, 22}
+	for _, v := range []struct {
+		h   http.Handler
+		rep byte
+	}{
+		{http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		}), socksRepNotAllowed},
+		{http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			c, _, _ := w.(http.Hijacker).Hijack()
+			io.WriteString(c, "HTTP/1.1 502 Bad Gateway\r\nConnection: close\r\n\r\nfailed")
+			c.Close()
+		}), socksRepHostUnreachable},
+		{http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), socksRepGeneralFailure},
+	} {
+		addr := startSocks(t, &SocksServer{Handler: v.h})
+		c, rep := socksDial(t, addr, nil, req)
+		if rep != v.rep {
+			t.Fatalf("expect reply %d, see %d", v.rep, rep)
+		}
+		c.Close()
+	}
+
+	// unknown command
+	addr := startSocks(t, &SocksServer{Handler: echoConnect(t, "")})
+	c, rep := socksDial(t, addr, nil, []byte{5, 9, 0, 1, 10, 1, 2, 3, 0, 22})
+	if rep != socksRepCommandNotSupported {
+		t.Fatalf("reply %d", rep)
+	}
+	c.Close()
+}
+
+func TestSocksUDP(t *testing.T) {
+	// The tunnel echoes the datagrams back with the same address.
+	datagram := func() (net.Conn, error) {
+		c, s := net.Pipe()
+		go func() {
+			b := make([]byte, fetch.MaxDatagram)
+			for {
+				n, addr, err := fetch.ReadDatagram(s, b)
+				if err != nil {
+					s.Close()
+					return
+				}
+				fetch.WriteDatagram(s, addr, b[:n])
+			}
+		}()
+		return c, nil
+	}
+	addr := startSocks(t, &SocksServer{Handler: echoConnect(t, ""), Datagram: datagram})
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write([]byte{socksVersion, 1, socksAuthNone})
+	b := make([]byte, 3)
+	if _, err := io.ReadFull(c, b[:2]); err != nil {
+		t.Fatal(err)
+	}
+	c.Write([]byte{5, socksCmdUDP, 0, 1, 0, 0, 0, 0, 0, 0})
+	if _, err := io.ReadFull(c, b); err != nil {
+		t.Fatal(err)
+	}
+	if b[1] != socksRepSucceeded {
+		t.Fatalf("reply %d", b[1])
+	}
+	bound, err := fetch.ReadAddr(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := net.Dial("udp", bound)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.Close()
+	for _, dst := range []string{"8.8.8.8:53", "example.com:443"} {
+		msg := fetch.AppendAddr([]byte{0, 0, 0}, dst)
+		msg = append(msg, "hello "+dst...)
+		u.Write(msg)
+		b := make([]byte, 1024)
+		n, err := u.Read(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b[:n], msg) {
+			t.Fatalf("echo %q", b[:n])
+		}
+	}
+}
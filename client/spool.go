@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+)
+
+// spoolMemory is the size of a request body kept in memory, the rest is
+// written to a temp file.
+const spoolMemory = 1 << 20
+
+// spool keeps a request body, so it can be read again.
+type spool struct {
+	buf  []byte
+	file *os.File
+	size int64
+}
+
+// newSpool reads r up to limit bytes. complete is false if r is longer than
+// limit, then the rest is still in r.
+func newSpool(r io.Reader, limit int64) (s *spool, complete bool, err error) {
+	s = &spool{}
+	var buf bytes.Buffer
+	n, err := io.Copy(&buf, io.LimitReader(r, spoolMemory))
+	s.buf, s.size = buf.Bytes(), n
+	if err != nil {
+		return nil, false, err
+	}
+	if n == spoolMemory && s.size <= limit {
+		if s.file, err = ioutil.TempFile("", "fetch-body-"); err != nil {
+			return nil, false, err
+		}
+		n, err = io.Copy(s.file, io.LimitReader(r, limit-s.size+1))
+		s.size += n
+		if err != nil {
+			s.Close()
+			return nil, false, err
+		}
+	}
+	return s, s.size <= limit, nil
+}
+
+// Reader returns a new reader from the start of the body.
+func (s *spool) Reader() io.ReadCloser {
+	r := io.Reader(bytes.NewReader(s.buf))
+	if s.file != nil {
+		r = io.MultiReader(r, io.NewSectionReader(s.file, 0, s.size-int64(len(s.buf))))
+	}
+	return ioutil.NopCloser(r)
+}
+
+// Close removes the temp file.
+func (s *spool) Close() error {
+	if s.file == nil {
+		return nil
+	}
+	s.file.Close()
+	return os.Remove(s.file.Name())
+}
+
+// spoolBody makes the body of r replayable by r.GetBody, if it is not longer
+// than limit. Otherwise the body can be read only once, and GetBody is nil.
+// The returned spool must be closed after r is done.
+func spoolBody(r *http.Request, limit int64) (*spool, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, nil
+	}
+	s, complete, err := newSpool(r.Body, limit)
+	if err != nil {
+		return nil, err
+	}
+	if !complete {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(s.Reader(), r.Body), r.Body}
+		return s, nil
+	}
+	r.Body.Close()
+	r.Body = s.Reader()
+	r.GetBody = func() (io.ReadCloser, error) {
+		return s.Reader(), nil
+	}
+	return s, nil
+}
+
+// replayable reports whether the body of r can be sent again, and rewinds it.
+func replayable(r *http.Request) bool {
+	if r.Body == nil || r.Body == http.NoBody {
+		return true
+	}
+	if r.GetBody == nil {
+		return false
+	}
+	b, err := r.GetBody()
+	if err != nil {
+		return false
+	}
+	r.Body = b
+	return true
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestSpool(t *testing.T) {
+	for _, v := range []struct {
+		size, limit int
+		complete    bool
+	}{
+		{0, 10, true},
+		{10, 10, true},
+		{11, 10, false},
+		{spoolMemory + 10, spoolMemory + 10, true},
+		{spoolMemory + 11, spoolMemory + 10, false},
+		{spoolMemory * 2, 10, false},
+	} {
+		body := bytes.Repeat([]byte("0123456789"), v.size/10+1)[:v.size]
+		r := bytes.NewReader(body)
+		s, complete, err := newSpool(r, int64(v.limit))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if complete != v.complete {
+			t.Fatalf("%v: complete is %v", v, complete)
+		}
+		// read twice, with the rest not spooled
+		for i := 0; i < 2; i++ {
+			b, _ := ioutil.ReadAll(s.Reader())
+			rest, _ := ioutil.ReadAll(bytes.NewReader(body[len(b):]))
+			if !bytes.Equal(append(b, rest...), body) {
+				t.Fatalf("%v: wrong body", v)
+			}
+		}
+		if r.Len() != v.size-int(s.size) {
+			t.Fatalf("%v: read %d, spooled %d", v, v.size-r.Len(), s.size)
+		}
+		s.Close()
+	}
+}
+
+func TestFallbackBody(t *testing.T) {
+	// the direct route is blocked
+	blocked := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		http.Error(w, "blocked", http.StatusForbidden)
+	}))
+	defer blocked.Close()
+
+	p, err := NewNTLMProxy(blocked.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules, _ := LoadRules("")
+	p.ValidHTTP = rules.ValidHTTP
+	p.MaxReplay = 100
+	p.Fallback = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		w.Write(b)
+	})
+	ts := httptest.NewServer(p)
+	defer ts.Close()
+	pURL, _ := url.Parse(ts.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(pURL)}}
+
+	body := strings.Repeat("x", 100)
+	resp, err := client.Post("http://example.com/", "text/plain", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(b) != body {
+		t.Fatalf("Fallback gets %q", b)
+	}
+
+	resp, err = client.Post("http://example.com/", "text/plain", strings.NewReader(body+"x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("Large body falls back: %d", resp.StatusCode)
+	}
+}
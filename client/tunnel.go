@@ -1,9 +1,18 @@
 package main
 
 import (
+	"bufio"
+	"errors"
 	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ramuchu/fetch"
 )
 
 // LogHandler is an adapter which prints a log with prefix, the request method and host.
@@ -14,56 +23,215 @@ func LogHandler(prefix string, h http.Handler) http.Handler {
 	})
 }
 
+// maxIdleTunnels is the maximum number of keep-alive tunnels waiting for requests.
+const maxIdleTunnels = 8
+
+// idleTunnelTimeout is how long a keep-alive tunnel can wait for next request.
+var idleTunnelTimeout = 60 * time.Second
+
 // Tunnel returns a http.Handler, that whenever a request comes from client, it
 // will create a conn from pool, and copy what they send and receive to each
 // other.
 //
 // Tunnel serve as a middle man between client and remote side. From client
 // point of view, it looks like it talks to the remote side.
-func Tunnel(pool funcConn) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		conn, err := pool()
+//
+// The tunnels of plain http requests are kept alive, and reused by the next
+// requests, so they do not pay for a new websocket every time.
+func Tunnel(pool ConnPool) http.Handler {
+	return &tunnel{pool: pool}
+}
+
+type tunnel struct {
+	pool ConnPool
+
+	lock sync.Mutex
+	idle []*idleTunnel
+}
+
+// idleTunnel is a keep-alive tunnel with its buffered reader.
+type idleTunnel struct {
+	net.Conn
+	br    *bufio.Reader
+	since time.Time
+}
+
+func (t *tunnel) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "CONNECT" {
+		t.serveConnect(w, r)
+		return
+	}
+
+	// The connection of client is not the tunnel
+	protocol := fetch.Upgrade(r.Header)
+	fetch.RemoveHopHeaders(r.Header)
+	fetch.SetUpgrade(r.Header, protocol)
+	r.Close = false
+
+	// A reused tunnel may have been closed by the remote side. Try again
+	// with a new one, if the request can be sent again.
+	for {
+		conn, reused, err := t.get()
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		//{
-		//	if b, err := httputil.DumpRequest(r, false); err == nil {
-		//		fmt.Printf("%s\n", b)
-		//	}
-		//}
-
-		//fmt.Fprintln(conn, "Received", r.URL.Path)
-		hj, ok := w.(http.Hijacker)
-		if !ok {
-			panic("CANNOT hijack")
+		var resp *http.Response
+		if err = r.Write(conn); err == nil {
+			resp, err = http.ReadResponse(conn.br, r)
 		}
-		c, _, err := hj.Hijack()
 		if err != nil {
-			panic(err)
+			conn.Close()
+			if reused && replayable(r) {
+				continue
+			}
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
 		}
 
-		//mw := io.MultiWriter(conn, os.Stdout)
-		// send out the request
-		if r.Method == "CONNECT" {
-			go func() {
-				r.Write(conn)
-				//io.Copy(conn, io.TeeReader(c, os.Stdout))
-				io.Copy(conn, c)
-				conn.Close()
-			}()
-			//io.Copy(io.MultiWriter(c, os.Stdout), conn)
-			io.Copy(c, conn)
-			c.Close()
+		if resp.StatusCode == http.StatusSwitchingProtocols {
+			// the tunnel is piped to client from now on
+			resp.Body = &bufConn{Conn: conn.Conn, r: conn.br}
+			pushResponse(w, resp)
 			return
 		}
 
-		go r.Write(conn)
+		keepAlive := !resp.Close
+		if err := pushResponse(w, resp); err != nil || !keepAlive {
+			conn.Close()
+			return
+		}
+		t.put(conn)
+		return
+	}
+}
+
+func (t *tunnel) serveConnect(w http.ResponseWriter, r *http.Request) {
+	conn, err := t.pool.Get()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	//{
+	//	if b, err := httputil.DumpRequest(r, false); err == nil {
+	//		fmt.Printf("%s\n", b)
+	//	}
+	//}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		panic("CANNOT hijack")
+	}
+	c, _, err := hj.Hijack()
+	if err != nil {
+		panic(err)
+	}
 
-		io.Copy(c, conn)
-		//io.Copy(conn, c)
-		c.Close()
+	// send out the request
+	go func() {
+		r.Write(conn)
+		//io.Copy(conn, io.TeeReader(c, os.Stdout))
+		io.Copy(conn, c)
 		conn.Close()
-	})
+	}()
+	//io.Copy(io.MultiWriter(c, os.Stdout), conn)
+	io.Copy(c, conn)
+	c.Close()
+}
+
+// get returns an idle tunnel, or a new one from pool.
+func (t *tunnel) get() (conn *idleTunnel, reused bool, err error) {
+	t.lock.Lock()
+	for len(t.idle) > 0 {
+		n := len(t.idle) - 1
+		conn = t.idle[n]
+		t.idle = t.idle[:n]
+		if time.Since(conn.since) < idleTunnelTimeout {
+			t.lock.Unlock()
+			return conn, true, nil
+		}
+		conn.Close()
+	}
+	t.lock.Unlock()
+
+	c, err := t.pool.Get()
+	if err != nil {
+		return nil, false, err
+	}
+	return &idleTunnel{Conn: c, br: bufio.NewReader(c)}, false, nil
+}
+
+// put keeps conn for the next request.
+func (t *tunnel) put(conn *idleTunnel) {
+	conn.since = time.Now()
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if len(t.idle) >= maxIdleTunnels {
+		t.idle[0].Close()
+		t.idle = append(t.idle[:0], t.idle[1:]...)
+	}
+	t.idle = append(t.idle, conn)
+}
+
+// ModeDialer returns a function that opens a tunnel from pool, and switches
+// it to the mode of method, e.g. fetch.MethodDatagram.
+func ModeDialer(pool ConnPool, method string) func() (net.Conn, error) {
+	return func() (net.Conn, error) {
+		return openTunnel(pool, &http.Request{
+			Method: method,
+			URL:    &url.URL{Path: "/"},
+			Host:   strings.ToLower(method),
+			Header: http.Header{},
+		})
+	}
+}
+
+// ConnectDialer returns a function that opens a tunnel from pool to addr by
+// CONNECT.
+func ConnectDialer(pool ConnPool) func(addr string) (net.Conn, error) {
+	return func(addr string) (net.Conn, error) {
+		return openTunnel(pool, &http.Request{
+			Method: "CONNECT",
+			URL:    &url.URL{Host: addr},
+			Host:   addr,
+			Header: http.Header{},
+		})
+	}
+}
+
+// openTunnel opens a tunnel from pool, and sends req, which the remote server
+// accepts by 200.
+func openTunnel(pool ConnPool, req *http.Request) (net.Conn, error) {
+	conn, err := pool.Get()
+	if err != nil {
+		return nil, err
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	// The body is not closed, as it lasts until the tunnel is closed.
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, errors.New(req.Method + " refused: " + resp.Status)
+	}
+	return &bufConn{Conn: conn, r: br}, nil
+}
+
+// bufConn reads from r, which buffers what has been read from the Conn.
+type bufConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
 }
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// fakeRemote serves the plain http requests of a tunnel one by one, and
+// replies the path in chunked encoding, as the remote server does.
+func fakeRemote(t *testing.T, dials *int32) funcConn {
+	return func() (net.Conn, error) {
+		atomic.AddInt32(dials, 1)
+		c, s := net.Pipe()
+		go func() {
+			defer s.Close()
+			br := bufio.NewReader(s)
+			for {
+				req, err := http.ReadRequest(br)
+				if err != nil {
+					return
+				}
+				if req.Header.Get("Proxy-Connection") != "" {
+					t.Error("hop-by-hop header is forwarded")
+				}
+				body, _ := ioutil.ReadAll(req.Body)
+				msg := req.Method + " " + req.URL.Path + " " + string(body)
+				io.WriteString(s, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n")
+				for _, v := range strings.SplitAfter(msg, " ") {
+					if v != "" {
+						fmt.Fprintf(s, "%x\r\n%s\r\n", len(v), v)
+					}
+				}
+				io.WriteString(s, "0\r\n\r\n")
+				if req.Close {
+					return
+				}
+			}
+		}()
+		return c, nil
+	}
+}
+
+func TestTunnelKeepAlive(t *testing.T) {
+	var dials int32
+	ts := httptest.NewServer(Tunnel(SimplePool(fakeRemote(t, &dials))))
+	defer ts.Close()
+	pURL, _ := url.Parse(ts.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(pURL)}}
+
+	for i, v := range []string{"/a", "/bb", "/ccc"} {
+		var resp *http.Response
+		var err error
+		if i == 1 {
+			resp, err = client.Post("http://example.com"+v, "text/plain", strings.NewReader("body"))
+		} else {
+			req, _ := http.NewRequest("GET", "http://example.com"+v, nil)
+			req.Header.Set("Proxy-Connection", "keep-alive")
+			resp, err = client.Do(req)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		want := "GET " + v + " "
+		if i == 1 {
+			want = "POST " + v + " body"
+		}
+		if string(b) != want {
+			t.Fatalf("expect %q see %q", want, b)
+		}
+	}
+	if dials != 1 {
+		t.Fatalf("Tunnel is not reused: %d dials", dials)
+	}
+}
+
+func TestModeDialer(t *testing.T) {
+	pool := func() (net.Conn, error) {
+		c, s := net.Pipe()
+		go func() {
+			br := bufio.NewReader(s)
+			req, err := http.ReadRequest(br)
+			if err != nil || req.Method != "MODE" {
+				t.Errorf("unexpected request: %v %v", req, err)
+				s.Close()
+				return
+			}
+			io.WriteString(s, "HTTP/1.0 200 OK\r\n\r\nready")
+			io.Copy(s, br)
+			s.Close()
+		}()
+		return c, nil
+	}
+
+	c, err := ModeDialer(SimplePool(pool), "MODE")()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(c, b); err != nil || string(b) != "ready" {
+		t.Fatalf("%q %v", b, err)
+	}
+	go c.Write([]byte("echo"))
+	if _, err := io.ReadFull(c, b[:4]); err != nil || string(b[:4]) != "echo" {
+		t.Fatalf("%q %v", b[:4], err)
+	}
+}
+
+// wsEcho is a websocket server echoes the messages.
+func wsEcho(t *testing.T) *httptest.Server {
+	var upgrader websocket.Upgrader
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer ws.Close()
+		for {
+			typ, b, err := ws.ReadMessage()
+			if err != nil {
+				return
+			}
+			ws.WriteMessage(typ, b)
+		}
+	}))
+}
+
+func TestTunnelUpgrade(t *testing.T) {
+	echo := wsEcho(t)
+	defer echo.Close()
+	echoAddr := strings.TrimPrefix(echo.URL, "http://")
+	pool := func() (net.Conn, error) {
+		return net.Dial("tcp", echoAddr)
+	}
+	ts := httptest.NewServer(Tunnel(SimplePool(pool)))
+	defer ts.Close()
+
+	// ask the proxy in plain http, rather than CONNECT
+	d := &websocket.Dialer{NetDial: func(network, addr string) (net.Conn, error) {
+		return net.Dial(network, strings.TrimPrefix(ts.URL, "http://"))
+	}}
+	ws, _, err := d.Dial("ws://"+echoAddr+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	for _, v := range []string{"hello", "world"} {
+		if err := ws.WriteMessage(websocket.TextMessage, []byte(v)); err != nil {
+			t.Fatal(err)
+		}
+		_, b, err := ws.ReadMessage()
+		if err != nil || string(b) != v {
+			t.Fatalf("expect %q see %q %v", v, b, err)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+// healthTimeout is the timeout to connect to a proxy in its health check.
+var healthTimeout = 5 * time.Second
+
+// proxyError is the failure to reach the proxy, rather than the host
+// requested. It is never taken as the host is blocked.
+type proxyError struct {
+	addr string
+	err  error
+	// sent is set if the request body may have been consumed
+	sent bool
+}
+
+func (e *proxyError) Error() string {
+	return "Proxy " + e.addr + " is unreachable: " + e.err.Error()
+}
+
+func (e *proxyError) Unwrap() error {
+	return e.err
+}
+
+func isProxyError(err error) bool {
+	var e *proxyError
+	return errors.As(err, &e)
+}
+
+// proxyHealth keeps the health of the upstream proxies by their addresses.
+// The proxies down are tried at last.
+type proxyHealth struct {
+	lock sync.Mutex
+	down map[string]bool
+}
+
+func newProxyHealth() *proxyHealth {
+	return &proxyHealth{down: map[string]bool{}}
+}
+
+// isDown reports whether the proxy at addr is found down, and adds addr to
+// the health checks.
+func (h *proxyHealth) isDown(addr string) bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	down, ok := h.down[addr]
+	if !ok {
+		h.down[addr] = false
+	}
+	return down
+}
+
+func (h *proxyHealth) set(addr string, err error) {
+	h.lock.Lock()
+	was, ok := h.down[addr]
+	h.down[addr] = err != nil
+	h.lock.Unlock()
+	switch {
+	case err != nil && (!ok || !was):
+		log.Print("Proxy " + addr + " is down: " + err.Error())
+	case err == nil && was:
+		log.Print("Proxy " + addr + " is up")
+	}
+}
+
+// check connects to the proxy at addr, and reports whether it is up.
+func (h *proxyHealth) check(addr string) bool {
+	c, err := net.DialTimeout("tcp", addr, healthTimeout)
+	if err == nil {
+		c.Close()
+	}
+	h.set(addr, err)
+	return err == nil
+}
+
+// Run checks all the proxies known every interval, it never returns.
+func (h *proxyHealth) Run(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		h.lock.Lock()
+		addrs := make([]string, 0, len(h.down))
+		for addr := range h.down {
+			addrs = append(addrs, addr)
+		}
+		h.lock.Unlock()
+		sort.Strings(addrs)
+		for _, addr := range addrs {
+			h.check(addr)
+		}
+	}
+}
+
+// candidates returns the proxies of u in the order to try, nil is DIRECT.
+// The proxies found down are moved to the end.
+func (p *NTLMProxy) candidates(u *url.URL) ([]*url.URL, error) {
+	proxies := p.proxies
+	if p.PAC != nil {
+		var err error
+		if proxies, err = p.PAC.FindProxy(u); err != nil {
+			return nil, err
+		}
+	}
+	if len(proxies) == 0 {
+		return []*url.URL{nil}, nil
+	}
+	var up, down []*url.URL
+	for _, v := range proxies {
+		if v != nil && p.health.isDown(v.Host) {
+			down = append(down, v)
+		} else {
+			up = append(up, v)
+		}
+	}
+	return append(up, down...), nil
+}
+
+// proxyFailure returns err as a proxyError, if the proxy at addr is down.
+func (p *NTLMProxy) proxyFailure(addr string, err error, sent bool) error {
+	if p.health.check(addr) {
+		return err
+	}
+	return &proxyError{addr: addr, err: err, sent: sent}
+}
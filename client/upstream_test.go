@@ -0,0 +1,120 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// downAddr returns an address nobody listens.
+func downAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	return l.Addr().String()
+}
+
+func TestProxyFailover(t *testing.T) {
+	echo := listen(t, func(c net.Conn) {
+		io.Copy(c, c)
+		c.Close()
+	})
+	fake := &fakeNTLMProxy{t: t, user: `DOMAIN\alice`, password: "secret", target: echo}
+	down := downAddr(t)
+	auth, _ := NewProxyAuth(`DOMAIN\alice`, "secret", "")
+	p, err := NewNTLMProxy("http://"+down+", http://"+listen(t, fake.serve), auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := p.dial("example.com:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if !p.health.isDown(down) {
+		t.Fatal("proxy is not found down")
+	}
+	proxies, _ := p.candidates(&url.URL{Scheme: "http", Host: "example.com"})
+	if proxies[len(proxies)-1].Host != down {
+		t.Fatalf("%v: the proxy down is not the last", proxies)
+	}
+
+	ts := httptest.NewServer(p)
+	defer ts.Close()
+	pURL, _ := url.Parse(ts.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(pURL)}}
+	resp, err := client.Get("http://example.com/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(b) != "hello /a" {
+		t.Fatalf("%d %q", resp.StatusCode, b)
+	}
+
+	// all down
+	p, _ = NewNTLMProxy("http://"+down, nil)
+	if _, err := p.dial("example.com:443"); !isProxyError(err) {
+		t.Fatalf("expect proxy error, see %v", err)
+	}
+}
+
+func TestProxyOutage(t *testing.T) {
+	// The proxy replies 503 as it is going down, or 403 for blocked hosts
+	var upstream *httptest.Server
+	upstream = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Host == "down.example.com" {
+			upstream.Listener.Close()
+			http.Error(w, "going down", http.StatusServiceUnavailable)
+			return
+		}
+		http.Error(w, "blocked", http.StatusForbidden)
+	}))
+	defer upstream.Close()
+
+	p, err := NewNTLMProxy(upstream.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var blocked []string
+	rules, _ := LoadRules("")
+	p.ValidHTTP = rules.ValidHTTP
+	p.Blocked = func(r *http.Request) {
+		blocked = append(blocked, r.Host)
+	}
+	p.Fallback = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("remote"))
+	})
+	ts := httptest.NewServer(p)
+	defer ts.Close()
+	pURL, _ := url.Parse(ts.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(pURL)}}
+
+	for _, v := range []struct {
+		host string
+		code int
+	}{
+		{"blocked.example.com", http.StatusOK},
+		{"down.example.com", http.StatusBadGateway},
+	} {
+		resp, err := client.Get("http://" + v.host + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != v.code {
+			t.Fatalf("%s: %d", v.host, resp.StatusCode)
+		}
+	}
+	if len(blocked) != 1 || blocked[0] != "blocked.example.com" {
+		t.Fatalf("recorded as blocked: %v", blocked)
+	}
+}
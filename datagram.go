@@ -0,0 +1,142 @@
+package fetch
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+)
+
+// MethodDatagram is the method of the request that switches a tunnel to
+// datagram mode. After the server replies 200, each packet in both directions
+// is sent as
+//
+//	LEN(2) ATYP ADDR PORT DATA
+//
+// LEN is the length of the rest of the packet in big endian. ATYP ADDR PORT
+// is the destination (client to server) or source (server to client) in the
+// format of SOCKS5, see RFC 1928.
+const MethodDatagram = "DATAGRAM"
+
+// MaxDatagram is the maximum size of a packet, including the address.
+const MaxDatagram = 0xffff
+
+// Address types, the same as SOCKS5.
+const (
+	AtypIPv4   = 0x01
+	AtypDomain = 0x03
+	AtypIPv6   = 0x04
+)
+
+// ErrAddrType is returned when the address type is unknown.
+var ErrAddrType = errors.New("Unsupported address type")
+
+// ErrDatagramSize is returned when the packet is too large for a datagram.
+var ErrDatagramSize = errors.New("Datagram too large")
+
+// ReadAddr reads ATYP ADDR PORT from r, and returns it as host:port.
+func ReadAddr(r io.Reader) (string, error) {
+	var atyp [1]byte
+	if _, err := io.ReadFull(r, atyp[:]); err != nil {
+		return "", err
+	}
+
+	var host string
+	switch atyp[0] {
+	case AtypIPv4, AtypIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if atyp[0] == AtypIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case AtypDomain:
+		var l [1]byte
+		if _, err := io.ReadFull(r, l[:]); err != nil {
+			return "", err
+		}
+		b := make([]byte, l[0])
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", err
+		}
+		host = string(b)
+	default:
+		return "", ErrAddrType
+	}
+
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// AppendAddr appends ATYP ADDR PORT of addr to b.
+// An empty or invalid addr is written as 0.0.0.0:0.
+func AppendAddr(b []byte, addr string) []byte {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return append(b, AtypIPv4, 0, 0, 0, 0, 0, 0)
+	}
+	port, _ := strconv.Atoi(portStr)
+
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			host = host[:255]
+		}
+		b = append(b, AtypDomain, byte(len(host)))
+		b = append(b, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		b = append(b, AtypIPv4)
+		b = append(b, ip4...)
+	} else {
+		b = append(b, AtypIPv6)
+		b = append(b, ip.To16()...)
+	}
+	return append(b, byte(port>>8), byte(port))
+}
+
+// WriteDatagram writes p with addr as one packet to w.
+// Callers sharing w must serialize the calls.
+func WriteDatagram(w io.Writer, addr string, p []byte) error {
+	b := pool.Get()
+	defer pool.Put(b)
+
+	b = AppendAddr(b[:2], addr)
+	if len(b)-2+len(p) > MaxDatagram {
+		return ErrDatagramSize
+	}
+	binary.BigEndian.PutUint16(b, uint16(len(b)-2+len(p)))
+	b = append(b, p...)
+	_, err := w.Write(b)
+	return err
+}
+
+// ReadDatagram reads one packet from r into p, and returns the size of data
+// and its address. If p is too small, the rest of the packet is discarded.
+func ReadDatagram(r io.Reader, p []byte) (n int, addr string, err error) {
+	var l [2]byte
+	if _, err = io.ReadFull(r, l[:]); err != nil {
+		return
+	}
+	lr := &io.LimitedReader{R: r, N: int64(binary.BigEndian.Uint16(l[:]))}
+	if addr, err = ReadAddr(lr); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return
+	}
+	m := int(lr.N)
+	if m > len(p) {
+		m = len(p)
+	}
+	if n, err = io.ReadFull(lr, p[:m]); err != nil {
+		return
+	}
+	_, err = io.Copy(ioutil.Discard, lr)
+	return
+}
@@ -0,0 +1,58 @@
+package fetch
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestDatagram(t *testing.T) {
+	var buf bytes.Buffer
+	in := []struct {
+		addr string
+		data []byte
+	}{
+		{"8.8.8.8:53", dataRand(512, 0, 0xff)},
+		{"[2001:db8::1]:443", dataRand(1200, 0, 0xff)},
+		{"example.com:123", nil},
+		{"", []byte("any")},
+	}
+	for _, v := range in {
+		if err := WriteDatagram(&buf, v.addr, v.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b := make([]byte, MaxDatagram)
+	for _, v := range in {
+		n, addr, err := ReadDatagram(&buf, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := v.addr
+		if want == "" {
+			want = "0.0.0.0:0"
+		}
+		if addr != want {
+			t.Fatalf("Wrong address: expect %s see %s", want, addr)
+		}
+		equal(t, v.data, b[:n], addr, len(v.data))
+	}
+	if _, _, err := ReadDatagram(&buf, b); err != io.EOF {
+		t.Fatalf("expect EOF, see %v", err)
+	}
+
+	// short buffer discards the rest of the packet
+	WriteDatagram(&buf, "8.8.8.8:53", []byte("0123456789"))
+	WriteDatagram(&buf, "8.8.4.4:53", []byte("abc"))
+	if n, _, err := ReadDatagram(&buf, b[:4]); err != nil || string(b[:n]) != "0123" {
+		t.Fatalf("short read: %q %v", b[:n], err)
+	}
+	if n, addr, err := ReadDatagram(&buf, b); err != nil || addr != "8.8.4.4:53" || string(b[:n]) != "abc" {
+		t.Fatalf("next read: %s %q %v", addr, b[:n], err)
+	}
+
+	if err := WriteDatagram(&buf, "8.8.8.8:53", make([]byte, MaxDatagram)); err != ErrDatagramSize {
+		t.Fatalf("expect ErrDatagramSize, see %v", err)
+	}
+}
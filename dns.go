@@ -0,0 +1,44 @@
+package fetch
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// MethodDNS is the method of the request that switches a tunnel to DNS mode.
+// After the server replies 200, DNS messages are sent in both directions with
+// 2 bytes length prefix, the same as DNS over TCP (RFC 1035 section 4.2.2).
+// Replies may come in any order, they are matched to the queries by ID.
+const MethodDNS = "DNS"
+
+// MaxDNS is the maximum size of a DNS message over stream.
+const MaxDNS = 0xffff
+
+// ErrDNSSize is returned when the message is too large.
+var ErrDNSSize = errors.New("DNS message too large")
+
+// WriteDNS writes p with length prefix to w.
+func WriteDNS(w io.Writer, p []byte) error {
+	if len(p) > MaxDNS {
+		return ErrDNSSize
+	}
+	b := make([]byte, 2+len(p))
+	binary.BigEndian.PutUint16(b, uint16(len(p)))
+	copy(b[2:], p)
+	_, err := w.Write(b)
+	return err
+}
+
+// ReadDNS reads a message with length prefix from r into p.
+func ReadDNS(r io.Reader, p []byte) (int, error) {
+	var l [2]byte
+	if _, err := io.ReadFull(r, l[:]); err != nil {
+		return 0, err
+	}
+	n := int(binary.BigEndian.Uint16(l[:]))
+	if n > len(p) {
+		return 0, ErrDNSSize
+	}
+	return io.ReadFull(r, p[:n])
+}
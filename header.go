@@ -0,0 +1,74 @@
+package fetch
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// hopHeaders are the headers of a single connection, they must not be
+// forwarded by proxies. See RFC 7230 section 6.1.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// RemoveHopHeaders removes the hop-by-hop headers from h, including the ones
+// listed in Connection.
+func RemoveHopHeaders(h http.Header) {
+	for _, v := range h["Connection"] {
+		for _, f := range strings.Split(v, ",") {
+			if f = strings.TrimSpace(f); f != "" {
+				h.Del(f)
+			}
+		}
+	}
+	for _, k := range hopHeaders {
+		h.Del(k)
+	}
+}
+
+// Upgrade returns the protocol in Upgrade, if it is listed in Connection.
+func Upgrade(h http.Header) string {
+	for _, v := range h["Connection"] {
+		for _, f := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(f), "Upgrade") {
+				return h.Get("Upgrade")
+			}
+		}
+	}
+	return ""
+}
+
+// SetUpgrade asks to switch to protocol, after the hop-by-hop headers are
+// removed. It does nothing if protocol is empty.
+func SetUpgrade(h http.Header, protocol string) {
+	if protocol != "" {
+		h.Set("Connection", "Upgrade")
+		h.Set("Upgrade", protocol)
+	}
+}
+
+// WriteUpgrade writes the head of a 101 Switching Protocols response to w,
+// without the hop-by-hop headers other than Upgrade.
+func WriteUpgrade(w io.Writer, resp *http.Response) error {
+	protocol := Upgrade(resp.Header)
+	RemoveHopHeaders(resp.Header)
+	SetUpgrade(resp.Header, protocol)
+	if _, err := fmt.Fprintf(w, "HTTP/1.1 %s\r\n", resp.Status); err != nil {
+		return err
+	}
+	if err := resp.Header.Write(w); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\r\n")
+	return err
+}
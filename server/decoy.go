@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+)
+
+// NewDecoy returns the handler of a decoy site, which serves the directory
+// at s, or reverse proxies the site if s is a http(s) URL.
+func NewDecoy(s string) (http.Handler, error) {
+	if u, err := url.Parse(s); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+		p := httputil.NewSingleHostReverseProxy(u)
+		director := p.Director
+		p.Director = func(r *http.Request) {
+			director(r)
+			r.Host = u.Host
+			// look like a direct visit
+			r.Header["X-Forwarded-For"] = nil
+		}
+		p.Transport = tunnels.transport
+		return p, nil
+	}
+	fi, err := os.Stat(s)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, errors.New("Decoy is neither a directory nor a URL: " + s)
+	}
+	return http.FileServer(http.Dir(s)), nil
+}
+
+// Camouflage serves the decoy site to everyone, except the clients.
+// The tunnel is found only with a valid credential, and the probes
+// without it see nothing but the decoy.
+type Camouflage struct {
+	Decoy http.Handler
+	// Private serves the clients, it should serve the tunnel and nothing
+	// else of the server.
+	Private http.Handler
+}
+
+func (c *Camouflage) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if clients != nil {
+		if _, ok := clients.Auth(r); ok {
+			c.Private.ServeHTTP(w, r)
+			return
+		}
+	}
+	c.Decoy.ServeHTTP(w, r)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func get(t *testing.T, req *http.Request) (int, string) {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, _ := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, string(b)
+}
+
+func TestDecoy(t *testing.T) {
+	dir := t.TempDir()
+	ioutil.WriteFile(filepath.Join(dir, "index.html"), []byte("<h1>Welcome</h1>"), 0666)
+	site := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Forwarded-For") != "" {
+			t.Error("X-Forwarded-For is sent to the decoy")
+		}
+		w.Write([]byte("site " + r.URL.Path))
+	}))
+	defer site.Close()
+
+	for _, v := range []struct{ decoy, path, body string }{
+		{dir, "/", "<h1>Welcome</h1>"},
+		{site.URL, "/about", "site /about"},
+	} {
+		d, err := NewDecoy(v.decoy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := httptest.NewServer(d)
+		req, _ := http.NewRequest("GET", s.URL+v.path, nil)
+		if code, body := get(t, req); code != 200 || body != v.body {
+			t.Fatalf("%s: %d %q", v.decoy, code, body)
+		}
+		s.Close()
+	}
+
+	if _, err := NewDecoy(filepath.Join(dir, "index.html")); err == nil {
+		t.Fatal("expect error of a file")
+	}
+}
+
+func TestCamouflage(t *testing.T) {
+	old := clients
+	clients = readClients(t)
+	defer func() { clients = old }()
+
+	mux := http.NewServeMux()
+	mux.Handle("/assets/app.js", tunnels)
+	decoy := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("decoy"))
+	})
+	s := httptest.NewServer(&Camouflage{Decoy: decoy, Private: mux})
+	defer s.Close()
+
+	// probes see the decoy only
+	for _, v := range []struct{ user, password string }{{"", ""}, {"alice", "wrong"}} {
+		req, _ := http.NewRequest("GET", s.URL+"/assets/app.js", nil)
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", "websocket")
+		if v.user != "" {
+			req.SetBasicAuth(v.user, v.password)
+		}
+		if code, body := get(t, req); code != 200 || body != "decoy" {
+			t.Fatalf("%v: %d %q", v, code, body)
+		}
+	}
+
+	h := http.Header{}
+	r := &http.Request{Header: h}
+	r.SetBasicAuth("alice", "secret")
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http")+"/assets/app.js", h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws.Close()
+}
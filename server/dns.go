@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ramuchu/fetch"
+)
+
+// dnsTimeout is the time to wait for the DNS server to reply.
+var dnsTimeout = 5 * time.Second
+
+// serveDNS serves the tunnel in DNS mode, see fetch.MethodDNS.
+// Each query is sent to the DNS server separately, so a slow one will not
+// block the others.
+func serveDNS(ws net.Conn, r io.Reader) {
+	fmt.Println("start DNS...")
+	ws.Write([]byte("HTTP/1.0 200 OK\r\n\r\n"))
+
+	server := getDNSServer()
+	var wlock sync.Mutex
+	b := make([]byte, fetch.MaxDNS)
+	for {
+		n, err := fetch.ReadDNS(r, b)
+		if err != nil {
+			break
+		}
+		go func(q []byte) {
+			resp, err := exchangeDNS(server, q)
+			if err != nil {
+				fmt.Println("DNS ERR:", err)
+				return
+			}
+			wlock.Lock()
+			fetch.WriteDNS(ws, resp)
+			wlock.Unlock()
+		}(append([]byte(nil), b[:n]...))
+	}
+	ws.Close()
+}
+
+// exchangeDNS sends q to server by UDP, and retries by TCP if the reply is truncated.
+func exchangeDNS(server string, q []byte) ([]byte, error) {
+	c, err := net.DialTimeout("udp", server, dnsTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c.SetDeadline(time.Now().Add(dnsTimeout))
+	b := make([]byte, fetch.MaxDNS)
+	var n int
+	if _, err = c.Write(q); err == nil {
+		n, err = c.Read(b)
+	}
+	c.Close()
+	if err != nil {
+		return nil, err
+	}
+	// TC bit of the header
+	if n < 3 || b[2]&0x02 == 0 {
+		return b[:n], nil
+	}
+
+	c, err = net.DialTimeout("tcp", server, dnsTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(dnsTimeout))
+	if err := fetch.WriteDNS(c, q); err != nil {
+		return nil, err
+	}
+	n, err = fetch.ReadDNS(c, b)
+	return b[:n], err
+}
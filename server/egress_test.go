@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// listen serves each connection to a new listener by fn.
+func listen(t *testing.T, fn func(c net.Conn)) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go fn(c)
+		}
+	}()
+	return l.Addr().String()
+}
+
+func pipe(a, b net.Conn) {
+	go func() {
+		io.Copy(a, b)
+		a.Close()
+	}()
+	io.Copy(b, a)
+	b.Close()
+}
+
+// standIn records the destinations asked to a stand-in proxy, and connects
+// all of them to target.
+type standIn struct {
+	target string
+	lock   sync.Mutex
+	asked  []string
+}
+
+func (s *standIn) ask(addr string) {
+	s.lock.Lock()
+	s.asked = append(s.asked, addr)
+	s.lock.Unlock()
+}
+
+func (s *standIn) last() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(s.asked) == 0 {
+		return ""
+	}
+	return s.asked[len(s.asked)-1]
+}
+
+// httpProxy is a stand-in http proxy requires Basic auth of auth if it is not empty.
+func (s *standIn) httpProxy(t *testing.T, auth string) string {
+	return listen(t, func(c net.Conn) {
+		br := bufio.NewReader(c)
+		req, err := http.ReadRequest(br)
+		if err != nil || req.Method != "CONNECT" {
+			c.Close()
+			return
+		}
+		if auth != "" && req.Header.Get("Proxy-Authorization") != "Basic "+base64.StdEncoding.EncodeToString([]byte(auth)) {
+			io.WriteString(c, "HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: Basic\r\nContent-Length: 0\r\n\r\n")
+			c.Close()
+			return
+		}
+		s.ask(req.Host)
+		d, err := net.Dial("tcp", s.target)
+		if err != nil {
+			c.Close()
+			return
+		}
+		io.WriteString(c, "HTTP/1.1 200 Connection established\r\n\r\n")
+		pipe(c, d)
+	})
+}
+
+// socksProxy is a stand-in SOCKS5 proxy, with username / password auth if
+// auth is not empty.
+func (s *standIn) socksProxy(t *testing.T, auth string) string {
+	return listen(t, func(c net.Conn) {
+		defer c.Close()
+		b := make([]byte, 262)
+		if _, err := io.ReadFull(c, b[:2]); err != nil {
+			return
+		}
+		io.ReadFull(c, b[:b[1]])
+		if auth == "" {
+			c.Write([]byte{5, 0})
+		} else {
+			c.Write([]byte{5, 2})
+			io.ReadFull(c, b[:2])
+			user := make([]byte, b[1])
+			io.ReadFull(c, user)
+			io.ReadFull(c, b[:1])
+			password := make([]byte, b[0])
+			io.ReadFull(c, password)
+			if string(user)+":"+string(password) != auth {
+				c.Write([]byte{1, 1})
+				return
+			}
+			c.Write([]byte{1, 0})
+		}
+
+		if _, err := io.ReadFull(c, b[:4]); err != nil {
+			return
+		}
+		var host string
+		switch b[3] {
+		case 1:
+			io.ReadFull(c, b[:4])
+			host = net.IP(b[:4]).String()
+		case 3:
+			io.ReadFull(c, b[:1])
+			io.ReadFull(c, b[1:1+b[0]])
+			host = string(b[1 : 1+b[0]])
+		default:
+			return
+		}
+		io.ReadFull(c, b[:2])
+		s.ask(net.JoinHostPort(host, strconv.Itoa(int(b[0])<<8|int(b[1]))))
+
+		d, err := net.Dial("tcp", s.target)
+		if err != nil {
+			c.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		c.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+		pipe(c, d)
+	})
+}
+
+func echo(t *testing.T) string {
+	return listen(t, func(c net.Conn) {
+		io.Copy(c, c)
+		c.Close()
+	})
+}
+
+func dialEcho(t *testing.T, e *Egress, addr string) error {
+	c, err := e.DialContext(context.Background(), "tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	msg := "hello " + addr
+	io.WriteString(c, msg)
+	b := make([]byte, len(msg))
+	if _, err := io.ReadFull(c, b); err != nil {
+		return err
+	}
+	if string(b) != msg {
+		t.Fatalf("expect %q see %q", msg, b)
+	}
+	return nil
+}
+
+func TestEgress(t *testing.T) {
+	target := echo(t)
+	hp := &standIn{target: target}
+	sp := &standIn{target: target}
+	rules := "# comment\n" +
+		"*.corp.example\thttp://user:pass@" + hp.httpProxy(t, "user:pass") + "\n" +
+		"socks.example\tsocks5://" + sp.socksProxy(t, "") + "\n" +
+		"auth.example\tsocks5://user:pass@" + sp.socksProxy(t, "user:pass") + "\n" +
+		"direct.corp.example\tdirect\n"
+
+	e := NewEgress()
+	if err := e.Read(strings.NewReader(rules)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, v := range []struct {
+		addr  string
+		proxy *standIn
+	}{
+		{"a.corp.example:443", hp},
+		{"b.a.corp.example:80", hp},
+		{"direct.corp.example:22", hp}, // the first match wins
+		{"socks.example:443", sp},
+		{"auth.example:443", sp},
+		{target, nil},
+	} {
+		if err := dialEcho(t, e, v.addr); err != nil {
+			t.Fatalf("%s: %s", v.addr, err)
+		}
+		if v.proxy != nil && v.proxy.last() != v.addr {
+			t.Fatalf("%s: proxy is asked for %s", v.addr, v.proxy.last())
+		}
+	}
+	if len(hp.asked) != 3 || len(sp.asked) != 2 {
+		t.Fatalf("Wrong count of proxy requests: %v %v", hp.asked, sp.asked)
+	}
+}
+
+func TestEgressAuthFailed(t *testing.T) {
+	hp := &standIn{target: echo(t)}
+	sp := &standIn{target: hp.target}
+	e := NewEgress()
+	d, _ := NewDialer("http://user:wrong@"+hp.httpProxy(t, "user:pass"), e.Default)
+	e.Add("http.example", d)
+	d, _ = NewDialer("socks5://user:wrong@"+sp.socksProxy(t, "user:pass"), e.Default)
+	e.Add("socks.example", d)
+
+	for _, addr := range []string{"http.example:443", "socks.example:443"} {
+		if err := dialEcho(t, e, addr); err == nil {
+			t.Fatalf("%s: expect error with wrong password", addr)
+		}
+	}
+}
+
+func TestDefaultEgress(t *testing.T) {
+	hp := &standIn{target: echo(t)}
+	e := NewEgress()
+	if err := e.Read(strings.NewReader("default\thttp://" + hp.httpProxy(t, "") + "\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := dialEcho(t, e, "any.example:443"); err != nil {
+		t.Fatal(err)
+	}
+	if hp.last() != "any.example:443" {
+		t.Fatalf("proxy is asked for %s", hp.last())
+	}
+
+	// the proxies of the rules after default are dialed directly
+	sp := &standIn{target: hp.target}
+	e = NewEgress()
+	rules := "default\thttp://" + hp.httpProxy(t, "") + "\n" +
+		"socks.example\tsocks5://" + sp.socksProxy(t, "") + "\n"
+	if err := e.Read(strings.NewReader(rules)); err != nil {
+		t.Fatal(err)
+	}
+	if err := dialEcho(t, e, "socks.example:443"); err != nil {
+		t.Fatal(err)
+	}
+	if sp.last() != "socks.example:443" || hp.last() != "any.example:443" {
+		t.Fatalf("proxies are asked for %s %s", sp.last(), hp.last())
+	}
+
+	if _, err := NewDialer("ftp://proxy", e.Default); err == nil {
+		t.Fatal("expect error of unknown scheme")
+	}
+}
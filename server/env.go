@@ -1,6 +1,10 @@
 package main
 
-import "os"
+import (
+	"fmt"
+	"os"
+	"time"
+)
 
 func getIP() string {
 	return ""
@@ -13,3 +17,71 @@ func getPort() string {
 	}
 	return s
 }
+
+// getDNSServer returns the DNS server to resolve the queries from tunnels.
+func getDNSServer() string {
+	s := os.Getenv("DNS_SERVER")
+	if s == "" {
+		return "8.8.8.8:53"
+	}
+	return s
+}
+
+// getEgress returns the file of egress rules, see Egress.Read.
+func getEgress() string {
+	return os.Getenv("EGRESS")
+}
+
+// getClients returns the file of clients, see ReadClients.
+// If it is empty, everyone can use the tunnels.
+func getClients() string {
+	return os.Getenv("CLIENTS")
+}
+
+// getUsage returns the file to save the usage of clients.
+func getUsage() string {
+	s := os.Getenv("USAGE")
+	if s == "" {
+		return "usage.txt"
+	}
+	return s
+}
+
+// getTimeouts returns the timeouts of tunnels from $DIAL_TIMEOUT,
+// $TLS_TIMEOUT, $HEADER_TIMEOUT and $IDLE_TIMEOUT, e.g. "30s" or "5m".
+func getTimeouts() Timeouts {
+	return Timeouts{
+		Dial:   getDuration("DIAL_TIMEOUT", 10*time.Second),
+		TLS:    getDuration("TLS_TIMEOUT", 10*time.Second),
+		Header: getDuration("HEADER_TIMEOUT", 30*time.Second),
+		Idle:   getDuration("IDLE_TIMEOUT", 5*time.Minute),
+	}
+}
+
+func getDuration(key string, def time.Duration) time.Duration {
+	s := os.Getenv(key)
+	if s == "" {
+		return def
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		fmt.Println("Failed to parse", key, err)
+		return def
+	}
+	return d
+}
+
+// getTunnelPath returns the path of the tunnel.
+func getTunnelPath() string {
+	s := os.Getenv("TUNNEL_PATH")
+	if s == "" {
+		return "/p"
+	}
+	return s
+}
+
+// getDecoy returns the directory or URL of the decoy site, see NewDecoy.
+// If it is not empty, only the clients can see the other paths.
+func getDecoy() string {
+	return os.Getenv("DECOY")
+}
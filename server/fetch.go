@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+
+	"github.com/ramuchu/fetch"
+)
+
+// Limits of /fetch.
+var (
+	// maxFetchBatch is the number of requests in a batch.
+	maxFetchBatch = 16
+	// maxFetchRequest is the size of the JSON of a batch.
+	maxFetchRequest int64 = 1 << 20
+	// maxFetchBody is the size of each response body, the rest is truncated.
+	maxFetchBody int64 = 32 << 20
+)
+
+var errFetchScheme = errors.New("Only http and https are allowed")
+var errFetchLocal = errors.New("Local and private addresses are not allowed")
+
+// fetchTunnels sends the requests of /fetch, which cannot reach the local
+// and private addresses of the server.
+var fetchTunnels = func() *Tunnels {
+	t := NewTunnels(tunnels.Timeouts)
+	t.dialer = localGuard{egress}
+	return t
+}()
+
+// localGuard dials through egress, but not to the loopback, link-local and
+// private addresses, unless a rule of egress names the host.
+type localGuard struct {
+	egress *Egress
+}
+
+func (g localGuard) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if g.egress.Allows(addr) {
+		return g.egress.DialContext(ctx, network, addr)
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		if ip.IP.IsLoopback() || ip.IP.IsLinkLocalUnicast() || ip.IP.IsLinkLocalMulticast() ||
+			ip.IP.IsUnspecified() || ip.IP.IsPrivate() {
+			return nil, errFetchLocal
+		}
+	}
+	// dial the address checked through the rule of the host, the name may
+	// resolve to another one
+	return g.egress.dialer(addr).DialContext(ctx, network, net.JoinHostPort(ips[0].IP.String(), port))
+}
+
+// FetchRequest is a request in the batch to /fetch.
+type FetchRequest struct {
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Header http.Header `json:"header,omitempty"`
+	// Body is encoded in base64.
+	Body []byte `json:"body,omitempty"`
+}
+
+// fetchResponse is the response of a FetchRequest, without the body.
+type fetchResponse struct {
+	Status int         `json:"status,omitempty"`
+	Header http.Header `json:"header,omitempty"`
+	Error  string      `json:"error,omitempty"`
+}
+
+// FetchServer sends a batch of requests for scripts which cannot use the
+// tunnels. The POST body is a JSON list of FetchRequest, and the requests
+// are sent in order through the egress. The responses are streamed back
+// as a JSON list in the same order, each is
+//
+//	{"status": 200, "header": {...}, "body": "base64...", "truncated": true}
+//
+// or {"error": "..."} if it fails. It is only available to the clients, and
+// cannot reach the local and private addresses of the server, see localGuard.
+func FetchServer(w http.ResponseWriter, r *http.Request) {
+	if clients == nil {
+		http.NotFound(w, r)
+		return
+	}
+	client, ok := clients.Auth(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="fetch"`)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	var batch []FetchRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxFetchRequest)).Decode(&batch); err != nil {
+		code := http.StatusBadRequest
+		var mbe *http.MaxBytesError
+		if errors.As(err, &mbe) {
+			code = http.StatusRequestEntityTooLarge
+		}
+		http.Error(w, "Failed to parse the requests: "+err.Error(), code)
+		return
+	}
+	if len(batch) > maxFetchBatch {
+		http.Error(w, fmt.Sprintf("Too many requests, at most %d", maxFetchBatch), http.StatusRequestEntityTooLarge)
+		return
+	}
+	release, err := client.Acquire()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	}
+	defer release()
+
+	w.Header().Set("Content-Type", "application/json")
+	io.WriteString(w, "[")
+	for i, f := range batch {
+		if i > 0 {
+			io.WriteString(w, ",")
+		}
+		if err := client.Check(); err != nil {
+			writeFetchError(w, err)
+			continue
+		}
+		if err := doFetch(w, r, client, f); err != nil {
+			// the response is broken
+			fmt.Println("fetch", f.URL, err)
+			return
+		}
+		if fl, ok := w.(http.Flusher); ok {
+			fl.Flush()
+		}
+	}
+	io.WriteString(w, "]")
+}
+
+func writeFetchError(w io.Writer, err error) {
+	b, _ := json.Marshal(fetchResponse{Error: err.Error()})
+	w.Write(b)
+}
+
+// doFetch sends f and writes its response to w. The error is returned only if
+// the writing fails.
+func doFetch(w io.Writer, r *http.Request, client *Client, f FetchRequest) error {
+	if f.Method == "" {
+		f.Method = "GET"
+	}
+	req, err := http.NewRequestWithContext(r.Context(), f.Method, f.URL, bytes.NewReader(f.Body))
+	if err == nil && req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+		err = errFetchScheme
+	}
+	if err != nil {
+		writeFetchError(w, err)
+		return nil
+	}
+	for k, v := range f.Header {
+		req.Header[http.CanonicalHeaderKey(k)] = v
+	}
+	fetch.RemoveHopHeaders(req.Header)
+	client.use(len(f.Body))
+
+	resp, err := fetchTunnels.roundTrip(req)
+	if err != nil {
+		writeFetchError(w, err)
+		return nil
+	}
+	defer resp.Body.Close()
+	fetch.RemoveHopHeaders(resp.Header)
+
+	// write the head without "}", then stream the body into it
+	head, _ := json.Marshal(fetchResponse{Status: resp.StatusCode, Header: resp.Header})
+	if _, err := w.Write(head[:len(head)-1]); err != nil {
+		return err
+	}
+	io.WriteString(w, `,"body":"`)
+	enc := base64.NewEncoder(base64.StdEncoding, w)
+	body := &fetchBody{r: io.LimitReader(resp.Body, maxFetchBody), client: client}
+	n, err := io.Copy(enc, body)
+	if cerr := enc.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil && err != body.err {
+		return err
+	}
+	io.WriteString(w, `"`)
+	truncated := body.err != nil
+	if n == maxFetchBody && !truncated {
+		// it is too large only if one more byte arrives
+		_, err := io.ReadFull(resp.Body, make([]byte, 1))
+		truncated = err != io.EOF
+	}
+	if truncated {
+		// the rest is not read, it is too large, broken or over the quota
+		io.WriteString(w, `,"truncated":true`)
+	}
+	_, err = io.WriteString(w, "}")
+	return err
+}
+
+// fetchBody counts what is read to the client, and keeps the error of reading.
+type fetchBody struct {
+	r      io.Reader
+	client *Client
+	err    error
+}
+
+func (b *fetchBody) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	if qerr := b.client.use(n); err == nil && qerr != nil {
+		err = qerr
+	}
+	if err != nil && err != io.EOF {
+		b.err = err
+	}
+	return n, err
+}
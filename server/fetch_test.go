@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type fetchResult struct {
+	Status    int         `json:"status"`
+	Header    http.Header `json:"header"`
+	Body      []byte      `json:"body"`
+	Truncated bool        `json:"truncated"`
+	Error     string      `json:"error"`
+}
+
+func postFetch(t *testing.T, url, user, password string, batch []FetchRequest) (*http.Response, []fetchResult) {
+	b, _ := json.Marshal(batch)
+	req, _ := http.NewRequest("POST", url, strings.NewReader(string(b)))
+	if user != "" {
+		req.SetBasicAuth(user, password)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return resp, nil
+	}
+	var results []fetchResult
+	if err := json.NewDecoder(resp.Body).Decode(&results); err != nil {
+		t.Fatal(err)
+	}
+	return resp, results
+}
+
+func TestFetchServer(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("X-Method", r.Method)
+		w.Header().Set("X-Test", r.Header.Get("X-Test"))
+		fmt.Fprintf(w, "%s %s", r.URL.Path, b)
+	}))
+	defer target.Close()
+
+	// the target is local, it is allowed by the rule
+	egress.Add("127.0.0.1", directDialer())
+	defer func() { egress.rules = nil }()
+
+	old := clients
+	clients = readClients(t)
+	defer func() { clients = old }()
+	s := httptest.NewServer(http.HandlerFunc(FetchServer))
+	defer s.Close()
+
+	batch := []FetchRequest{
+		{URL: target.URL + "/a", Header: http.Header{"x-test": {"1"}}},
+		{Method: "POST", URL: target.URL + "/b", Body: []byte("hello")},
+		{URL: "file:///etc/passwd"},
+		{URL: target.URL + "/" + strings.Repeat("x", 100)},
+		{URL: target.URL + "/" + strings.Repeat("x", 48)},
+		{URL: strings.Replace(target.URL, "127.0.0.1", "localhost", 1) + "/c"},
+	}
+	maxFetchBody = 50
+	defer func() { maxFetchBody = 32 << 20 }()
+	_, results := postFetch(t, s.URL, "alice", "secret", batch)
+	if len(results) != len(batch) {
+		t.Fatalf("Wrong number of results: %v", results)
+	}
+	if r := results[0]; r.Status != 200 || string(r.Body) != "/a " || r.Header.Get("X-Test") != "1" || r.Truncated {
+		t.Fatalf("Wrong result: %+v", r)
+	}
+	if r := results[1]; r.Header.Get("X-Method") != "POST" || string(r.Body) != "/b hello" {
+		t.Fatalf("Wrong result: %+v", r)
+	}
+	if r := results[2]; r.Error != errFetchScheme.Error() {
+		t.Fatalf("Wrong result: %+v", r)
+	}
+	if r := results[3]; len(r.Body) != 50 || !r.Truncated {
+		t.Fatalf("Wrong result: %+v", r)
+	}
+	// exactly the limit
+	if r := results[4]; len(r.Body) != 50 || r.Truncated {
+		t.Fatalf("Wrong result: %+v", r)
+	}
+	if r := results[5]; !strings.Contains(r.Error, errFetchLocal.Error()) {
+		t.Fatalf("Wrong result: %+v", r)
+	}
+	if clients.m["alice"].usage.DayBytes == 0 {
+		t.Fatal("Usage is not counted")
+	}
+}
+
+func TestFetchServerLimits(t *testing.T) {
+	old := clients
+	clients = nil
+	defer func() { clients = old }()
+	s := httptest.NewServer(http.HandlerFunc(FetchServer))
+	defer s.Close()
+
+	if resp, _ := postFetch(t, s.URL, "", "", nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("Available without clients: %d", resp.StatusCode)
+	}
+
+	clients = readClients(t)
+	if resp, _ := postFetch(t, s.URL, "alice", "wrong", nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Wrong status of wrong password: %d", resp.StatusCode)
+	}
+	batch := make([]FetchRequest, maxFetchBatch+1)
+	if resp, _ := postFetch(t, s.URL, "alice", "secret", batch); resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("Wrong status of too many requests: %d", resp.StatusCode)
+	}
+	batch = []FetchRequest{{URL: "http://example.com/", Body: make([]byte, maxFetchRequest)}}
+	if resp, _ := postFetch(t, s.URL, "alice", "secret", batch); resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("Wrong status of large request: %d", resp.StatusCode)
+	}
+}
+
+func TestFetchEgress(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer target.Close()
+	hp := &standIn{target: strings.TrimPrefix(target.URL, "http://")}
+	d, _ := NewDialer("http://"+hp.httpProxy(t, ""), egress.Default)
+	egress.Add("corp.example", d)
+	defer func() { egress.rules = nil }()
+
+	old := clients
+	clients = readClients(t)
+	defer func() { clients = old }()
+	s := httptest.NewServer(http.HandlerFunc(FetchServer))
+	defer s.Close()
+
+	_, results := postFetch(t, s.URL, "alice", "secret", []FetchRequest{{URL: "http://corp.example/"}})
+	if len(results) != 1 || string(results[0].Body) != "ok" {
+		t.Fatalf("Wrong results: %+v", results)
+	}
+	if hp.last() != "corp.example:80" {
+		t.Fatalf("proxy is asked for %q", hp.last())
+	}
+}
+
+func TestFetchEgressAll(t *testing.T) {
+	// the rule of "*" is not a name, but the checked address goes through it
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer target.Close()
+	hp := &standIn{target: strings.TrimPrefix(target.URL, "http://")}
+	d, _ := NewDialer("http://"+hp.httpProxy(t, ""), directDialer())
+	egress.Add("*", d)
+	defer func() { egress.rules = nil }()
+
+	old := clients
+	clients = readClients(t)
+	defer func() { clients = old }()
+	s := httptest.NewServer(http.HandlerFunc(FetchServer))
+	defer s.Close()
+
+	_, results := postFetch(t, s.URL, "alice", "secret", []FetchRequest{
+		{URL: "http://203.0.113.5/"},
+		{URL: "http://10.1.2.3/"},
+		{URL: "http://[fd00::1]/"},
+		{URL: "http://192.168.1.1/"},
+	})
+	if len(results) != 4 || string(results[0].Body) != "ok" {
+		t.Fatalf("Wrong results: %+v", results)
+	}
+	if hp.last() != "203.0.113.5:80" {
+		t.Fatalf("proxy is asked for %q", hp.last())
+	}
+	for _, r := range results[1:] {
+		if !strings.Contains(r.Error, errFetchLocal.Error()) {
+			t.Fatalf("Wrong result of a private address: %+v", r)
+		}
+	}
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errTooManyTunnels = errors.New("Too many tunnels")
+var errDailyQuota = errors.New("Daily quota exceeded")
+var errMonthlyQuota = errors.New("Monthly quota exceeded")
+
+// anonymous is the client when no clients are configured. It has no limits.
+var anonymous = &Client{}
+
+// Client is an identity allowed to use the tunnels, and its limits.
+// Zero value of a limit means unlimited.
+type Client struct {
+	Name     string
+	password string
+
+	// Rate is the bytes per second of all its tunnels, in both directions.
+	Rate int64
+	// Tunnels is the number of tunnels at the same time.
+	Tunnels int
+	// Daily and Monthly are the bytes can be transferred in a day / month.
+	Daily   int64
+	Monthly int64
+
+	bucket *bucket
+
+	lock   sync.Mutex
+	active int
+	usage  usage
+}
+
+// usage is the bytes transferred in the day and month.
+type usage struct {
+	Day        string
+	DayBytes   int64
+	Month      string
+	MonthBytes int64
+}
+
+// roll resets the counters if the day or month is over.
+func (u *usage) roll(now time.Time) {
+	if d := now.Format("2006-01-02"); d != u.Day {
+		u.Day, u.DayBytes = d, 0
+	}
+	if m := now.Format("2006-01"); m != u.Month {
+		u.Month, u.MonthBytes = m, 0
+	}
+}
+
+// Acquire counts a new tunnel. The returned function must be called when the
+// tunnel is closed.
+func (c *Client) Acquire() (release func(), err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.Tunnels > 0 && c.active >= c.Tunnels {
+		return nil, errTooManyTunnels
+	}
+	c.active++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			c.lock.Lock()
+			c.active--
+			c.lock.Unlock()
+		})
+	}, nil
+}
+
+// Check returns error if the client has used up its quota.
+func (c *Client) Check() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.usage.roll(time.Now())
+	switch {
+	case c.Daily > 0 && c.usage.DayBytes >= c.Daily:
+		return errDailyQuota
+	case c.Monthly > 0 && c.usage.MonthBytes >= c.Monthly:
+		return errMonthlyQuota
+	}
+	return nil
+}
+
+// use counts n bytes transferred, and waits if it is faster than Rate.
+func (c *Client) use(n int) error {
+	if n <= 0 || c == anonymous {
+		return nil
+	}
+	c.lock.Lock()
+	c.usage.roll(time.Now())
+	c.usage.DayBytes += int64(n)
+	c.usage.MonthBytes += int64(n)
+	c.lock.Unlock()
+
+	if c.bucket != nil {
+		time.Sleep(c.bucket.take(n))
+	}
+	return c.Check()
+}
+
+// Meter wraps conn, so what is sent and received are counted and limited.
+// When the quota is used up, Read and Write fail.
+func (c *Client) Meter(conn net.Conn) net.Conn {
+	if c == anonymous {
+		return conn
+	}
+	return &meteredConn{Conn: conn, client: c}
+}
+
+type meteredConn struct {
+	net.Conn
+	client *Client
+}
+
+func (c *meteredConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if qerr := c.client.use(n); err == nil && qerr != nil {
+		err = qerr
+	}
+	return n, err
+}
+
+func (c *meteredConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if qerr := c.client.use(n); err == nil && qerr != nil {
+		err = qerr
+	}
+	return n, err
+}
+
+// bucket is a token bucket, filled rate tokens per second up to burst.
+type bucket struct {
+	lock   sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(rate int64) *bucket {
+	return &bucket{
+		rate:   float64(rate),
+		burst:  float64(rate),
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+// take removes n tokens, and returns how long to wait until they are filled.
+func (b *bucket) take(n int) time.Duration {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// Clients are the identities allowed to use the tunnels.
+// A nil Clients allows everyone without limits.
+type Clients struct {
+	m map[string]*Client
+}
+
+// ReadClients reads the clients from r. Each line is the name, password
+// and the limits as key=value, separated by spaces, e.g.
+//
+//	alice	secret	rate=1M	tunnels=16	daily=2G	monthly=30G
+//
+// Lines starting with # are ignored.
+func ReadClients(r io.Reader) (*Clients, error) {
+	cs := &Clients{m: make(map[string]*Client)}
+	scr := bufio.NewScanner(r)
+	for scr.Scan() {
+		line := strings.TrimSpace(scr.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		t := strings.Fields(line)
+		if len(t) < 2 {
+			return nil, errors.New("Failed to parse line: " + line)
+		}
+		c := &Client{Name: t[0], password: t[1]}
+		for _, kv := range t[2:] {
+			f := strings.SplitN(kv, "=", 2)
+			if len(f) != 2 {
+				return nil, errors.New("Failed to parse limit: " + kv)
+			}
+			n, err := parseSize(f[1])
+			if err != nil {
+				return nil, errors.New("Failed to parse limit: " + kv)
+			}
+			switch f[0] {
+			case "rate":
+				c.Rate = n
+			case "tunnels":
+				c.Tunnels = int(n)
+			case "daily":
+				c.Daily = n
+			case "monthly":
+				c.Monthly = n
+			default:
+				return nil, errors.New("Unknown limit: " + kv)
+			}
+		}
+		if c.Rate > 0 {
+			c.bucket = newBucket(c.Rate)
+		}
+		cs.m[c.Name] = c
+	}
+	return cs, scr.Err()
+}
+
+// parseSize parses a number with optional suffix K, M or G (of 1024).
+func parseSize(s string) (int64, error) {
+	if s == "" {
+		return 0, errors.New("Empty size")
+	}
+	mul := int64(1)
+	switch strings.ToUpper(s[len(s)-1:]) {
+	case "K":
+		mul = 1 << 10
+	case "M":
+		mul = 1 << 20
+	case "G":
+		mul = 1 << 30
+	}
+	if mul > 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	return n * mul, err
+}
+
+// Auth returns the client of the Basic credentials of r.
+func (cs *Clients) Auth(r *http.Request) (*Client, bool) {
+	if cs == nil {
+		return anonymous, true
+	}
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, false
+	}
+	c, ok := cs.m[user]
+	if !ok || subtle.ConstantTimeCompare([]byte(password), []byte(c.password)) != 1 {
+		return nil, false
+	}
+	return c, true
+}
+
+// SaveUsage writes the usage of all clients to w.
+func (cs *Clients) SaveUsage(w io.Writer) error {
+	if cs == nil {
+		return nil
+	}
+	for _, c := range cs.m {
+		c.lock.Lock()
+		u := c.usage
+		c.lock.Unlock()
+		if u.Day == "" {
+			continue
+		}
+		if _, err := fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%d\n", c.Name, u.Day, u.DayBytes, u.Month, u.MonthBytes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadUsage reads the usage written by SaveUsage.
+func (cs *Clients) ReadUsage(r io.Reader) error {
+	scr := bufio.NewScanner(r)
+	for scr.Scan() {
+		t := strings.Split(scr.Text(), "\t")
+		if len(t) != 5 {
+			fmt.Println("Failed to parse line:", scr.Text())
+			continue
+		}
+		c, ok := cs.m[t[0]]
+		if !ok {
+			continue
+		}
+		day, err1 := strconv.ParseInt(t[2], 10, 64)
+		month, err2 := strconv.ParseInt(t[4], 10, 64)
+		if err1 != nil || err2 != nil {
+			fmt.Println("Failed to parse line:", scr.Text())
+			continue
+		}
+		c.lock.Lock()
+		c.usage = usage{Day: t[1], DayBytes: day, Month: t[3], MonthBytes: month}
+		c.lock.Unlock()
+	}
+	return scr.Err()
+}
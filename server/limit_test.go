@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+const clientsFile = "# name password limits\n" +
+	"alice\tsecret\trate=1M\ttunnels=2\tdaily=2G\tmonthly=30G\n" +
+	"bob secret2 daily=100\n"
+
+func readClients(t *testing.T) *Clients {
+	cs, err := ReadClients(strings.NewReader(clientsFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cs
+}
+
+func TestReadClients(t *testing.T) {
+	cs := readClients(t)
+	a := cs.m["alice"]
+	if a == nil || a.Rate != 1<<20 || a.Tunnels != 2 || a.Daily != 2<<30 || a.Monthly != 30<<30 || a.bucket == nil {
+		t.Fatalf("Wrong client: %+v", a)
+	}
+	if b := cs.m["bob"]; b == nil || b.Daily != 100 || b.Rate != 0 || b.bucket != nil {
+		t.Fatalf("Wrong client: %+v", b)
+	}
+
+	for _, s := range []string{"alice", "alice secret rate", "alice secret speed=1", "alice secret rate=xM"} {
+		if _, err := ReadClients(strings.NewReader(s)); err == nil {
+			t.Fatalf("%q: expect error", s)
+		}
+	}
+}
+
+func TestClientAuth(t *testing.T) {
+	r, _ := http.NewRequest("GET", "http://localhost/p", nil)
+	if c, ok := (*Clients)(nil).Auth(r); !ok || c != anonymous {
+		t.Fatal("Nil clients should allow everyone")
+	}
+
+	cs := readClients(t)
+	if _, ok := cs.Auth(r); ok {
+		t.Fatal("Allowed without credentials")
+	}
+	r.SetBasicAuth("alice", "wrong")
+	if _, ok := cs.Auth(r); ok {
+		t.Fatal("Allowed with wrong password")
+	}
+	r.SetBasicAuth("alice", "secret")
+	if c, ok := cs.Auth(r); !ok || c.Name != "alice" {
+		t.Fatal("Not allowed with correct password")
+	}
+}
+
+func TestClientTunnels(t *testing.T) {
+	c := readClients(t).m["alice"]
+	r1, err := c.Acquire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Acquire(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Acquire(); err != errTooManyTunnels {
+		t.Fatalf("expect %v see %v", errTooManyTunnels, err)
+	}
+	r1()
+	r1() // release twice is fine
+	if _, err := c.Acquire(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Acquire(); err != errTooManyTunnels {
+		t.Fatalf("expect %v see %v", errTooManyTunnels, err)
+	}
+}
+
+func TestClientQuota(t *testing.T) {
+	c := readClients(t).m["bob"]
+	a, b := net.Pipe()
+	defer a.Close()
+	m := c.Meter(a)
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			if _, err := b.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	if _, err := m.Write(make([]byte, 60)); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Check(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Write(make([]byte, 60)); err != errDailyQuota {
+		t.Fatalf("expect %v see %v", errDailyQuota, err)
+	}
+	if err := c.Check(); err != errDailyQuota {
+		t.Fatalf("expect %v see %v", errDailyQuota, err)
+	}
+
+	// a new day
+	c.usage.Day = "2000-01-01"
+	if err := c.Check(); err != nil {
+		t.Fatal(err)
+	}
+	if c.usage.DayBytes != 0 || c.usage.MonthBytes != 120 {
+		t.Fatalf("Wrong usage: %+v", c.usage)
+	}
+}
+
+func TestBucket(t *testing.T) {
+	b := newBucket(1000)
+	if d := b.take(1000); d != 0 {
+		t.Fatalf("Burst should not wait: %v", d)
+	}
+	if d := b.take(500); d < 400*time.Millisecond || d > 500*time.Millisecond {
+		t.Fatalf("Wrong wait: %v", d)
+	}
+}
+
+func TestUsage(t *testing.T) {
+	cs := readClients(t)
+	cs.m["alice"].use(1234)
+	var buf bytes.Buffer
+	if err := cs.SaveUsage(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(buf.String(), "bob") {
+		t.Fatalf("Unused client is saved: %q", buf.String())
+	}
+
+	cs2 := readClients(t)
+	if err := cs2.ReadUsage(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if u := cs2.m["alice"].usage; u != cs.m["alice"].usage || u.DayBytes != 1234 {
+		t.Fatalf("Wrong usage: %+v", u)
+	}
+}
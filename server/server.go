@@ -2,84 +2,53 @@ package main
 
 import (
 	"bufio"
-	"encoding/hex"
+	"context"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/ramuchu/fetch"
-
-	_ "net/http/pprof"
 )
 
-func EchoServer2(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("echo2")
-	c, _, err := w.(http.Hijacker).Hijack()
-	if err != nil {
-     	panic("cannot hijack http")
-	}
-	defer c.Close()
+// egress dials the destinations of tunnels.
+var egress = NewEgress()
 
-	tee := io.TeeReader(c, os.Stdout)
-	c.Write([]byte("HTTP/1.0 200 OK\r\n\r\n"))
-	fmt.Println("start echo2...")
-	io.Copy(c, tee)
-}
+// Tunnels serves the tunnels, each stage of them is limited by Timeouts.
+type Tunnels struct {
+	Timeouts Timeouts
 
-func EchoServer3(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("echo3")
-	c, _, err := w.(http.Hijacker).Hijack()
-	if err != nil {
-		panic("cannot hijack http")
-	}
-	defer c.Close()
-
-	tee := io.TeeReader(c, os.Stdout)
-	c.Write([]byte("HTTP/1.0 200 OK\r\n\r\n"))
-	fmt.Println("start echo2...")
-	ibuf := make([]byte, 1024)
-	obuf := make([]byte, 2*1024)
-	var n int
-	var ierr, oerr error
-	for ierr == nil && oerr == nil {
-		n, ierr = tee.Read(ibuf)
-		n = hex.Encode(obuf, ibuf[:n])
-		_, oerr = c.Write(obuf[:n])
-	}
+	// dialer dials the destinations, it is egress by default.
+	dialer    Dialer
+	transport *http.Transport
 }
 
-func WebServer(w http.ResponseWriter, r *http.Request) {
-	val := r.URL.Query()
-	q := val.Get("q")
-	if q == "" {
-		q = "http://httpbin.org/ip"
-	}
-	resp, err := http.Get(q)
-	if err != nil {
-		fmt.Fprintln(w, err)
-		return
+// NewTunnels returns Tunnels in the timeouts to.
+func NewTunnels(to Timeouts) *Tunnels {
+	t := &Tunnels{Timeouts: to, dialer: egress}
+	t.transport = &http.Transport{
+		DialContext:           t.dial,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   to.TLS,
+		ResponseHeaderTimeout: to.Header,
+		ExpectContinueTimeout: 1 * time.Second,
 	}
-	resp.Write(w)
+	return t
 }
 
-func WebServer2(w http.ResponseWriter, r *http.Request) {
-	val := r.URL.Query()
-	q := val.Get("q")
-	if q == "" {
-		q = "http://httpbin.org/ip"
-	}
-	resp, err := http.Get(q)
-	if err != nil {
-		fmt.Fprintln(w, err)
-		return
-	}
-	pushResponse(w, resp)
-}
+// tunnels serves the tunnels in the timeouts of the environment, and its
+// transport sends the other requests to the destinations.
+var tunnels = NewTunnels(getTimeouts())
 
-func serveGET(ws net.Conn, req *http.Request) {
+// serveGET sends req to its host, and writes the response to ws.
+// It returns false if the tunnel cannot be used for the next request.
+// If the host switches protocols, ws is piped to it, and the rest is read from r.
+// The request is canceled by idle, if the host stalls.
+func (t *Tunnels) serveGET(ws net.Conn, r io.Reader, req *http.Request, idle *idleTimer) bool {
 	fmt.Println("req.RequestURI", req.RequestURI)
 	req.RequestURI = ""
 	fmt.Println("req.URL.Scheme", req.URL.Scheme)
@@ -88,98 +57,260 @@ func serveGET(ws net.Conn, req *http.Request) {
 	req.URL.Host = req.Host
 	fmt.Println("URL", req.URL.RequestURI())
 
-	resp, err := http.DefaultTransport.RoundTrip(req)
+	// The connection to the host is not the one of client
+	keepAlive := !req.Close
+	protocol := fetch.Upgrade(req.Header)
+	fetch.RemoveHopHeaders(req.Header)
+	fetch.SetUpgrade(req.Header, protocol)
+	req.Close = false
+
+	ctx, cancel := idle.Context(req.Context())
+	defer cancel()
+	resp, err := t.roundTrip(req.WithContext(ctx))
 	if err != nil {
 		fmt.Println(err)
-		io.WriteString(ws, "HTTP/1.1 400 Bad Request\r\nContent-Type: text/plain\r\nConnection: close\r\n\r\n400 Bad Request: "+err.Error())
-		return
+		if isTimeout(err) {
+			writeTimeout(ws, err)
+		} else {
+			writeError(ws, http.StatusBadRequest, err.Error())
+		}
+		return false
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		serveUpgrade(ws, r, resp)
+		return false
+	}
+
+	// Always reply in HTTP/1.1, and chunk the body of unknown length,
+	// so the end of the response does not depend on closing the tunnel.
+	fetch.RemoveHopHeaders(resp.Header)
+	resp.Proto, resp.ProtoMajor, resp.ProtoMinor = "HTTP/1.1", 1, 1
+	resp.TransferEncoding = nil
+	if resp.ContentLength < 0 {
+		resp.TransferEncoding = []string{"chunked"}
+	}
+	resp.Close = !keepAlive
+	if err := resp.Write(ws); err != nil {
+		return false
 	}
-	resp.Write(ws)
+	return keepAlive
 }
 
-func serveCONNECT(ws net.Conn, req *http.Request) {
-	host := req.URL.Host
-	fmt.Println("CONNECTING", host, "...")
-	transport, ok := http.DefaultTransport.(*http.Transport)
+// serveUpgrade writes the 101 response to ws, and pipes ws to the upgraded
+// connection of resp.
+func serveUpgrade(ws net.Conn, r io.Reader, resp *http.Response) {
+	up, ok := resp.Body.(io.ReadWriteCloser)
 	if !ok {
-		fmt.Println("ERR: cannot resolve DefaultTransport")
-		io.WriteString(ws, "HTTP/1.1 500 Internal Server Error\r\nContent-Type: text/plain\r\nConnection: close\r\n\r\n500 Internal Server Error: cannot resolve DefaultTransport")
+		writeError(ws, http.StatusBadGateway, "Cannot switch protocols")
+		return
+	}
+	if err := fetch.WriteUpgrade(ws, resp); err != nil {
 		return
 	}
-	c, err := transport.DialContext(req.Context(), "tcp", host)
+	fmt.Println("start upgraded tunnel...")
+	go func() {
+		io.Copy(ws, up)
+		ws.Close()
+	}()
+	io.Copy(up, r)
+	up.Close()
+}
+
+// serveCONNECT pipes ws to the host of req. Both are closed by idle if
+// the tunnel is stuck.
+func (t *Tunnels) serveCONNECT(ws net.Conn, r io.Reader, req *http.Request, idle *idleTimer) {
+	host := req.URL.Host
+	fmt.Println("CONNECTING", host, "...")
+	c, err := t.dial(context.Background(), "tcp", host)
 	if err != nil {
 		fmt.Println("ERR:", err)
-		io.WriteString(ws, "HTTP/1.1 500 Internal Server Error\r\nContent-Type: text/plain\r\nConnection: close\r\n\r\n500 Internal Server Error: "+err.Error())
+		if err == errDialTimeout {
+			writeTimeout(ws, err)
+		} else {
+			writeError(ws, http.StatusInternalServerError, err.Error())
+		}
 		return
 	}
+	c = idle.Watch(c)
 	ws.Write([]byte("HTTP/1.0 200 OK\r\n\r\n"))
 	fmt.Println("start tunnel...")
 	go func() {
 		io.Copy(ws, c)
 		ws.Close()
 	}()
-	io.Copy(c, ws)
+	io.Copy(c, r)
 	c.Close()
 }
 
+// writeError writes a response of code with msg to the tunnel, and the
+// tunnel should be closed after.
+func writeError(w io.Writer, code int, msg string) {
+	status := fmt.Sprintf("%d %s", code, http.StatusText(code))
+	if msg != "" {
+		msg = ": " + msg
+	}
+	io.WriteString(w, "HTTP/1.1 "+status+"\r\nContent-Type: text/plain\r\nConnection: close\r\n\r\n"+status+msg)
+}
+
 var upgrader = websocket.Upgrader{}
 
-func wsProxy(w http.ResponseWriter, r *http.Request) {
+// clients are allowed to use the tunnels. If it is nil, everyone is allowed.
+var clients *Clients
+
+func (t *Tunnels) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	client, ok := clients.Auth(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="fetch"`)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
 	ws, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		fmt.Println("wsProxy error", err)
+		fmt.Println("tunnel error", err)
 		return
 	}
 
-	conn := fetch.NewServerConn(ws.UnderlyingConn(), 0x56)
-	req, err := http.ReadRequest(bufio.NewReader(conn))
+	idle := newIdleTimer(t.Timeouts.Idle)
+	defer idle.Stop()
+	conn := idle.Watch(client.Meter(fetch.NewServerConn(ws.UnderlyingConn(), 0x56)))
+	defer conn.Close()
+
+	release, err := client.Acquire()
 	if err != nil {
-		io.WriteString(conn, "HTTP/1.1 400 Bad Request\r\nContent-Type: text/plain\r\nConnection: close\r\n\r\n400 Bad Request")
+		fmt.Println("client", client.Name, err)
+		writeError(conn, http.StatusTooManyRequests, err.Error())
 		return
 	}
-	//b, _ := httputil.DumpRequestOut(req, true)
-	//os.Stdout.Write(b)
+	defer release()
 
-	fmt.Println("req.Method", req.Method)
-	switch req.Method {
-	case "CONNECT":
-		serveCONNECT(conn, req)
-	default:
-		serveGET(conn, req)
+	// Serve the requests one by one until the tunnel is switched to other
+	// mode, or closed. Pipelined requests wait in the buffer.
+	br := bufio.NewReader(conn)
+	for {
+		// wait for the next request until idle, then read it in time
+		if _, err := br.Peek(1); err != nil {
+			return
+		}
+		if t.Timeouts.Header > 0 {
+			conn.SetReadDeadline(time.Now().Add(t.Timeouts.Header))
+		}
+		req, err := http.ReadRequest(br)
+		conn.SetReadDeadline(time.Time{})
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				writeTimeout(conn, errRequestTimeout)
+			} else if err != io.EOF && !idle.Expired() {
+				writeError(conn, http.StatusBadRequest, "")
+			}
+			return
+		}
+		//b, _ := httputil.DumpRequestOut(req, true)
+		//os.Stdout.Write(b)
+
+		fmt.Println("req.Method", req.Method)
+		if err := client.Check(); err != nil {
+			fmt.Println("client", client.Name, err)
+			writeError(conn, http.StatusTooManyRequests, err.Error())
+			return
+		}
+		switch req.Method {
+		case "CONNECT":
+			t.serveCONNECT(conn, br, req, idle)
+			return
+		case fetch.MethodDatagram:
+			serveDatagram(conn, br)
+			return
+		case fetch.MethodDNS:
+			serveDNS(conn, br)
+			return
+		default:
+			if !t.serveGET(conn, br, req, idle) {
+				return
+			}
+		}
 	}
 }
 
 func main() {
-	http.HandleFunc("/echo3", EchoServer3)
-	http.HandleFunc("/web", WebServer)
-	http.HandleFunc("/web2", WebServer2)
-	http.HandleFunc("/p", wsProxy)
+	// only the tunnel and /fetch are served, nothing else of the server is
+	// visible even to the clients
+	mux := http.NewServeMux()
+	mux.HandleFunc("/fetch", FetchServer)
+	mux.Handle(getTunnelPath(), tunnels)
 	//proxy := NewProxyListener(nil)
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		fmt.Println("Hello world")
-		fmt.Fprintf(w, "Hello world!")
-	})
+
+	if f := getEgress(); f != "" {
+		r, err := os.Open(f)
+		if err != nil {
+			panic(err)
+		}
+		err = egress.Read(r)
+		r.Close()
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	if f := getClients(); f != "" {
+		r, err := os.Open(f)
+		if err != nil {
+			panic(err)
+		}
+		clients, err = ReadClients(r)
+		r.Close()
+		if err != nil {
+			panic(err)
+		}
+		if r, err := os.Open(getUsage()); err == nil {
+			clients.ReadUsage(r)
+			r.Close()
+		}
+		go saveUsage(getUsage())
+	}
+
+	// only the clients can see the tunnel behind the decoy
+	var handler http.Handler = mux
+	if d := getDecoy(); d != "" {
+		if clients == nil {
+			panic("DECOY requires CLIENTS")
+		}
+		decoy, err := NewDecoy(d)
+		if err != nil {
+			panic(err)
+		}
+		handler = &Camouflage{Decoy: decoy, Private: mux}
+	}
 
 	bind := getIP() + ":" + getPort()
 	fmt.Println("Listening to", bind)
 
-	err := http.ListenAndServe(bind, nil)
+	server := &http.Server{Addr: bind, Handler: handler, ReadHeaderTimeout: tunnels.Timeouts.Header}
+	err := server.ListenAndServe()
 	if err != nil {
 		panic(err)
 	}
 }
 
-func pushResponse(w http.ResponseWriter, resp *http.Response) {
-	hj, ok := w.(http.Hijacker)
-	if !ok {
-		http.Error(w, "webserver doesn't support hijacking", http.StatusInternalServerError)
-		return
-	}
-	conn, _, err := hj.Hijack()
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+// saveUsage writes the usage of clients to file every minute.
+func saveUsage(file string) {
+	for range time.Tick(time.Minute) {
+		f, err := os.Create(file + ".tmp")
+		if err != nil {
+			fmt.Println("ERR:", err)
+			continue
+		}
+		err = clients.SaveUsage(f)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil {
+			err = os.Rename(file+".tmp", file)
+		}
+		if err != nil {
+			fmt.Println("ERR:", err)
+		}
 	}
-	defer conn.Close()
-	resp.Write(conn)
 }
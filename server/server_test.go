@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestTunnelUpgrade(t *testing.T) {
+	var upgrader websocket.Upgrader
+	echo := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer ws.Close()
+		for {
+			typ, b, err := ws.ReadMessage()
+			if err != nil {
+				return
+			}
+			ws.WriteMessage(typ, b)
+		}
+	}))
+	defer echo.Close()
+	s := httptest.NewServer(tunnels)
+	defer s.Close()
+
+	// the websocket to echo is sent as a plain http request in the tunnel
+	d := &websocket.Dialer{NetDial: func(network, addr string) (net.Conn, error) {
+		return openTunnel(t, s), nil
+	}}
+	ws, _, err := d.Dial("ws"+strings.TrimPrefix(echo.URL, "http")+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	for _, v := range []string{"hello", "world"} {
+		if err := ws.WriteMessage(websocket.TextMessage, []byte(v)); err != nil {
+			t.Fatal(err)
+		}
+		_, b, err := ws.ReadMessage()
+		if err != nil || string(b) != v {
+			t.Fatalf("expect %q see %q %v", v, b, err)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var errDialTimeout = errors.New("Dial timeout")
+var errTLSTimeout = errors.New("TLS handshake timeout")
+var errHeaderTimeout = errors.New("Response header timeout")
+var errRequestTimeout = errors.New("Request header timeout")
+
+// Timeouts of each stage of the tunnels. Zero means no timeout.
+type Timeouts struct {
+	// Dial is the time to connect to the destination.
+	Dial time.Duration
+	// TLS is the time of TLS handshake with the destination.
+	TLS time.Duration
+	// Header is the time to read the header of a request from the client,
+	// or of a response from the destination.
+	Header time.Duration
+	// Idle is the time a tunnel can be open without any traffic.
+	Idle time.Duration
+}
+
+// dial connects to addr through the dialer in t.Timeouts.Dial.
+func (t *Tunnels) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	if t.Timeouts.Dial > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.Timeouts.Dial)
+		defer cancel()
+	}
+	c, err := t.dialer.DialContext(ctx, network, addr)
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+		return nil, errDialTimeout
+	}
+	return c, err
+}
+
+// the stages of a request to the destination
+const (
+	stageDial = iota
+	stageTLS
+	stageWrite
+	stageHeader
+)
+
+// roundTrip sends req by the transport. A timeout is returned as the error
+// of the stage where it happens, see isTimeout.
+func (t *Tunnels) roundTrip(req *http.Request) (*http.Response, error) {
+	stage := int32(stageDial)
+	trace := &httptrace.ClientTrace{
+		TLSHandshakeStart: func() { atomic.StoreInt32(&stage, stageTLS) },
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			if err == nil {
+				atomic.StoreInt32(&stage, stageWrite)
+			}
+		},
+		GotConn:      func(httptrace.GotConnInfo) { atomic.StoreInt32(&stage, stageWrite) },
+		WroteRequest: func(httptrace.WroteRequestInfo) { atomic.StoreInt32(&stage, stageHeader) },
+	}
+	resp, err := t.transport.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+	if errors.Is(err, errDialTimeout) {
+		return nil, errDialTimeout
+	}
+	var ne net.Error
+	if !errors.As(err, &ne) || !ne.Timeout() {
+		return resp, err
+	}
+	switch atomic.LoadInt32(&stage) {
+	case stageTLS:
+		return nil, errTLSTimeout
+	case stageHeader:
+		return nil, errHeaderTimeout
+	}
+	return resp, err
+}
+
+// isTimeout reports whether err is the timeout of a stage.
+func isTimeout(err error) bool {
+	switch err {
+	case errDialTimeout, errTLSTimeout, errHeaderTimeout, errRequestTimeout:
+		return true
+	}
+	return false
+}
+
+// writeTimeout writes the response of a timeout to the tunnel.
+func writeTimeout(w io.Writer, err error) {
+	code := http.StatusGatewayTimeout
+	if err == errRequestTimeout {
+		code = http.StatusRequestTimeout
+	}
+	writeError(w, code, err.Error())
+}
+
+// idleTimer closes the conns it watches, when none of them is read or
+// written for d.
+type idleTimer struct {
+	d     time.Duration
+	last  int64 // UnixNano of the last read or write
+	timer *time.Timer
+
+	lock    sync.Mutex
+	conns   []io.Closer
+	expired bool
+}
+
+func newIdleTimer(d time.Duration) *idleTimer {
+	t := &idleTimer{d: d, last: time.Now().UnixNano()}
+	if d > 0 {
+		t.timer = time.AfterFunc(d, t.check)
+	}
+	return t
+}
+
+func (t *idleTimer) check() {
+	idle := time.Since(time.Unix(0, atomic.LoadInt64(&t.last)))
+	if idle < t.d {
+		t.timer.Reset(t.d - idle)
+		return
+	}
+	t.lock.Lock()
+	t.expired = true
+	conns := t.conns
+	t.lock.Unlock()
+	for _, c := range conns {
+		c.Close()
+	}
+}
+
+// Expired reports whether the conns are closed by the timer.
+func (t *idleTimer) Expired() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.expired
+}
+
+// Stop stops the timer, the conns are not closed.
+func (t *idleTimer) Stop() {
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+}
+
+// Context returns a context of parent, which is canceled when the timer
+// expires. The returned function must be called when the context is done.
+func (t *idleTimer) Context(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	c := &cancelCloser{cancel}
+	t.lock.Lock()
+	expired := t.expired
+	if !expired {
+		t.conns = append(t.conns, c)
+	}
+	t.lock.Unlock()
+	if expired {
+		cancel()
+	}
+	return ctx, func() {
+		cancel()
+		t.lock.Lock()
+		conns := make([]io.Closer, 0, len(t.conns))
+		for _, v := range t.conns {
+			if v != c {
+				conns = append(conns, v)
+			}
+		}
+		t.conns = conns
+		t.lock.Unlock()
+	}
+}
+
+// cancelCloser cancels a context when it is closed.
+type cancelCloser struct {
+	cancel context.CancelFunc
+}
+
+func (c *cancelCloser) Close() error {
+	c.cancel()
+	return nil
+}
+
+// Watch returns conn which counts as activity when it is read or written.
+func (t *idleTimer) Watch(c net.Conn) net.Conn {
+	t.lock.Lock()
+	expired := t.expired
+	if !expired {
+		t.conns = append(t.conns, c)
+	}
+	t.lock.Unlock()
+	if expired {
+		c.Close()
+	}
+	return &idleConn{Conn: c, timer: t}
+}
+
+type idleConn struct {
+	net.Conn
+	timer *idleTimer
+}
+
+func (c *idleConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		atomic.StoreInt64(&c.timer.last, time.Now().UnixNano())
+	}
+	return n, err
+}
+
+func (c *idleConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		atomic.StoreInt64(&c.timer.last, time.Now().UnixNano())
+	}
+	return n, err
+}
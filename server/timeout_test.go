@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/ramuchu/fetch"
+)
+
+// silent accepts the connections and never replies.
+func silent(t *testing.T) string {
+	return listen(t, func(c net.Conn) {
+		io.Copy(ioutil.Discard, c)
+		c.Close()
+	})
+}
+
+// openTunnel opens a tunnel to s, which serves Tunnels.
+func openTunnel(t *testing.T, s *httptest.Server) net.Conn {
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http")+"/p", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fetch.NewClientConn(ws.UnderlyingConn(), 0x56)
+}
+
+func TestDialTimeout(t *testing.T) {
+	tun := NewTunnels(Timeouts{Dial: 100 * time.Millisecond})
+	tun.dialer, _ = NewDialer("http://"+silent(t), directDialer())
+
+	_, err := tun.dial(context.Background(), "tcp", "slow.example:443")
+	if err != errDialTimeout {
+		t.Fatalf("expect %v see %v", errDialTimeout, err)
+	}
+	req, _ := http.NewRequest("GET", "http://slow.example/", nil)
+	if _, err := tun.roundTrip(req); err != errDialTimeout {
+		t.Fatalf("expect %v see %v", errDialTimeout, err)
+	}
+}
+
+func TestHeaderTimeout(t *testing.T) {
+	tun := NewTunnels(Timeouts{Header: 100 * time.Millisecond})
+	req, _ := http.ReadRequest(bufio.NewReader(strings.NewReader("GET / HTTP/1.1\r\nHost: " + silent(t) + "\r\n\r\n")))
+	ws, c := net.Pipe()
+	go func() {
+		tun.serveGET(ws, ws, req, newIdleTimer(0))
+		ws.Close()
+	}()
+	resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusGatewayTimeout || !strings.Contains(string(b), errHeaderTimeout.Error()) {
+		t.Fatalf("Wrong response: %d %s", resp.StatusCode, b)
+	}
+}
+
+func TestTLSTimeout(t *testing.T) {
+	tun := NewTunnels(Timeouts{TLS: 100 * time.Millisecond})
+	req, _ := http.NewRequest("GET", "https://"+silent(t)+"/", nil)
+	if _, err := tun.roundTrip(req); err != errTLSTimeout {
+		t.Fatalf("expect %v see %v", errTLSTimeout, err)
+	}
+}
+
+func TestIdleTimer(t *testing.T) {
+	tm := newIdleTimer(100 * time.Millisecond)
+	defer tm.Stop()
+	a, b := net.Pipe()
+	c, d := net.Pipe()
+	wa, wc := tm.Watch(a), tm.Watch(c)
+	go io.Copy(ioutil.Discard, b)
+
+	// activity keeps the conns open
+	for i := 0; i < 5; i++ {
+		time.Sleep(40 * time.Millisecond)
+		if _, err := wa.Write([]byte("x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if tm.Expired() {
+		t.Fatal("Expired with activity")
+	}
+
+	// the stuck one is closed as well
+	if _, err := wc.Read(make([]byte, 1)); err == nil {
+		t.Fatal("expect error of closed conn")
+	}
+	if !tm.Expired() {
+		t.Fatal("Not expired")
+	}
+	d.Close()
+}
+
+func TestTunnelTimeouts(t *testing.T) {
+	s := httptest.NewServer(NewTunnels(Timeouts{Header: 100 * time.Millisecond, Idle: 300 * time.Millisecond}))
+	defer s.Close()
+
+	// an incomplete request
+	c := openTunnel(t, s)
+	defer c.Close()
+	io.WriteString(c, "GET / HTTP/1.1\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusRequestTimeout {
+		t.Fatalf("Wrong status: %d", resp.StatusCode)
+	}
+
+	// an idle tunnel is closed without response
+	c = openTunnel(t, s)
+	defer c.Close()
+	start := time.Now()
+	if n, err := c.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("expect error, read %d", n)
+	}
+	if d := time.Since(start); d < 200*time.Millisecond {
+		t.Fatalf("Closed too early: %v", d)
+	}
+}
+
+func TestStalledBody(t *testing.T) {
+	// the host sends the header, then stalls in the body
+	closed := make(chan struct{})
+	host := listen(t, func(c net.Conn) {
+		http.ReadRequest(bufio.NewReader(c))
+		io.WriteString(c, "HTTP/1.1 200 OK\r\nContent-Length: 100\r\n\r\nabc")
+		c.Read(make([]byte, 1))
+		close(closed)
+	})
+	s := httptest.NewServer(NewTunnels(Timeouts{Idle: 200 * time.Millisecond}))
+	defer s.Close()
+
+	c := openTunnel(t, s)
+	defer c.Close()
+	io.WriteString(c, "GET / HTTP/1.1\r\nHost: "+host+"\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(resp.Body); err == nil {
+		t.Fatal("expect error of the body cut")
+	}
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the connection to the host is not closed")
+	}
+}
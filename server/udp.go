@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/ramuchu/fetch"
+)
+
+// udpIdle is how long a flow is kept in the NAT table without any packet.
+// The association itself is closed when it has been idle for the same time.
+var udpIdle = 2 * time.Minute
+
+// udpFlow is an entry of the NAT table, a UDP socket connected to addr.
+type udpFlow struct {
+	conn net.Conn
+	addr string
+	last int64 // unix nano of last packet
+}
+
+func (f *udpFlow) touch() {
+	atomic.StoreInt64(&f.last, time.Now().UnixNano())
+}
+
+func (f *udpFlow) idle(now time.Time) bool {
+	return now.Sub(time.Unix(0, atomic.LoadInt64(&f.last))) > udpIdle
+}
+
+// udpAssoc relays the datagrams of a tunnel. Each destination gets its own
+// socket, so the replies can be sent back with the address the client asked.
+type udpAssoc struct {
+	ws    net.Conn
+	wlock sync.Mutex
+
+	lock  sync.Mutex
+	flows map[string]*udpFlow
+	last  time.Time
+}
+
+// serveDatagram serves the tunnel in datagram mode, see fetch.MethodDatagram.
+func serveDatagram(ws net.Conn, r io.Reader) {
+	fmt.Println("start datagram...")
+	a := &udpAssoc{
+		ws:    ws,
+		flows: make(map[string]*udpFlow),
+		last:  time.Now(),
+	}
+	ws.Write([]byte("HTTP/1.0 200 OK\r\n\r\n"))
+
+	done := make(chan struct{})
+	go a.expire(done)
+
+	b := make([]byte, fetch.MaxDatagram)
+	for {
+		n, addr, err := fetch.ReadDatagram(r, b)
+		if err != nil {
+			break
+		}
+		f, err := a.flow(addr)
+		if err != nil {
+			fmt.Println("ERR:", err)
+			continue
+		}
+		f.touch()
+		f.conn.Write(b[:n])
+	}
+
+	close(done)
+	ws.Close()
+	a.lock.Lock()
+	for k, f := range a.flows {
+		f.conn.Close()
+		delete(a.flows, k)
+	}
+	a.lock.Unlock()
+}
+
+// flow returns the flow to addr, or creates it if it is not in the table.
+func (a *udpAssoc) flow(addr string) (*udpFlow, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.last = time.Now()
+	if f, ok := a.flows[addr]; ok {
+		return f, nil
+	}
+	c, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	f := &udpFlow{conn: c, addr: addr}
+	a.flows[addr] = f
+	go a.reply(f)
+	return f, nil
+}
+
+// reply sends the packets from f back to the tunnel.
+func (a *udpAssoc) reply(f *udpFlow) {
+	b := make([]byte, fetch.MaxDatagram)
+	for {
+		n, err := f.conn.Read(b)
+		if err != nil {
+			// ICMP port unreachable of a previous packet, keep the flow until it expires
+			if errors.Is(err, syscall.ECONNREFUSED) {
+				continue
+			}
+			return
+		}
+		f.touch()
+		a.wlock.Lock()
+		err = fetch.WriteDatagram(a.ws, f.addr, b[:n])
+		a.wlock.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// expire removes the idle flows, and closes the tunnel if nothing is left.
+func (a *udpAssoc) expire(done chan struct{}) {
+	t := time.NewTicker(udpIdle / 4)
+	defer t.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-t.C:
+			a.lock.Lock()
+			for k, f := range a.flows {
+				if f.idle(now) {
+					f.conn.Close()
+					delete(a.flows, k)
+				}
+			}
+			empty := len(a.flows) == 0 && now.Sub(a.last) > udpIdle
+			a.lock.Unlock()
+			if empty {
+				fmt.Println("datagram idle, closing")
+				a.ws.Close()
+				return
+			}
+		}
+	}
+}